@@ -1,22 +1,29 @@
 package cmd
 
 import (
+	"cmp"
 	"context"
-	"crypto/rand"
 	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"go-proxy/internal/config"
-	"go-proxy/internal/middleware"
 	"go-proxy/internal/service"
+	"net"
 
 	"net/http"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"syscall"
 	"time"
 
+	"go-proxy/internal/util/utilcert"
+	"go-proxy/internal/util/utilconfig"
 	xlog "go-proxy/internal/util/utillog"
+	"go-proxy/internal/util/utilnet"
+	"go-proxy/internal/util/utiltls"
 
+	"go-proxy/internal/middleware"
 	"go-proxy/internal/router"
 
 	"github.com/labstack/echo/v4"
@@ -29,7 +36,8 @@ type Command struct {
 	AppService service.AppService
 	WebDriver  *echo.Echo
 
-	stop context.CancelFunc
+	handler reloadableHandler
+	stop    context.CancelFunc
 }
 
 func (x *Command) Stop() {
@@ -48,8 +56,17 @@ func (x *Command) Exec() {
 	//
 
 	//
-	middleware.Init(x.WebDriver, x.AppService) // 1
-	router.Init(x.WebDriver, x.AppService)     // 2
+	handler, err := newAppHandler(x.AppService)
+	if err != nil {
+		xlog.Panic("%v", err)
+	}
+	x.handler.set(handler)
+
+	// middlewares and routes swapped on config reload
+	x.WebDriver.RouteNotFound("/*", x.handler.serve)
+	x.AppService.OnReload(x.handler.reload)
+
+	router.InitSys(x.WebDriver, x.AppService)
 
 	defer func() {
 
@@ -61,12 +78,16 @@ func (x *Command) Exec() {
 	time.Sleep(400 * time.Millisecond)
 }
 
-func applyServerTLS(s *http.Server, c *config.AppConfig) {
+// applyServerTLS session and protocol settings of TLS listener, key rotation stops on ctx done
+func applyServerTLS(ctx context.Context, s *http.Server, c *config.AppConfig) {
 
 	sessionCache := c.HTTPServer.TLSSessionCache
 	sessionTickets := c.HTTPServer.TLSSessionTickets
 
 	cfg := s.TLSConfig
+	if cfg == nil {
+		cfg = new(tls.Config)
+	}
 	//
 	if sessionCache {
 		sessionCacheSize := c.HTTPServer.TLSSessionCacheSize
@@ -78,35 +99,139 @@ func applyServerTLS(s *http.Server, c *config.AppConfig) {
 		xlog.Info("enabled TLS session cache: size: %v", sessionCacheSize)
 	}
 
-	if sessionTickets {
+	if sessionTickets || c.HTTPServer.TLSTicketKeys != "" {
 		//
 		cfg.SessionTicketsDisabled = false
-		go func() {
-			ticker := time.NewTicker(24 * time.Hour) // Rotate every 24 hours
-			defer ticker.Stop()
-			for range ticker.C {
-				var newKey [32]byte
-				_, err := rand.Read(newKey[:])
-				if err != nil {
-					xlog.Error("failed to generate session ticket key: %v", err)
-				} else {
-					cfg.SetSessionTicketKeys([][32]byte{newKey}) // Replace the keys
-				}
-			}
-		}()
 
-		xlog.Info("enabled TLS session tickets")
+		keys := utiltls.NewTicketKeys(c.HTTPServer.TLSTicketKeys)
+		if err := keys.Apply(cfg); err != nil {
+			xlog.Panic("error on load session ticket keys: %v", err)
+		}
+
+		rotate := time.Duration(c.HTTPServer.TLSTicketRotate) * time.Second
+		if rotate <= 0 {
+			rotate = 24 * time.Hour
+		}
+		go keys.Run(ctx, cfg, rotate)
+
+		xlog.Info("enabled TLS session tickets: keys: %v rotate: %v", cmp.Or(c.HTTPServer.TLSTicketKeys, "random"), rotate)
+	}
+
+	if err := c.TLSSettings().Apply(cfg); err != nil {
+		xlog.Panic("error on apply TLS settings: %v", err)
 	}
 
+	xlog.Info("TLS settings: preset: %v %v", cmp.Or(c.HTTPServer.TLSPreset, "none"), utiltls.Describe(cfg))
+
 	s.TLSConfig = cfg
 
 }
+
+// applyClientAuth client CAs and verify mode of listener, request mode if only routes verify
+func applyClientAuth(s *http.Server, c *config.AppConfig) {
+
+	clientAuth := c.HTTPServer.ClientAuth
+	if clientAuth.CA == "" {
+		return
+	}
+
+	data, err := os.ReadFile(clientAuth.CA)
+	if err != nil {
+		xlog.Panic("error on read client ca: %v", err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		xlog.Panic("no certificates in client ca: %v", clientAuth.CA)
+	}
+
+	cfg := s.TLSConfig
+	cfg.ClientCAs = pool
+
+	switch clientAuth.Verify {
+	case config.ClientAuthRequire:
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	case config.ClientAuthRequest:
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	default:
+		if len(c.RoutesClientAuth()) > 0 {
+			cfg.ClientAuth = tls.VerifyClientCertIfGiven
+		}
+	}
+
+	xlog.Info("enabled TLS client auth: %v ca: %v", cfg.ClientAuth, clientAuth.CA)
+}
+
+// applyAutoTLS account, CA and hosts of ACME manager, returns cert dir
+func applyAutoTLS(m *autocert.Manager, c *config.AppConfig) string {
+
+	certDir := c.HTTPServer.CertDir
+	certHosts := c.HTTPServer.CertHosts
+
+	xlog.Info("server hosts: %v", certHosts)
+
+	if certDir == "" {
+		xlog.Panic("certificate dir not defined")
+	}
+
+	if len(certHosts) == 0 {
+		xlog.Panic("certificate host not defined")
+	}
+
+	certDir, _ = filepath.Abs(certDir)
+
+	if _, err := os.Stat(certDir); os.IsNotExist(err) {
+		xlog.Panic("path not exists : %v error: %v", certDir, err)
+	}
+
+	xlog.Info("cert path: %v", certDir)
+
+	acmeConfig := c.HTTPServer.ACME
+
+	directoryURL := acmeConfig.DirectoryURL
+	if directoryURL == "" && c.Debug {
+		directoryURL = utilcert.LetsEncryptStagingURL
+	}
+
+	err := utilcert.ConfigureACME(m, certDir, certHosts, utilcert.ACMEOptions{
+		DirectoryURL: directoryURL,
+		CA:           acmeConfig.CA,
+		Email:        acmeConfig.Email,
+		EABKeyID:     acmeConfig.EABKeyID,
+		EABHMACKey:   acmeConfig.EABHMACKey,
+		RenewBefore:  time.Duration(acmeConfig.RenewBefore) * 24 * time.Hour,
+		Challenge:    acmeConfig.Challenge,
+	})
+	if err != nil {
+		xlog.Panic("error on configure ACME: %v", err)
+	}
+
+	xlog.Info("ACME directory: %v email: %v eab: %v challenge: %v",
+		cmp.Or(directoryURL, acme.LetsEncryptURL), acmeConfig.Email, acmeConfig.EABKeyID != "", cmp.Or(acmeConfig.Challenge, utilcert.ChallengeTLSALPN))
+
+	return certDir
+}
+
+// listenProxyProtocol tcp listener of address with PROXY protocol of trusted sources
+func listenProxyProtocol(listen string, c *config.AppConfig) net.Listener {
+
+	l, err := utilnet.Listen(listen, true, c.HTTPServer.ProxyProtocol.Trusted)
+	if err != nil {
+		xlog.Panic("error on listen %v: %v", listen, err)
+	}
+
+	xlog.Info("PROXY protocol on %v, trusted: %v", listen, c.HTTPServer.ProxyProtocol.Trusted)
+
+	return l
+}
+
 func applyServer(s *http.Server, c *config.AppConfig) {
 
 	s.ReadTimeout = time.Duration(c.HTTPServer.ReadTimeout) * time.Second
 	s.WriteTimeout = time.Duration(c.HTTPServer.WriteTimeout) * time.Second
 	s.IdleTimeout = time.Duration(c.HTTPServer.IdleTimeout) * time.Second
 	s.ReadHeaderTimeout = time.Duration(c.HTTPServer.ReadHeaderTimeout) * time.Second
+	s.ConnContext = utilnet.ConnContext // PROXY header of request
 
 }
 
@@ -122,6 +247,38 @@ func (x *Command) startWithGracefulShutdown() {
 	defer stop()
 	x.stop = stop
 
+	// Reload config on SIGHUP
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-hup:
+				xlog.Info("hangup signal")
+				_ = x.AppService.Reload() // error logged, current config kept
+			}
+		}
+	}()
+
+	// Reload config on change of files and urls
+
+	if appConfig.ConfigWatch > 0 {
+		watcher := utilconfig.NewWatcher(appConfig.ConfigPath, appConfig.ConfigFileName())
+		interval := time.Duration(appConfig.ConfigWatch) * time.Second
+
+		xlog.Info("config watch: %v interval: %v", appConfig.ConfigPath, interval)
+
+		go watcher.Start(ctx, interval, func(changed []string) {
+			xlog.Info("config source changed: %v", changed)
+			_ = x.AppService.Reload()
+		})
+	}
+
 	// Start server
 
 	{
@@ -140,6 +297,10 @@ func (x *Command) startWithGracefulShutdown() {
 				}
 			}()
 
+			if appConfig.HTTPServer.ProxyProtocol.Listen {
+				webDriver.Listener = listenProxyProtocol(listen, appConfig)
+			}
+
 			if err := webDriver.Start(listen); err != nil {
 				if err != http.ErrServerClosed {
 					xlog.Error("%v", err)
@@ -150,8 +311,26 @@ func (x *Command) startWithGracefulShutdown() {
 
 		}
 
+		// stapleOCSP wrap get certificate with OCSP staples cached in cert dir
+		stapleOCSP := func(certDir string,
+			get func(*tls.ClientHelloInfo) (*tls.Certificate, error), certs []*tls.Certificate,
+		) func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+
+			if !appConfig.HTTPServer.OCSPStapling {
+				return get
+			}
+
+			stapler := utilcert.NewOCSPStapler(filepath.Join(certDir, utilcert.OCSPDir))
+			stapler.Add(certs...)
+			go stapler.Run(ctx, 10*time.Minute)
+
+			xlog.Info("OCSP stapling enabled, cache: %v", filepath.Join(certDir, utilcert.OCSPDir))
+
+			return stapler.GetCertificate(get)
+		}
+
 		serveTLS := func(listen string, certDir string,
-			certHosts []string,
+			certHosts []string, defaultCert string, certWatch int,
 		) {
 
 			xlog.Info("server starting: %v, cert from: %v", listen, certDir)
@@ -168,18 +347,34 @@ func (x *Command) startWithGracefulShutdown() {
 
 			certDir, _ = filepath.Abs(certDir)
 
-			crt, _ := filepath.Abs(filepath.Join(certDir, certHosts[0]))
-			key, _ := filepath.Abs(filepath.Join(certDir, certHosts[0]))
+			if _, err := os.Stat(certDir); os.IsNotExist(err) {
+				xlog.Panic("path not exists : %v error: %v", certDir, err)
+			}
 
-			for _, itm := range []string{certDir, crt, key} {
-				if _, err := os.Stat(itm); os.IsNotExist(err) {
-					xlog.Panic("path not exists : %v error: %v", itm, err)
-				}
+			xlog.Info("cert path: %v", certDir)
+
+			// cert by SNI from "<cert dir>/<host>/"
+			certStore, err := utilcert.NewStore(certDir, certHosts, defaultCert)
+			if err != nil {
+				xlog.Panic("error on load certificates: %v", err)
+			}
 
-				xlog.Info("cert path: %v", itm) // 1 2 3
+			if certWatch > 0 {
+				xlog.Info("certificate watch interval: %vs", certWatch)
+				go certStore.Watch(ctx, time.Duration(certWatch)*time.Second)
 			}
 
-			if err := webDriver.StartTLS(listen, crt, key); err != nil {
+			s := webDriver.TLSServer
+			s.Addr = listen
+			s.TLSConfig.GetCertificate = stapleOCSP(certDir, certStore.GetCertificate, certStore.Certificates())
+			if !webDriver.DisableHTTP2 {
+				s.TLSConfig.NextProtos = append(s.TLSConfig.NextProtos, "h2")
+			}
+			if appConfig.HTTPServer.ProxyProtocol.ListenTLS {
+				webDriver.TLSListener = tls.NewListener(listenProxyProtocol(listen, appConfig), s.TLSConfig)
+			}
+
+			if err := webDriver.StartServer(s); err != nil {
 				if err != http.ErrServerClosed {
 					xlog.Error("%v", err)
 				} else {
@@ -188,48 +383,23 @@ func (x *Command) startWithGracefulShutdown() {
 			}
 
 		}
-		serveAutoTLS := func(listen string,
-			certDir string,
-			certHosts []string,
-			debug bool,
-		) {
-
-			xlog.Info("server hosts: %v", certHosts)
+		serveAutoTLS := func(listen string, certDir string) {
 
 			xlog.Info("server starting with auto TLS: %v, cert from: %v", listen, certDir)
 
-			if certDir == "" {
-				xlog.Panic("certificate dir not defined")
-				return
-			}
-
-			if len(certHosts) == 0 {
-				xlog.Panic("certificate host not defined")
-				return
+			// same as StartAutoTLS, keeps TLS config of server
+			s := webDriver.TLSServer
+			s.Addr = listen
+			s.TLSConfig.GetCertificate = stapleOCSP(certDir, webDriver.AutoTLSManager.GetCertificate, nil)
+			s.TLSConfig.NextProtos = append(s.TLSConfig.NextProtos, acme.ALPNProto)
+			if !webDriver.DisableHTTP2 {
+				s.TLSConfig.NextProtos = append(s.TLSConfig.NextProtos, "h2")
 			}
-
-			certDir, _ = filepath.Abs(certDir)
-
-			for _, itm := range []string{certDir} {
-				if _, err := os.Stat(itm); os.IsNotExist(err) {
-					xlog.Panic("path not exists : %v error: %v", itm, err)
-				}
-
-				xlog.Info("cert path: %v", itm)
-			}
-
-			// .Email
-			webDriver.AutoTLSManager.Prompt = autocert.AcceptTOS
-			webDriver.AutoTLSManager.HostPolicy = autocert.HostWhitelist(certHosts...) // Add your domain(s) here
-			webDriver.AutoTLSManager.Cache = autocert.DirCache(certDir)                // Directory for storing certificates
-
-			if debug {
-				webDriver.AutoTLSManager.Client = &acme.Client{
-					DirectoryURL: "https://acme-staging-v02.api.letsencrypt.org/directory",
-				}
+			if appConfig.HTTPServer.ProxyProtocol.ListenTLS {
+				webDriver.TLSListener = tls.NewListener(listenProxyProtocol(listen, appConfig), s.TLSConfig)
 			}
 
-			if err := webDriver.StartAutoTLS(listen); err != nil {
+			if err := webDriver.StartServer(s); err != nil {
 				if err != http.ErrServerClosed {
 					xlog.Error("%v", err)
 				} else {
@@ -239,38 +409,47 @@ func (x *Command) startWithGracefulShutdown() {
 
 		}
 
-		if appConfig.HTTPServer.Listen != "" {
-			go serve(appConfig.HTTPServer.Listen)
-		}
-
 		if appConfig.HTTPServer.ListenTLS != "" {
 
-			applyServerTLS(webDriver.TLSServer, appConfig)
+			applyServerTLS(ctx, webDriver.TLSServer, appConfig)
+			applyClientAuth(webDriver.TLSServer, appConfig)
 
 			if appConfig.HTTPServer.AutoTLS {
-				go serveAutoTLS(appConfig.HTTPServer.ListenTLS,
-					appConfig.HTTPServer.CertDir,
-					appConfig.HTTPServer.CertHosts,
-					appConfig.Debug,
-				)
+				certDir := applyAutoTLS(&webDriver.AutoTLSManager, appConfig)
+
+				// HTTP-01 challenges answered before redirect and maintenance of app handler,
+				// not enabled on manager for tls-alpn-01
+				if appConfig.HTTPServer.Listen != "" && appConfig.HTTPServer.ACME.Challenge == utilcert.ChallengeHTTP {
+					webDriver.Pre(middleware.ACMEChallenge(webDriver.AutoTLSManager.HTTPHandler(nil)))
+				}
+
+				go serveAutoTLS(appConfig.HTTPServer.ListenTLS, certDir)
 			} else {
 				go serveTLS(appConfig.HTTPServer.ListenTLS,
 					appConfig.HTTPServer.CertDir,
 					appConfig.HTTPServer.CertHosts,
+					appConfig.HTTPServer.DefaultCert,
+					appConfig.HTTPServer.CertWatch,
 				)
 			}
 
 		}
 
+		// after TLS setup, middlewares of listeners added before start
+		if appConfig.HTTPServer.Listen != "" {
+			go serve(appConfig.HTTPServer.Listen)
+		}
+
 	}
 
 	// Wait for interrupt signal to gracefully shutdown the server with a timeout of 10 seconds.
 	<-ctx.Done()
 	xlog.Info("interrupt signal")
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	// own context, ctx is still read by reload, watcher and OCSP goroutines
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 	xlog.Info("shutdown web driver")
-	if err := webDriver.Shutdown(ctx); err != nil {
+	if err := webDriver.Shutdown(shutdownCtx); err != nil {
 		xlog.Error("error on shutdown server: %v", err)
 	}
 }
@@ -0,0 +1,109 @@
+package cmd
+
+import (
+	"fmt"
+	"go-proxy/internal/config"
+	"go-proxy/internal/middleware"
+	"go-proxy/internal/router"
+	"go-proxy/internal/service"
+	"slices"
+	"sync/atomic"
+
+	xlog "go-proxy/internal/util/utillog"
+
+	"github.com/labstack/echo/v4"
+	elog "github.com/labstack/gommon/log"
+)
+
+// appHandler middlewares and routes built from one config
+type appHandler struct {
+	echo    *echo.Echo
+	runtime *middleware.Runtime
+	config  *config.AppConfig
+}
+
+// newAppHandler build handler of config, panic on invalid config returned as error
+func newAppHandler(appService service.AppService) (res *appHandler, err error) {
+
+	var rt *middleware.Runtime
+
+	defer func() {
+		if r := recover(); r != nil {
+			if rt != nil {
+				rt.Close() // health checks and pools of failed build
+			}
+			err = fmt.Errorf("error on build handler: %v", r)
+		}
+	}()
+
+	e := echo.New()
+	e.Logger.SetLevel(elog.INFO)
+
+	rt = middleware.Init(e, appService) // 1
+	router.Init(e, appService)          // 2
+
+	return &appHandler{echo: e, runtime: rt, config: appService.Config()}, nil
+}
+
+// reloadableHandler serve requests by current app handler, swapped on config reload,
+// in-flight requests are served by previous handler until done
+type reloadableHandler struct {
+	current atomic.Pointer[appHandler]
+}
+
+func (x *reloadableHandler) set(handler *appHandler) {
+
+	handler.runtime.Activate()
+
+	if prev := x.current.Swap(handler); prev != nil {
+		prev.runtime.Close()
+	}
+}
+
+func (x *reloadableHandler) serve(c echo.Context) error {
+	x.current.Load().echo.ServeHTTP(c.Response().Writer, c.Request())
+	return nil
+}
+
+// reload prepare handler of reloaded config, swap on commit, close on rollback
+func (x *reloadableHandler) reload(appService service.AppService) (func(), func(), error) {
+
+	handler, err := newAppHandler(appService)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if current := x.current.Load(); current != nil {
+		warnRestartRequired(current.config, appService.Config())
+		warnStateReset(appService.Config())
+	}
+
+	return func() { x.set(handler) }, handler.runtime.Close, nil
+}
+
+// warnRestartRequired log settings of listeners not changed by reload
+func warnRestartRequired(prev *config.AppConfig, next *config.AppConfig) {
+
+	a, b := prev.HTTPServer, next.HTTPServer
+
+	if a.Listen != b.Listen || a.ListenTLS != b.ListenTLS || a.ListenSys != b.ListenSys ||
+		a.AutoTLS != b.AutoTLS || a.CertDir != b.CertDir || !slices.Equal(a.CertHosts, b.CertHosts) ||
+		a.SysAPIKey != b.SysAPIKey || a.TLSPreset != b.TLSPreset || a.TLSMinVersion != b.TLSMinVersion ||
+		a.TLSMaxVersion != b.TLSMaxVersion || !slices.Equal(a.TLSCipherSuites, b.TLSCipherSuites) || !slices.Equal(a.TLSCurves, b.TLSCurves) ||
+		a.TLSTicketKeys != b.TLSTicketKeys || a.TLSTicketRotate != b.TLSTicketRotate || a.OCSPStapling != b.OCSPStapling || a.ACME != b.ACME ||
+		a.ProxyProtocol.Listen != b.ProxyProtocol.Listen || a.ProxyProtocol.ListenTLS != b.ProxyProtocol.ListenTLS ||
+		a.ProxyProtocol.ListenSys != b.ProxyProtocol.ListenSys || !slices.Equal(a.ProxyProtocol.Trusted, b.ProxyProtocol.Trusted) {
+		xlog.Warn("listeners, certificates, TLS and sys api settings are applied after restart")
+	}
+}
+
+// warnStateReset log state of limiters not kept by reload, limiters are built again from config
+func warnStateReset(next *config.AppConfig) {
+
+	server := next.HTTPServer
+
+	if (server.RateLimit > 0 || len(server.RateRules) > 0) && server.RateStore != config.RateStoreRedis {
+		xlog.Warn("rate limit counters of memory store are reset by reload")
+	}
+	xlog.Info("concurrency limit queues start empty after reload, in-flight requests are counted by previous config")
+}
@@ -0,0 +1,94 @@
+package cmd
+
+import (
+	"go-proxy/internal/config"
+	"go-proxy/internal/service"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+type testAppService struct {
+	config *config.AppConfig
+}
+
+func (x *testAppService) Config() *config.AppConfig              { return x.config }
+func (x *testAppService) Reload() error                          { return nil }
+func (x *testAppService) OnReload(handler service.ReloadHandler) {}
+
+func Test_reloadableHandler_reload(t *testing.T) {
+
+	backend := func(body string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = io.WriteString(w, body)
+		}))
+	}
+	backend1, backend2 := backend("1"), backend("2")
+	defer backend1.Close()
+	defer backend2.Close()
+
+	newConfig := func(url string) *config.AppConfig {
+		res := config.NewAppConfig()
+		res.Proxy.Routes = []config.AppConfigProxyRoute{
+			{Prefix: "/api/*", Servers: []config.AppConfigProxyServer{{URL: url}}},
+		}
+		return res
+	}
+
+	handler, err := newAppHandler(&testAppService{config: newConfig(backend1.URL)})
+	if err != nil {
+		t.Fatalf("newAppHandler() error: %v", err)
+	}
+
+	x := &reloadableHandler{}
+	x.set(handler)
+
+	e := echo.New()
+	e.RouteNotFound("/*", x.serve)
+
+	get := func() string {
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/test", nil))
+		return rec.Body.String()
+	}
+
+	if got := get(); got != "1" {
+		t.Fatalf("body = %v, want 1", got)
+	}
+
+	// invalid config rejected, current handler kept
+	invalid := config.NewAppConfig()
+	invalid.Proxy.Routes = []config.AppConfigProxyRoute{{Prefix: "/api/*"}}
+	if _, _, err := x.reload(&testAppService{config: invalid}); err == nil {
+		t.Fatalf("expected reload error")
+	}
+	if got := get(); got != "1" {
+		t.Fatalf("body = %v, want 1", got)
+	}
+
+	commit, _, err := x.reload(&testAppService{config: newConfig(backend2.URL)})
+	if err != nil {
+		t.Fatalf("reload() error: %v", err)
+	}
+	if got := get(); got != "1" {
+		t.Fatalf("body before commit = %v, want 1", got)
+	}
+
+	commit()
+	if got := get(); got != "2" {
+		t.Fatalf("body after commit = %v, want 2", got)
+	}
+
+	// handler rolled back if other reload handler rejects config
+	_, rollback, err := x.reload(&testAppService{config: newConfig(backend1.URL)})
+	if err != nil {
+		t.Fatalf("reload() error: %v", err)
+	}
+	rollback()
+	if got := get(); got != "2" {
+		t.Fatalf("body after rollback = %v, want 2", got)
+	}
+}
@@ -1,20 +1,26 @@
 package config
 
 import (
+	"cmp"
+	"crypto/tls"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"go-proxy/internal/config/consts"
 	"math"
+	"net/netip"
 	"os"
 	"path/filepath"
 	"slices"
 	"strconv"
 	"strings"
+	"sync/atomic"
 
 	xlog "go-proxy/internal/util/utillog"
 
+	"go-proxy/internal/util/utilcert"
 	"go-proxy/internal/util/utilconfig"
+	"go-proxy/internal/util/utiltls"
 )
 
 var (
@@ -290,27 +296,133 @@ type Database struct {
 	IdleTime  int    `json:"idle_time"`
 	Migration bool   `json:"migration"`
 	SSL       bool   `json:"ssl"`
+	DB        int    `json:"db"` // redis database index
 }
 
 // type AppConfigLog struct {
 // 	Level int `json:"level"` // 0=Error 1=Warn 2=Info 3=Debug
 // }
 
+type AppConfigProxyHealthCheck struct {
+	Path     string `json:"path"`     // "/health", empty is disabled
+	Interval int    `json:"interval"` // seconds
+	Timeout  int    `json:"timeout"`  // seconds
+	Status   int    `json:"status"`   // expected status, 0 is any 2xx or 3xx
+	Rise     int    `json:"rise"`     // successful checks to mark target healthy
+	Fall     int    `json:"fall"`     // failed checks to mark target unhealthy
+}
+
+type AppConfigProxyOutlier struct {
+	Consecutive  int `json:"consecutive"`   // consecutive 5xx or connection errors to eject target, 0 is disabled
+	BaseEjection int `json:"base_ejection"` // seconds, doubles with each ejection
+	MaxEjection  int `json:"max_ejection"`  // seconds
+
+	MaxEjectionPercent int `json:"max_ejection_percent"` // targets ejected at once, 50 if 0, at least one
+}
+
+// AppConfigConcurrency in-flight requests limit, excess requests wait in queue, lower priority is shed first
+type AppConfigConcurrency struct {
+	MaxInFlight  int                            `json:"max_in_flight"` // 0 is unlimited
+	MaxQueue     int                            `json:"max_queue"`     // waiting requests, 0 sheds at once
+	QueueTimeout int                            `json:"queue_timeout"` // seconds, max wait in queue, 5 if 0
+	Priorities   []AppConfigConcurrencyPriority `json:"priorities"`    // first matched, priority 0 if none
+}
+
+// AppConfigConcurrencyPriority priority of requests by route or header
+type AppConfigConcurrencyPriority struct {
+	Path     string `json:"path"`     // path prefix "/api/reports", any path if empty
+	Header   string `json:"header"`   // "X-Priority: low", any request if empty
+	Priority int    `json:"priority"` // higher is served first and shed last, negative is below default
+}
+
+type AppConfigProxyAffinity struct {
+	Enabled bool   `json:"enabled"` // default for upstreams, override by "?affinity=1"
+	Cookie  string `json:"cookie"`  // cookie name, override by "?affinity=cookie_name"
+	TTL     int    `json:"ttl"`     // seconds, 0 is session cookie
+	Key     string `json:"key"`     // cookie signing key, random if empty
+}
+
+type AppConfigProxyServer struct {
+	URL    string `json:"url"`    // "http://127.0.0.1:8080"
+	Weight int    `json:"weight"` // default 1
+}
+
+// AppConfigProxyRewrite ordered rewrite rule, first matched rule applied
+type AppConfigProxyRewrite struct {
+	Match    string `json:"match"`    // regexp "^/old/(.*)$", matched on path after strip prefix
+	Replace  string `json:"replace"`  // "/new/$1", "/new?id=$1" replace query, original query kept if no "?"
+	Query    bool   `json:"query"`    // match on path with query "/old?id=1"
+	Redirect int    `json:"redirect"` // 301, 302, 307 or 308 to client instead of internal rewrite, 0 is rewrite
+}
+
+// AppConfigProxyRoute structured upstream, "http://127.0.0.1:8080/api/*?server=127.0.0.1:8081" is shorthand
+type AppConfigProxyRoute struct {
+	Prefix       string                  `json:"prefix"`        // "/api/*"
+	Host         string                  `json:"host"`          // "example.com", empty is any host
+	Servers      []AppConfigProxyServer  `json:"servers"`       //
+	Rewrite      []string                `json:"rewrite"`       // ["/old/*:/new/$1"], applied before rewrite rules
+	RewriteRules []AppConfigProxyRewrite `json:"rewrite_rules"` // ordered regexp rules
+	StripPrefix  bool                    `json:"strip_prefix"`  // remove static part of prefix "/api" before proxy
+	Timeout      int                     `json:"timeout"`       // seconds, upstream request timeout, 0 is none
+
+	RequestHeadersSet  []string `json:"request_headers_set"`  // ["X-Forwarded-Prefix: /api"]
+	RequestHeadersDel  []string `json:"request_headers_del"`  // ["Cookie"]
+	ResponseHeadersSet []string `json:"response_headers_set"` // ["Cache-Control: no-store"]
+	ResponseHeadersDel []string `json:"response_headers_del"` // ["Server"]
+
+	Balancer    string                     `json:"balancer"`     // default from proxy config
+	HashKey     string                     `json:"hash_key"`     // default from proxy config
+	HealthCheck *AppConfigProxyHealthCheck `json:"health_check"` // default from proxy config
+	Outlier     *AppConfigProxyOutlier     `json:"outlier"`      // default from proxy config
+	Affinity    *AppConfigProxyAffinity    `json:"affinity"`     // default from proxy config
+	ClientAuth  *AppConfigRouteClientAuth  `json:"client_auth"`  // client certificate required or allowed for route
+	TLS         *AppConfigProxyTLS         `json:"tls"`          // default from proxy config
+	Transport   *AppConfigHTTPTransport    `json:"transport"`    // zero values from http_transport
+	Concurrency *AppConfigConcurrency      `json:"concurrency"`  // default from proxy config
+}
+
+// AppConfigProxyTLS TLS to https servers of upstream, system roots if empty
+type AppConfigProxyTLS struct {
+	CA                 string `json:"ca"`                   // PEM file of root CAs "/app/cert/internal-ca.pem", system roots if empty
+	Cert               string `json:"cert"`                 // PEM file of client cert for mTLS to server
+	Key                string `json:"key"`                  // PEM file of client key
+	ServerName         string `json:"server_name"`          // SNI and verified name, host of server url if empty
+	InsecureSkipVerify bool   `json:"insecure_skip_verify"` // development and testing env only
+	MinVersion         string `json:"min_version"`          // "1.2", "1.3", default of go if empty
+}
+
 type AppConfigProxy struct {
-	Upstreams      []string       `json:"upstreams"` // records "http://127.0.0.1:8080/api/test/ping"
-	OverrideStatus map[int]string `json:"override_status"`
+	Upstreams      []string                  `json:"upstreams"` // records "http://127.0.0.1:8080/api/test/ping"
+	Routes         []AppConfigProxyRoute     `json:"routes"`    // structured upstreams
+	OverrideStatus map[int]string            `json:"override_status"`
+	HealthCheck    AppConfigProxyHealthCheck `json:"health_check"` // default for upstreams, override by "?health=/health"
+	Outlier        AppConfigProxyOutlier     `json:"outlier"`      // default for upstreams, override by "?outlier=5"
+	Balancer       string                    `json:"balancer"`     // round_robin weighted_round_robin least_conn random_two hash, override by "?balancer=hash"
+	HashKey        string                    `json:"hash_key"`     // for hash balancer: ip header:X-User-ID cookie:session, override by "?hash_key=ip"
+	Affinity       AppConfigProxyAffinity    `json:"affinity"`     // sticky sessions
+	TLS            AppConfigProxyTLS         `json:"tls"`          // default for upstreams
+	Concurrency    AppConfigConcurrency      `json:"concurrency"`  // default for upstreams, per upstream
 }
 
+// AppConfigHTTPTransport connections to upstream servers, own transport per upstream, zero values are go defaults
 type AppConfigHTTPTransport struct {
 	MaxIdleConns        int `json:"max_idle_conns,omitempty"`
 	MaxIdleConnsPerHost int `json:"max_idle_conns_per_host,omitempty"`
-	IdleConnTimeout     int `json:"idle_conn_timeout,omitempty"`
+	IdleConnTimeout     int `json:"idle_conn_timeout,omitempty"` // seconds
 	MaxConnsPerHost     int `json:"max_conns_per_host,omitempty"`
+
+	DialTimeout           int   `json:"dial_timeout,omitempty"`            // seconds
+	KeepAlive             int   `json:"keep_alive,omitempty"`              // seconds, tcp keep-alive period, -1 is disabled
+	ResponseHeaderTimeout int   `json:"response_header_timeout,omitempty"` // seconds, 0 is none
+	TLSHandshakeTimeout   int   `json:"tls_handshake_timeout,omitempty"`   // seconds
+	DisableKeepAlives     *bool `json:"disable_keep_alives,omitempty"`     // new connection per request, route value overrides default
+	DisableHTTP2          *bool `json:"disable_http2,omitempty"`           // HTTP/1.1 only to https servers, route value overrides default
 }
 type AppConfigHTTPServer struct {
 	AccessLog     bool     `json:"access_log"`
 	RateLimit     float64  `json:"rate_limit"`
 	RateBurst     int      `json:"rate_burst"`
+	RateStore     string   `json:"rate_store"` // "memory" or "redis", redis is shared by replicas
 	Listen        string   `json:"listen"`
 	ListenTLS     string   `json:"listen_tls"`
 	AutoTLS       bool     `json:"auto_tls"`
@@ -319,16 +431,24 @@ type AppConfigHTTPServer struct {
 	RedirectWWW   bool     `json:"redirect_www"`
 	RequestID     bool     `json:"request_id"`
 
+	RateRules []AppConfigRateRule `json:"rate_rules"` // all matched rules apply, in addition to rate_limit per ip
+
 	CertDir           string `json:"cert_dir"`
+	DefaultCert       string `json:"default_cert"`                  // host of cert for unknown server names, first cert host if empty
+	CertWatch         int    `json:"cert_watch"`                    // seconds, poll cert files and reload on change, 0 is disabled
+	OCSPStapling      bool   `json:"ocsp_stapling"`                 // staple OCSP responses, cached in "<cert_dir>/ocsp"
 	RequestTimeout    int    `json:"request_timeout,omitempty"`     // 5 to 30 seconds
 	ReadTimeout       int    `json:"read_timeout,omitempty"`        // 5 to 30 seconds
 	WriteTimeout      int    `json:"write_timeout,omitempty"`       // 10 to 30 seconds, WriteTimeout > ReadTimeout
 	IdleTimeout       int    `json:"idle_timeout,omitempty"`        // 60 to 120 seconds
 	ReadHeaderTimeout int    `json:"read_header_timeout,omitempty"` // default get from ReadTimeout
 
-	SysMetrics bool   `json:"sys_metrics"` //
-	SysAPIKey  string `json:"sys_api_key"`
-	ListenSys  string `json:"listen_sys"`
+	SysMetrics   bool   `json:"sys_metrics"`   //
+	SysUpstreams bool   `json:"sys_upstreams"` // upstream targets state
+	SysReload    bool   `json:"sys_reload"`    // reload config by POST
+	SysMaint     bool   `json:"sys_maint"`     // maintenance mode switch
+	SysAPIKey    string `json:"sys_api_key"`
+	ListenSys    string `json:"listen_sys"`
 
 	AllowOrigins []string `json:"allow_origins"`
 	HeadersDel   []string `json:"headers_del"`
@@ -342,7 +462,114 @@ type AppConfigHTTPServer struct {
 	TLSSessionCache     bool `json:"tls_session_cache"`      //
 	TLSSessionTickets   bool `json:"tls_session_tickets"`    //
 
+	TLSTicketKeys   string `json:"tls_ticket_keys"`   // file or dir of session ticket keys shared by replicas, random keys if empty
+	TLSTicketRotate int    `json:"tls_ticket_rotate"` // seconds, new random key or reread of ticket keys path
+
+	TLSPreset       string   `json:"tls_preset"`        // modern, intermediate, legacy, go defaults if empty
+	TLSMinVersion   string   `json:"tls_min_version"`   // "1.2", default from preset
+	TLSMaxVersion   string   `json:"tls_max_version"`   // "1.3", default from preset
+	TLSCipherSuites []string `json:"tls_cipher_suites"` // ["TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"], default from preset
+	TLSCurves       []string `json:"tls_curves"`        // ["X25519", "P-256"], default from preset
+
 	CSRF bool `json:"csrf"` //
+
+	ClientAuth AppConfigClientAuth `json:"client_auth"` // mTLS
+
+	ACME AppConfigACME `json:"acme"` // auto TLS account and CA
+
+	Concurrency AppConfigConcurrency `json:"concurrency"` // all requests
+
+	ClientIP AppConfigClientIP `json:"client_ip"` // real ip for rate limit, geo ip and access log
+
+	ProxyProtocol AppConfigProxyProtocol `json:"proxy_protocol"` // PROXY header of TCP load balancer
+}
+
+// AppConfigProxyProtocol PROXY protocol v1/v2 on listeners, client address of trusted sources from header
+type AppConfigProxyProtocol struct {
+	Listen    bool     `json:"listen"`     //
+	ListenTLS bool     `json:"listen_tls"` // header before TLS handshake
+	ListenSys bool     `json:"listen_sys"` // own sys listener only
+	Trusted   []string `json:"trusted"`    // "10.0.0.0/8", "203.0.113.7", header of others is not read
+}
+
+const (
+	ClientIPDirect = "direct"    // connection peer, headers ignored
+	ClientIPXFF    = "xff"       // X-Forwarded-For of trusted proxies
+	ClientIPRealIP = "x_real_ip" // X-Real-IP of trusted proxy
+
+	ClientIPProxyProtocol = "proxy_protocol" // source of PROXY header, connection peer without header
+)
+
+var clientIPModes = []string{"", ClientIPDirect, ClientIPXFF, ClientIPRealIP, ClientIPProxyProtocol}
+
+// AppConfigClientIP client ip of requests through proxies
+type AppConfigClientIP struct {
+	Mode           string   `json:"mode"`            // direct, xff, x_real_ip, proxy_protocol; legacy headers of any peer if empty (deprecated)
+	TrustedProxies []string `json:"trusted_proxies"` // "10.0.0.0/8", "203.0.113.7", headers of others are ignored
+	Hops           int      `json:"hops"`            // xff, trusted proxies in front of server, by trusted list if 0
+}
+
+// AppConfigACME CA and account of automatic certificates
+type AppConfigACME struct {
+	DirectoryURL string `json:"directory_url"` // "https://ca.internal:9000/acme/acme/directory", Let's Encrypt if empty, staging in development env
+	CA           string `json:"ca"`            // PEM file of roots of directory url, system roots if empty
+	Email        string `json:"email"`         // account contact
+	EABKeyID     string `json:"eab_kid"`       // external account binding key id
+	EABHMACKey   string `json:"eab_hmac_key"`  // external account binding base64url HMAC key
+	RenewBefore  int    `json:"renew_before"`  // days before expiry, 30 if 0
+	Challenge    string `json:"challenge"`     // tls-alpn-01 (default), http-01 on listen
+}
+
+const (
+	ClientAuthNone    = "none"
+	ClientAuthRequest = "request" // verify if given
+	ClientAuthRequire = "require"
+)
+
+const (
+	RateActionReject = "reject"
+	RateActionDelay  = "delay" // wait up to max delay, reject over it
+	RateActionLog    = "log"   // log only
+)
+
+var rateActions = []string{"", RateActionReject, RateActionDelay, RateActionLog}
+
+// AppConfigRateRule rate limit of matched requests, empty matcher matches any request
+type AppConfigRateRule struct {
+	Name      string   `json:"name"`      // key prefix in store, "rule<index>" if empty
+	Path      string   `json:"path"`      // path prefix "/api"
+	Methods   []string `json:"methods"`   // "POST"
+	Hosts     []string `json:"hosts"`     // "example.com", "*.example.com"
+	Countries []string `json:"countries"` // X-Country-Code of GeoIP
+	Key       string   `json:"key"`       // ip (default), subnet (ip /24 or /64), header:<name>, cookie:<name>, jwt:<claim>, ip if value is empty
+	Rate      float64  `json:"rate"`      // requests per second
+	Burst     int      `json:"burst"`     // max(1, ceil(rate)) if 0
+	Action    string   `json:"action"`    // reject (default), delay, log
+	MaxDelay  int      `json:"max_delay"` // seconds, delay action, 1 if 0
+}
+
+const (
+	RateStoreMemory = "memory" // per replica
+	RateStoreRedis  = "redis"  // shared by replicas, memory while redis is down
+)
+
+var clientAuthVerify = []string{"", ClientAuthNone, ClientAuthRequest, ClientAuthRequire}
+
+// AppConfigClientAuth client certificates of TLS listener, verified by CA bundle
+type AppConfigClientAuth struct {
+	CA     string   `json:"ca"`     // PEM file of client CAs, client auth disabled if empty
+	Verify string   `json:"verify"` // none, request (verify if given), require
+	Allow  []string `json:"allow"`  // subject, common name or SAN "client.example.com", "*.svc.local", "spiffe://example.com/app"
+
+	HeaderSubject     string `json:"header_subject"`     // "X-Client-Cert-Subject", verified client identity to upstream
+	HeaderFingerprint string `json:"header_fingerprint"` // "X-Client-Cert-Fingerprint", sha256 hex
+	HeaderCert        string `json:"header_cert"`        // "X-Client-Cert", url escaped PEM
+}
+
+// AppConfigRouteClientAuth client certificate rules of route, checked in addition to listener rules
+type AppConfigRouteClientAuth struct {
+	Verify string   `json:"verify"` // require, request
+	Allow  []string `json:"allow"`  //
 }
 
 type AppConfigMod struct {
@@ -352,7 +579,18 @@ type AppConfigMod struct {
 	IsMaint bool   `json:"is_maint"`
 	Title   string `json:"title"`
 
-	ConfigPath []string `json:"-"` // []string{".", os.Getenv("APP_CONFIG"), flagAppConfig}
+	ConfigPath  []string `json:"-"`            // []string{".", os.Getenv("APP_CONFIG"), flagAppConfig}
+	ConfigWatch int      `json:"config_watch"` // seconds, poll config files and urls and reload on change, 0 is disabled
+}
+
+// AppConfigMaint maintenance mode options, mode enabled by "is_maint" or scheduled window
+type AppConfigMaint struct {
+	Routes       []string `json:"routes"`        // path prefixes "/api/*" in maintenance, empty is all
+	Allow        []string `json:"allow"`         // ips and cidrs "10.0.0.0/8" reaching backend
+	BypassHeader string   `json:"bypass_header"` // "X-Maint-Bypass: secret" reaching backend
+	RetryAfter   int      `json:"retry_after"`   // seconds, until window end if scheduled
+	Start        string   `json:"start"`         // RFC3339 "2025-01-01T02:00:00Z", scheduled window
+	End          string   `json:"end"`           // RFC3339, empty is open window
 }
 
 type AppConfigGeoIP struct {
@@ -362,6 +600,17 @@ type AppConfigGeoIP struct {
 	BlockCountry []string `json:"block_country"`
 }
 
+// AppConfigVirtualHost routes, redirect rules and error pages of hosts
+type AppConfigVirtualHost struct {
+	Hosts          []string              `json:"hosts"`           // "example.com", "*.example.com"
+	Cert           bool                  `json:"cert"`            // add hosts (except wildcard) to cert hosts
+	Routes         []AppConfigProxyRoute `json:"routes"`          // route without host matches hosts of virtual host
+	RedirectTo     string                `json:"redirect_to"`     // "https://example.com", redirect all requests, path kept
+	RedirectHTTPS  *bool                 `json:"redirect_https"`  // default from http server config
+	RedirectWWW    *bool                 `json:"redirect_www"`    // default from http server config
+	OverrideStatus map[int]string        `json:"override_status"` // default from proxy config
+}
+
 type AppConfig struct {
 	AppConfigMod
 
@@ -377,6 +626,10 @@ type AppConfig struct {
 	HTTPServer AppConfigHTTPServer `json:"http_server"`
 
 	GeoIP AppConfigGeoIP `json:"geo_ip"`
+
+	VirtualHosts []AppConfigVirtualHost `json:"virtual_hosts"`
+
+	Maint AppConfigMaint `json:"maint"`
 }
 
 func NewAppConfig() *AppConfig {
@@ -417,17 +670,39 @@ func NewAppConfig() *AppConfig {
 			IsMaint:    false,
 		},
 
-		Proxy: AppConfigProxy{},
+		Maint: AppConfigMaint{
+			RetryAfter: 10,
+		},
+
+		Proxy: AppConfigProxy{
+			HealthCheck: AppConfigProxyHealthCheck{
+				Interval: 10,
+				Timeout:  2,
+				Rise:     2,
+				Fall:     3,
+			},
+			Outlier: AppConfigProxyOutlier{
+				BaseEjection:       30,
+				MaxEjection:        300,
+				MaxEjectionPercent: 50,
+			},
+			Affinity: AppConfigProxyAffinity{
+				Cookie: "_affinity",
+				TTL:    0,
+			},
+		},
 
 		HTTPTransport: AppConfigHTTPTransport{},
 		HTTPServer: AppConfigHTTPServer{
 			RequestTimeout: 20,
+			CertWatch:      60,
 			ReadTimeout:    5,
 			WriteTimeout:   10,
 			IdleTimeout:    30,
 
 			RateLimit: 5,
 			RateBurst: 10,
+			RateStore: RateStoreMemory,
 
 			Listen: "127.0.0.1:80",
 			// ListenTLS: "127.0.0.1:443",
@@ -441,8 +716,16 @@ func NewAppConfig() *AppConfig {
 
 			TLSSessionCache:   false,
 			TLSSessionTickets: false,
+			TLSTicketRotate:   86400,
 
 			CSRF: true,
+
+			ClientAuth: AppConfigClientAuth{
+				Verify:            ClientAuthNone,
+				HeaderSubject:     "X-Client-Cert-Subject",
+				HeaderFingerprint: "X-Client-Cert-Fingerprint",
+				HeaderCert:        "X-Client-Cert",
+			},
 		},
 	}
 
@@ -493,13 +776,29 @@ func (x *AppConfig) readEnvVar() error {
 	reader.Int(&x.DB.MaxIdle, "db_max_idle", nil)
 	reader.Int(&x.DB.IdleTime, "db_idle_time", nil)
 
+	reader.String(&x.Redis.Host, "redis_host", nil)
+	reader.String(&x.Redis.Port, "redis_port", nil)
+	reader.Int(&x.Redis.DB, "redis_db", nil)
+	reader.String(&x.Redis.User, "redis_user", nil)
+	reader.String(&x.Redis.Password, "redis_password", nil) // APP_REDIS_PASSWORD_FILE
+	reader.Bool(&x.Redis.SSL, "redis_ssl", nil)
+
 	reader.String(&x.Env, "env", nil)
 	reader.String(&x.Title, "title", nil)
+	reader.Int(&x.ConfigWatch, "config_watch", nil)
 
 	// Http server
 	reader.Bool(&x.HTTPServer.AccessLog, "http_access_log", nil)
 	reader.Float64(&x.HTTPServer.RateLimit, "http_rate_limit", nil)
 	reader.Int(&x.HTTPServer.RateBurst, "http_rate_burst", nil)
+	reader.String(&x.HTTPServer.RateStore, "http_rate_store", nil)
+	reader.String(&x.HTTPServer.ClientIP.Mode, "http_client_ip_mode", nil)
+	reader.StringArray(&x.HTTPServer.ClientIP.TrustedProxies, "http_trusted_proxies", nil)
+	reader.Int(&x.HTTPServer.ClientIP.Hops, "http_client_ip_hops", nil)
+	reader.Bool(&x.HTTPServer.ProxyProtocol.Listen, "http_proxy_protocol", nil)
+	reader.Bool(&x.HTTPServer.ProxyProtocol.ListenTLS, "http_proxy_protocol_tls", nil)
+	reader.Bool(&x.HTTPServer.ProxyProtocol.ListenSys, "http_proxy_protocol_sys", nil)
+	reader.StringArray(&x.HTTPServer.ProxyProtocol.Trusted, "http_proxy_protocol_trusted", nil)
 	reader.String(&x.HTTPServer.Listen, "http_listen", nil)        // =>listen
 	reader.String(&x.HTTPServer.ListenTLS, "http_listen_tls", nil) // =>listen_tls
 	reader.Bool(&x.HTTPServer.AutoTLS, "http_auto_tls", nil)
@@ -512,6 +811,9 @@ func (x *AppConfig) readEnvVar() error {
 	reader.Int(&x.HTTPServer.ReadHeaderTimeout, "http_read_header_timeout", nil)
 	reader.String(&x.HTTPServer.ListenSys, "http_listen_sys", nil)  // =>listen_sys
 	reader.String(&x.HTTPServer.SysAPIKey, "http_sys_api_key", nil) // =>sys_api_key
+	reader.Bool(&x.HTTPServer.SysUpstreams, "http_sys_upstreams", nil)
+	reader.Bool(&x.HTTPServer.SysReload, "http_sys_reload", nil)
+	reader.Bool(&x.HTTPServer.SysMaint, "http_sys_maint", nil)
 	reader.StringArray(&x.HTTPServer.AllowOrigins, "http_allow_origins", nil)
 	reader.StringArray(&x.HTTPServer.HeadersDel, "http_headers_del", nil)
 	reader.StringArray(&x.HTTPServer.HeadersAdd, "http_headers_add", nil)
@@ -525,6 +827,12 @@ func (x *AppConfig) readEnvVar() error {
 	reader.String(&x.GeoIP.File, "geo_ip_file", &CmdLine.GeoIPFile)
 
 	reader.Bool(&x.IsMaint, "is_maint", &CmdLine.IsMaint)
+	reader.StringArray(&x.Maint.Routes, "maint_routes", nil)
+	reader.StringArray(&x.Maint.Allow, "maint_allow", nil)
+	reader.String(&x.Maint.BypassHeader, "maint_bypass_header", nil)
+	reader.Int(&x.Maint.RetryAfter, "maint_retry_after", nil)
+	reader.String(&x.Maint.Start, "maint_start", nil)
+	reader.String(&x.Maint.End, "maint_end", nil)
 
 	reader.String(&x.HTTPServer.Listen, "listen", &CmdLine.Listen)
 	reader.String(&x.HTTPServer.ListenTLS, "listen_tls", &CmdLine.ListenTLS)
@@ -534,6 +842,36 @@ func (x *AppConfig) readEnvVar() error {
 
 	reader.StringArray(&x.Proxy.Upstreams, "tragets", &CmdLine.Upstreams)
 	reader.StringArray(&x.HTTPServer.CertHosts, "cert_hosts", &CmdLine.CertHosts)
+	reader.String(&x.HTTPServer.DefaultCert, "default_cert", nil)
+	reader.Int(&x.HTTPServer.CertWatch, "cert_watch", nil)
+	reader.Bool(&x.HTTPServer.OCSPStapling, "ocsp_stapling", nil)
+	reader.String(&x.HTTPServer.ACME.DirectoryURL, "acme_directory_url", nil)
+	reader.String(&x.HTTPServer.ACME.CA, "acme_ca", nil)
+	reader.String(&x.HTTPServer.ACME.Email, "acme_email", nil)
+	reader.String(&x.HTTPServer.ACME.EABKeyID, "acme_eab_kid", nil)
+	reader.String(&x.HTTPServer.ACME.EABHMACKey, "acme_eab_hmac_key", nil)
+	reader.Int(&x.HTTPServer.ACME.RenewBefore, "acme_renew_before", nil)
+	reader.String(&x.HTTPServer.ACME.Challenge, "acme_challenge", nil)
+	reader.String(&x.HTTPServer.ClientAuth.CA, "client_auth_ca", nil)
+	reader.String(&x.HTTPServer.ClientAuth.Verify, "client_auth_verify", nil)
+	reader.StringArray(&x.HTTPServer.ClientAuth.Allow, "client_auth_allow", nil)
+
+	reader.String(&x.Proxy.HealthCheck.Path, "proxy_health_path", nil)
+	reader.Int(&x.Proxy.HealthCheck.Interval, "proxy_health_interval", nil)
+	reader.Int(&x.Proxy.HealthCheck.Timeout, "proxy_health_timeout", nil)
+	reader.Int(&x.Proxy.HealthCheck.Status, "proxy_health_status", nil)
+	reader.Int(&x.Proxy.HealthCheck.Rise, "proxy_health_rise", nil)
+	reader.Int(&x.Proxy.HealthCheck.Fall, "proxy_health_fall", nil)
+	reader.String(&x.Proxy.Balancer, "proxy_balancer", nil)
+	reader.String(&x.Proxy.HashKey, "proxy_hash_key", nil)
+	reader.Bool(&x.Proxy.Affinity.Enabled, "proxy_affinity_enabled", nil)
+	reader.String(&x.Proxy.Affinity.Cookie, "proxy_affinity_cookie", nil)
+	reader.Int(&x.Proxy.Affinity.TTL, "proxy_affinity_ttl", nil)
+	reader.String(&x.Proxy.Affinity.Key, "proxy_affinity_key", nil)
+	reader.Int(&x.Proxy.Outlier.Consecutive, "proxy_outlier_consecutive", nil)
+	reader.Int(&x.Proxy.Outlier.BaseEjection, "proxy_outlier_base_ejection", nil)
+	reader.Int(&x.Proxy.Outlier.MaxEjection, "proxy_outlier_max_ejection", nil)
+	reader.Int(&x.Proxy.Outlier.MaxEjectionPercent, "proxy_outlier_max_ejection_percent", nil)
 
 	reader.StringArray(&x.GeoIP.AllowCountry, "allow_country", nil)
 	reader.StringArray(&x.GeoIP.BlockCountry, "block_country", nil)
@@ -549,6 +887,13 @@ func (x *AppConfig) readEnvVar() error {
 	reader.Int(&x.HTTPServer.TLSSessionCacheSize, "http_tls_session_cache_size", nil)
 	reader.Bool(&x.HTTPServer.TLSSessionCache, "http_tls_session_cache", nil)
 	reader.Bool(&x.HTTPServer.TLSSessionTickets, "http_tls_session_tickets", nil)
+	reader.String(&x.HTTPServer.TLSTicketKeys, "http_tls_ticket_keys", nil)
+	reader.Int(&x.HTTPServer.TLSTicketRotate, "http_tls_ticket_rotate", nil)
+	reader.String(&x.HTTPServer.TLSPreset, "http_tls_preset", nil)
+	reader.String(&x.HTTPServer.TLSMinVersion, "http_tls_min_version", nil)
+	reader.String(&x.HTTPServer.TLSMaxVersion, "http_tls_max_version", nil)
+	reader.StringArray(&x.HTTPServer.TLSCipherSuites, "http_tls_cipher_suites", nil)
+	reader.StringArray(&x.HTTPServer.TLSCurves, "http_tls_curves", nil)
 
 	if reader.envError != nil {
 		return reader.envError
@@ -557,6 +902,59 @@ func (x *AppConfig) readEnvVar() error {
 	return nil
 }
 
+// TLSSettings protocol versions, cipher suites and curves of TLS listener
+func (x *AppConfig) TLSSettings() utiltls.Settings {
+	return utiltls.Settings{
+		Preset:       x.HTTPServer.TLSPreset,
+		MinVersion:   x.HTTPServer.TLSMinVersion,
+		MaxVersion:   x.HTTPServer.TLSMaxVersion,
+		CipherSuites: x.HTTPServer.TLSCipherSuites,
+		Curves:       x.HTTPServer.TLSCurves,
+	}
+}
+
+// allRoutes structured proxy routes and virtual host routes
+func (x *AppConfig) allRoutes() []AppConfigProxyRoute {
+
+	res := slices.Clone(x.Proxy.Routes)
+	for _, vh := range x.VirtualHosts {
+		res = append(res, vh.Routes...)
+	}
+
+	return res
+}
+
+// RoutesClientAuth client auth rules of proxy routes and virtual host routes
+func (x *AppConfig) RoutesClientAuth() []*AppConfigRouteClientAuth {
+
+	res := []*AppConfigRouteClientAuth{}
+
+	for _, v := range x.allRoutes() {
+		if v.ClientAuth != nil {
+			res = append(res, v.ClientAuth)
+		}
+	}
+
+	return res
+}
+
+// mergeCertHosts add hosts of virtual hosts with cert flag to cert hosts
+func (x *AppConfig) mergeCertHosts() {
+
+	for _, vh := range x.VirtualHosts {
+		if !vh.Cert {
+			continue
+		}
+		for _, host := range vh.Hosts {
+			if host == "" || strings.HasPrefix(host, "*") || slices.Contains(x.HTTPServer.CertHosts, host) {
+				continue
+			}
+			x.HTTPServer.CertHosts = append(x.HTTPServer.CertHosts, host)
+		}
+	}
+
+}
+
 func (x *AppConfig) validateEnv() error {
 
 	if x.Env == "" {
@@ -570,17 +968,160 @@ func (x *AppConfig) validateEnv() error {
 	return nil
 
 }
+
+// isIPOrCIDR "10.0.0.1" or "10.0.0.0/8"
+func isIPOrCIDR(v string) bool {
+	if _, err := netip.ParsePrefix(v); err == nil {
+		return true
+	}
+	_, err := netip.ParseAddr(v)
+	return err == nil
+}
+
 func (x AppConfig) validate() error {
 
 	if x.HTTPServer.Listen == "" && x.HTTPServer.ListenTLS == "" {
 		return fmt.Errorf("socket Listen and ListenTLS are empty")
 	}
 
+	{
+		verifies := []string{x.HTTPServer.ClientAuth.Verify}
+		for _, v := range x.RoutesClientAuth() {
+			verifies = append(verifies, v.Verify)
+		}
+		for _, v := range verifies {
+			if !slices.Contains(clientAuthVerify, v) {
+				return fmt.Errorf("client auth verify %q not one of %v", v, clientAuthVerify)
+			}
+		}
+		verify := x.HTTPServer.ClientAuth.Verify
+		if x.HTTPServer.ClientAuth.CA == "" && (verify == ClientAuthRequest || verify == ClientAuthRequire || len(x.RoutesClientAuth()) > 0) {
+			return fmt.Errorf("client auth ca is empty")
+		}
+	}
+
+	{
+		clientIP := x.HTTPServer.ClientIP
+		if !slices.Contains(clientIPModes, clientIP.Mode) {
+			return fmt.Errorf("client ip mode %q not one of %v", clientIP.Mode, clientIPModes[1:])
+		}
+		for _, v := range clientIP.TrustedProxies {
+			if !isIPOrCIDR(v) {
+				return fmt.Errorf("client ip trusted proxy %q is not ip or cidr", v)
+			}
+		}
+		if clientIP.Hops < 0 {
+			return fmt.Errorf("client ip hops must not be negative")
+		}
+		headers := clientIP.Mode == ClientIPXFF || clientIP.Mode == ClientIPRealIP
+		if headers && len(clientIP.TrustedProxies) == 0 {
+			// hops without trusted list would take the header of any peer
+			return fmt.Errorf("client ip mode %v requires trusted proxies", clientIP.Mode)
+		}
+
+		pp := x.HTTPServer.ProxyProtocol
+		if (pp.Listen || pp.ListenTLS || pp.ListenSys) && len(pp.Trusted) == 0 {
+			return fmt.Errorf("proxy protocol requires trusted sources")
+		}
+		for _, v := range pp.Trusted {
+			if !isIPOrCIDR(v) {
+				return fmt.Errorf("proxy protocol trusted source %q is not ip or cidr", v)
+			}
+		}
+		if clientIP.Mode == ClientIPProxyProtocol && !pp.Listen && !pp.ListenTLS {
+			return fmt.Errorf("client ip mode %v requires proxy protocol on listen or listen_tls", clientIP.Mode)
+		}
+	}
+
+	if !slices.Contains([]string{"", RateStoreMemory, RateStoreRedis}, x.HTTPServer.RateStore) {
+		return fmt.Errorf("rate store %q not one of %v", x.HTTPServer.RateStore, []string{RateStoreMemory, RateStoreRedis})
+	}
+	if x.HTTPServer.RateStore == RateStoreRedis {
+		if x.Redis.Host == "" {
+			return fmt.Errorf("rate store %v requires redis host", RateStoreRedis)
+		}
+		if x.Redis.DB < 0 {
+			return fmt.Errorf("redis db %v must not be negative", x.Redis.DB)
+		}
+	}
+
+	for i, v := range x.HTTPServer.RateRules {
+		if v.Rate <= 0 {
+			return fmt.Errorf("rate rule %v: rate must be positive", cmp.Or(v.Name, strconv.Itoa(i)))
+		}
+		if !slices.Contains(rateActions, v.Action) {
+			return fmt.Errorf("rate rule %v: action %q not one of %v", cmp.Or(v.Name, strconv.Itoa(i)), v.Action, rateActions[1:])
+		}
+		kind, name, _ := strings.Cut(v.Key, ":")
+		if !slices.Contains([]string{"", "ip", "subnet", "header", "cookie", "jwt"}, kind) || (name == "") != (kind == "" || kind == "ip" || kind == "subnet") {
+			return fmt.Errorf("rate rule %v: key %q not one of ip, subnet, header:<name>, cookie:<name>, jwt:<claim>", cmp.Or(v.Name, strconv.Itoa(i)), v.Key)
+		}
+		if len(v.Countries) > 0 && !x.GeoIP.Enabled {
+			return fmt.Errorf("rate rule %v: countries require geo ip", cmp.Or(v.Name, strconv.Itoa(i)))
+		}
+	}
+
+	{
+		concurrency := []AppConfigConcurrency{x.HTTPServer.Concurrency, x.Proxy.Concurrency}
+		for _, v := range x.allRoutes() {
+			if v.Concurrency != nil {
+				concurrency = append(concurrency, *v.Concurrency)
+			}
+		}
+		for _, v := range concurrency {
+			if v.MaxInFlight < 0 || v.MaxQueue < 0 || v.QueueTimeout < 0 {
+				return fmt.Errorf("concurrency limits must not be negative")
+			}
+			for _, p := range v.Priorities {
+				if p.Header != "" && !strings.Contains(p.Header, ":") {
+					return fmt.Errorf("concurrency priority header %q not match \"Name: value\"", p.Header)
+				}
+			}
+		}
+	}
+
+	if err := x.TLSSettings().Apply(&tls.Config{}); err != nil {
+		return err
+	}
+
+	{
+		acme := x.HTTPServer.ACME
+		if !slices.Contains([]string{"", utilcert.ChallengeTLSALPN, utilcert.ChallengeHTTP}, acme.Challenge) {
+			return fmt.Errorf("acme challenge %q not one of %v", acme.Challenge, []string{utilcert.ChallengeTLSALPN, utilcert.ChallengeHTTP})
+		}
+		if acme.Challenge == utilcert.ChallengeHTTP && x.HTTPServer.AutoTLS && x.HTTPServer.Listen == "" {
+			return fmt.Errorf("acme challenge %v requires listen", acme.Challenge)
+		}
+		if (acme.EABKeyID == "") != (acme.EABHMACKey == "") {
+			return fmt.Errorf("acme eab_kid and eab_hmac_key must be set both")
+		}
+	}
+
+	{
+		upstreamTLS := []AppConfigProxyTLS{x.Proxy.TLS}
+		for _, v := range x.allRoutes() {
+			if v.TLS != nil {
+				upstreamTLS = append(upstreamTLS, *v.TLS)
+			}
+		}
+		for _, v := range upstreamTLS {
+			if _, err := utiltls.ParseVersion(v.MinVersion); err != nil {
+				return fmt.Errorf("proxy tls min version: %w", err)
+			}
+			if v.InsecureSkipVerify && x.Env != envDevelopment && x.Env != envTesting {
+				return fmt.Errorf("proxy tls insecure_skip_verify is not allowed in %v env", x.Env)
+			}
+			if (v.Cert == "") != (v.Key == "") {
+				return fmt.Errorf("proxy tls cert and key must be set both")
+			}
+		}
+	}
+
 	return nil
 }
 
 type AppConfigSource struct {
-	config *AppConfig
+	config atomic.Pointer[AppConfig]
 }
 
 func MustNewAppConfigSource() *AppConfigSource {
@@ -599,6 +1140,29 @@ func MustNewAppConfigSource() *AppConfigSource {
 
 func (x *AppConfigSource) Load() error {
 
+	res, err := x.Read()
+	if err != nil {
+		return err
+	}
+
+	x.Set(res)
+
+	if CmdLine.DumpConfig {
+		data, _ := json.MarshalIndent(res, "", " ")
+		fmt.Println(string(data))
+	}
+
+	return nil
+}
+
+// Set replace current config, used after reloaded config applied
+func (x *AppConfigSource) Set(appConfig *AppConfig) {
+	x.config.Store(appConfig)
+}
+
+// Read load and validate config from files and env, current config not changed
+func (x *AppConfigSource) Read() (*AppConfig, error) {
+
 	res := NewAppConfig()
 
 	{
@@ -608,7 +1172,7 @@ func (x *AppConfigSource) Load() error {
 	{
 		err := res.readEnvName()
 		if err != nil {
-			return err
+			return nil, err
 		}
 	}
 
@@ -616,14 +1180,14 @@ func (x *AppConfigSource) Load() error {
 		for i := 0; i < len(res.ConfigPath); i++ {
 
 			dir := res.ConfigPath[i]
-			fileName := fmt.Sprintf("config.%s.json", res.Env)
+			fileName := res.ConfigFileName()
 
 			xlog.Info("loading config from: %v", dir)
 
 			err := utilconfig.LoadConfig(res /*pointer*/, dir, fileName)
 
 			if err != nil {
-				return err
+				return nil, err
 			}
 
 		}
@@ -633,33 +1197,33 @@ func (x *AppConfigSource) Load() error {
 	{
 		err := res.readEnvVar()
 		if err != nil {
-			return err
+			return nil, err
 		}
 
 	}
 
+	res.mergeCertHosts()
+
 	{
 		err := res.validate()
 		if err != nil {
-			return err
+			return nil, err
 		}
 	}
 
 	xlog.Info("config loaded: Name=%v Env=%v Debug=%v ", res.Name, res.Env, res.Debug)
 
-	x.config = res
-
-	if CmdLine.DumpConfig {
-		data, _ := json.MarshalIndent(res, "", " ")
-		fmt.Println(string(data))
-	}
+	return res, nil
+}
 
-	return nil
+// ConfigFileName "config.<env>.json" in each config path
+func (x *AppConfig) ConfigFileName() string {
+	return fmt.Sprintf("config.%s.json", x.Env)
 }
 
 func (x *AppConfigSource) Config() *AppConfig {
 
-	return x.config
+	return x.config.Load()
 
 }
 
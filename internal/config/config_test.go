@@ -2,6 +2,7 @@ package config
 
 import (
 	"os"
+	"strings"
 	"testing"
 )
 
@@ -35,3 +36,140 @@ func Test_envReader_StringArray(t *testing.T) {
 		})
 	}
 }
+
+func TestAppConfig_Diff(t *testing.T) {
+
+	a := NewAppConfig()
+	b := NewAppConfig()
+
+	b.Proxy.Balancer = "least_conn"
+	b.HTTPServer.SysAPIKey = "secret"
+	b.Proxy.Routes = []AppConfigProxyRoute{{Prefix: "/api/*", Affinity: &AppConfigProxyAffinity{Key: "qwe"}}}
+
+	got := strings.Join(a.Diff(b), "\n")
+
+	for _, want := range []string{
+		`proxy.balancer: "" => "least_conn"`,
+		`http_server.sys_api_key: *** => ***`,
+		`proxy.routes.0.prefix: - => "/api/*"`,
+		`proxy.routes.0.affinity.key: *** => ***`,
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("Diff() = %v, want contains %v", got, want)
+		}
+	}
+
+	if strings.Contains(got, "secret") || strings.Contains(got, "qwe") {
+		t.Errorf("Diff() has secret values: %v", got)
+	}
+
+	if diff := a.Diff(NewAppConfig()); len(diff) != 0 {
+		t.Errorf("Diff() of same config = %v, want empty", diff)
+	}
+}
+
+func TestAppConfig_validate(t *testing.T) {
+
+	tests := []struct {
+		name   string
+		modify func(x *AppConfig)
+		ok     bool
+	}{
+		{name: "default", modify: func(x *AppConfig) {}, ok: true},
+		{name: "insecure in production", modify: func(x *AppConfig) {
+			x.Proxy.TLS.InsecureSkipVerify = true
+		}, ok: false},
+		{name: "insecure route in development", modify: func(x *AppConfig) {
+			x.Env = envDevelopment
+			x.Proxy.Routes = []AppConfigProxyRoute{{TLS: &AppConfigProxyTLS{InsecureSkipVerify: true}}}
+		}, ok: true},
+		{name: "insecure vhost route in production", modify: func(x *AppConfig) {
+			x.VirtualHosts = []AppConfigVirtualHost{{Routes: []AppConfigProxyRoute{{TLS: &AppConfigProxyTLS{InsecureSkipVerify: true}}}}}
+		}, ok: false},
+		{name: "cert without key", modify: func(x *AppConfig) {
+			x.Proxy.TLS.Cert = "client.pem"
+		}, ok: false},
+		{name: "client auth without ca", modify: func(x *AppConfig) {
+			x.HTTPServer.ClientAuth.Verify = ClientAuthRequire
+		}, ok: false},
+		{name: "unknown tls preset", modify: func(x *AppConfig) {
+			x.HTTPServer.TLSPreset = "strict"
+		}, ok: false},
+		{name: "redis rate store", modify: func(x *AppConfig) {
+			x.HTTPServer.RateStore = RateStoreRedis
+		}, ok: true},
+		{name: "redis rate store with negative db", modify: func(x *AppConfig) {
+			x.HTTPServer.RateStore = RateStoreRedis
+			x.Redis.DB = -1
+		}, ok: false},
+		{name: "unknown rate store", modify: func(x *AppConfig) {
+			x.HTTPServer.RateStore = "memcached"
+		}, ok: false},
+		{name: "rate rule", modify: func(x *AppConfig) {
+			x.HTTPServer.RateRules = []AppConfigRateRule{{Path: "/api", Key: "header:X-API-Key", Rate: 10, Action: RateActionDelay}}
+		}, ok: true},
+		{name: "rate rule header without name", modify: func(x *AppConfig) {
+			x.HTTPServer.RateRules = []AppConfigRateRule{{Key: "header", Rate: 10}}
+		}, ok: false},
+		{name: "rate rule without rate", modify: func(x *AppConfig) {
+			x.HTTPServer.RateRules = []AppConfigRateRule{{Key: "subnet"}}
+		}, ok: false},
+		{name: "rate rule countries without geo ip", modify: func(x *AppConfig) {
+			x.HTTPServer.RateRules = []AppConfigRateRule{{Rate: 10, Countries: []string{"US"}}}
+		}, ok: false},
+		{name: "concurrency priority header", modify: func(x *AppConfig) {
+			x.Proxy.Routes = []AppConfigProxyRoute{{Concurrency: &AppConfigConcurrency{MaxInFlight: 10, Priorities: []AppConfigConcurrencyPriority{{Header: "X-Priority"}}}}}
+		}, ok: false},
+		{name: "client ip xff", modify: func(x *AppConfig) {
+			x.HTTPServer.ClientIP = AppConfigClientIP{Mode: ClientIPXFF, TrustedProxies: []string{"10.0.0.0/8", "192.168.1.1"}}
+		}, ok: true},
+		{name: "client ip xff without trusted proxies", modify: func(x *AppConfig) {
+			x.HTTPServer.ClientIP = AppConfigClientIP{Mode: ClientIPXFF}
+		}, ok: false},
+		{name: "client ip xff hops without trusted proxies", modify: func(x *AppConfig) {
+			x.HTTPServer.ClientIP = AppConfigClientIP{Mode: ClientIPXFF, Hops: 2}
+		}, ok: false},
+		{name: "client ip invalid trusted proxy", modify: func(x *AppConfig) {
+			x.HTTPServer.ClientIP = AppConfigClientIP{Mode: ClientIPRealIP, TrustedProxies: []string{"10.0.0"}}
+		}, ok: false},
+		{name: "proxy protocol", modify: func(x *AppConfig) {
+			x.HTTPServer.ProxyProtocol = AppConfigProxyProtocol{Listen: true, Trusted: []string{"10.0.0.0/8"}}
+			x.HTTPServer.ClientIP = AppConfigClientIP{Mode: ClientIPProxyProtocol}
+		}, ok: true},
+		{name: "proxy protocol without trusted sources", modify: func(x *AppConfig) {
+			x.HTTPServer.ProxyProtocol = AppConfigProxyProtocol{ListenTLS: true}
+		}, ok: false},
+		{name: "proxy protocol invalid trusted source", modify: func(x *AppConfig) {
+			x.HTTPServer.ProxyProtocol = AppConfigProxyProtocol{Listen: true, Trusted: []string{"10.0.0.0/40"}}
+		}, ok: false},
+		{name: "client ip proxy protocol without listener", modify: func(x *AppConfig) {
+			x.HTTPServer.ProxyProtocol = AppConfigProxyProtocol{ListenSys: true, Trusted: []string{"10.0.0.0/8"}}
+			x.HTTPServer.ClientIP = AppConfigClientIP{Mode: ClientIPProxyProtocol}
+		}, ok: false},
+		{name: "acme http challenge", modify: func(x *AppConfig) {
+			x.HTTPServer.AutoTLS = true
+			x.HTTPServer.ACME.Challenge = "http-01"
+		}, ok: true},
+		{name: "acme http challenge without listen", modify: func(x *AppConfig) {
+			x.HTTPServer.AutoTLS = true
+			x.HTTPServer.Listen = ""
+			x.HTTPServer.ListenTLS = "127.0.0.1:443"
+			x.HTTPServer.ACME.Challenge = "http-01"
+		}, ok: false},
+		{name: "acme dns challenge", modify: func(x *AppConfig) {
+			x.HTTPServer.ACME.Challenge = "dns-01"
+		}, ok: false},
+		{name: "acme eab without key", modify: func(x *AppConfig) {
+			x.HTTPServer.ACME.EABKeyID = "kid"
+		}, ok: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			x := NewAppConfig()
+			tt.modify(x)
+			if err := x.validate(); (err == nil) != tt.ok {
+				t.Errorf("validate() error = %v, want ok %v", err, tt.ok)
+			}
+		})
+	}
+}
@@ -32,7 +32,10 @@ const (
 const (
 	PathAuthStatusAPI = "/auth/api/status" // get _csrf, user related, no-cache
 
-	PathSysMetricsAPI = "/sys/api/metrics"
+	PathSysMetricsAPI   = "/sys/api/metrics"
+	PathSysUpstreamsAPI = "/sys/api/upstreams"
+	PathSysReloadAPI    = "/sys/api/reload"
+	PathSysMaintAPI     = "/sys/api/maint"
 	// PathAPITestPing = PathAPITest + "/ping" // no self ping
 
 	PathProxyPingDebugAPI   = "/proxy/api/ping"
@@ -0,0 +1,106 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// secretKeys values of fields with these words are not logged
+var secretKeys = []string{"password", "secret", "token", "hmac"}
+
+// Diff changed fields "proxy.balancer: "round_robin" => "least_conn"", items of arrays by index "proxy.routes.0.prefix"
+func (x *AppConfig) Diff(other *AppConfig) []string {
+
+	a, b := x.flatten(), other.flatten()
+
+	keys := []string{}
+	for k := range a {
+		keys = append(keys, k)
+	}
+	for k := range b {
+		if _, ok := a[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	slices.Sort(keys)
+
+	res := []string{}
+	for _, k := range keys {
+		va, oka := a[k]
+		vb, okb := b[k]
+		if va == vb || (!oka && vb == "null") || (!okb && va == "null") {
+			continue
+		}
+		if !oka {
+			va = "-"
+		}
+		if !okb {
+			vb = "-"
+		}
+		if isSecretKey(k) {
+			va, vb = "***", "***"
+		}
+		res = append(res, fmt.Sprintf("%v: %v => %v", k, va, vb))
+	}
+
+	return res
+}
+
+// flatten json fields to "a.b.c" => json value
+func (x *AppConfig) flatten() map[string]string {
+
+	res := map[string]string{}
+
+	data, err := json.Marshal(x)
+	if err != nil {
+		return res
+	}
+
+	var value any
+	if err := json.Unmarshal(data, &value); err != nil {
+		return res
+	}
+
+	var walk func(prefix string, value any)
+	walk = func(prefix string, value any) {
+		join := func(k string) string {
+			if prefix == "" {
+				return k
+			}
+			return prefix + "." + k
+		}
+		switch v := value.(type) {
+		case map[string]any:
+			for k, item := range v {
+				walk(join(k), item)
+			}
+			return
+		case []any:
+			for i, item := range v {
+				walk(join(strconv.Itoa(i)), item)
+			}
+			return
+		}
+		data, _ := json.Marshal(value)
+		res[prefix] = string(data)
+	}
+	walk("", value)
+
+	return res
+}
+
+func isSecretKey(name string) bool {
+	name = strings.ToLower(name[strings.LastIndex(name, ".")+1:])
+	if name == "key" || strings.HasSuffix(name, "api_key") {
+		return true
+	}
+	for _, v := range secretKeys {
+		if strings.Contains(name, v) {
+			return true
+		}
+	}
+	return false
+}
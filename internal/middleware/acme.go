@@ -0,0 +1,30 @@
+package middleware
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// ACMEChallengePrefix path of ACME HTTP-01 challenges
+const ACMEChallengePrefix = "/.well-known/acme-challenge/"
+
+// ACMEChallenge answer HTTP-01 challenges by handler of manager on plain listener before other middlewares,
+// requests of TLS listener passed to next, only for http-01 challenge, handler enables http-01 on manager
+func ACMEChallenge(handler http.Handler) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+
+			req := c.Request()
+
+			if req.TLS != nil || !strings.HasPrefix(req.URL.Path, ACMEChallengePrefix) {
+				return next(c)
+			}
+
+			handler.ServeHTTP(c.Response(), req)
+
+			return nil
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package middleware
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+func TestACMEChallenge(t *testing.T) {
+
+	dir := t.TempDir()
+
+	// token of pending challenge in cache of manager
+	if err := os.WriteFile(filepath.Join(dir, "token1+http-01"), []byte("token1.thumbprint"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist("example.com"),
+		Cache:      autocert.DirCache(dir),
+	}
+
+	// app handler with redirect to https and maintenance of all routes
+	mode, _ := newMaintMode(MaintMode{Enabled: true})
+	app := echo.New()
+	app.Pre(middleware.HTTPSRedirect())
+	app.Pre(newMaintenance(mode, &maintBypass{}))
+	app.RouteNotFound("/*", func(c echo.Context) error { return c.String(http.StatusOK, "app") })
+
+	e := echo.New()
+	e.Pre(ACMEChallenge(m.HTTPHandler(nil)))
+	e.RouteNotFound("/*", func(c echo.Context) error {
+		app.ServeHTTP(c.Response().Writer, c.Request())
+		return nil
+	})
+
+	do := func(host string, path string, isTLS bool) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Host = host
+		if isTLS {
+			req.TLS = &tls.ConnectionState{}
+		}
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+
+	tests := []struct {
+		name   string
+		host   string
+		path   string
+		isTLS  bool
+		status int
+		body   string
+	}{
+		{name: "challenge", host: "example.com", path: "/.well-known/acme-challenge/token1", status: http.StatusOK, body: "token1.thumbprint"},
+		{name: "unknown token", host: "example.com", path: "/.well-known/acme-challenge/token2", status: http.StatusNotFound},
+		{name: "unknown host", host: "other.com", path: "/.well-known/acme-challenge/token1", status: http.StatusForbidden},
+		{name: "redirect of other paths", host: "example.com", path: "/index.html", status: http.StatusMovedPermanently},
+		{name: "tls listener", host: "example.com", path: "/.well-known/acme-challenge/token1", isTLS: true, status: http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := do(tt.host, tt.path, tt.isTLS)
+			if rec.Code != tt.status {
+				t.Fatalf("status = %v, want %v", rec.Code, tt.status)
+			}
+			if tt.body != "" && rec.Body.String() != tt.body {
+				t.Errorf("body = %q, want %q", rec.Body.String(), tt.body)
+			}
+		})
+	}
+}
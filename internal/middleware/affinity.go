@@ -0,0 +1,137 @@
+package middleware
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"go-proxy/internal/config"
+	xlog "go-proxy/internal/util/utillog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// affinity sticky session cookie "<target id>.<expires>.<signature>"
+type affinity struct {
+	cookie string
+	ttl    time.Duration
+	key    []byte
+}
+
+func newAffinity(cfg config.AppConfigProxyAffinity) *affinity {
+
+	res := &affinity{
+		cookie: cfg.Cookie,
+		ttl:    time.Duration(cfg.TTL) * time.Second,
+		key:    []byte(cfg.Key),
+	}
+
+	if res.cookie == "" {
+		res.cookie = "_affinity"
+	}
+
+	if len(res.key) == 0 {
+		xlog.Warn("affinity cookie key is empty, random key is used, cookies not valid after restart")
+		res.key = make([]byte, 32)
+		_, _ = rand.Read(res.key)
+	}
+
+	return res
+}
+
+// targetID short id of target, not expose target address
+func (x *affinity) targetID(name string) string {
+	sum := sha256.Sum256([]byte(name))
+	return hex.EncodeToString(sum[:8])
+}
+
+func (x *affinity) sign(pool string, id string, expires string) string {
+	mac := hmac.New(sha256.New, x.key)
+	mac.Write([]byte(pool + "|" + id + "|" + expires))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (x *affinity) encode(pool string, name string, now time.Time) string {
+
+	id := x.targetID(name)
+	expires := "0"
+	if x.ttl > 0 {
+		expires = strconv.FormatInt(now.Add(x.ttl).Unix(), 10)
+	}
+
+	return id + "." + expires + "." + x.sign(pool, id, expires)
+}
+
+// decode target id from cookie value, empty if invalid or expired
+func (x *affinity) decode(pool string, value string, now time.Time) string {
+
+	parts := strings.Split(value, ".")
+	if len(parts) != 3 {
+		return ""
+	}
+
+	id, expires, signature := parts[0], parts[1], parts[2]
+
+	if !hmac.Equal([]byte(signature), []byte(x.sign(pool, id, expires))) {
+		return ""
+	}
+
+	if expires != "0" {
+		v, err := strconv.ParseInt(expires, 10, 64)
+		if err != nil || now.Unix() > v {
+			return ""
+		}
+	}
+
+	return id
+}
+
+// get target id from request cookie
+func (x *affinity) get(c echo.Context, pool string) string {
+	cookie, err := c.Cookie(x.cookie)
+	if err != nil {
+		return ""
+	}
+	return x.decode(pool, cookie.Value, time.Now())
+}
+
+// set cookie of target to response
+func (x *affinity) set(c echo.Context, pool string, name string) {
+
+	cookie := &http.Cookie{
+		Name:     x.cookie,
+		Value:    x.encode(pool, name, time.Now()),
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   c.Scheme() == "https",
+		SameSite: http.SameSiteLaxMode,
+	}
+
+	if x.ttl > 0 {
+		cookie.MaxAge = int(x.ttl / time.Second)
+	}
+
+	c.SetCookie(cookie)
+}
+
+// stickyTarget available target from affinity cookie, call under lock
+func (x *upstreamPool) stickyTarget(c echo.Context) *poolTarget {
+
+	id := x.affinity.get(c, x.name)
+	if id == "" {
+		return nil
+	}
+
+	for _, v := range x.targets {
+		if v.added && x.affinity.targetID(v.target.Name) == id {
+			return v
+		}
+	}
+
+	return nil // target unhealthy or removed, fallback to balancer
+}
@@ -0,0 +1,97 @@
+package middleware
+
+import (
+	"go-proxy/internal/config"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+func Test_affinity_decode(t *testing.T) {
+
+	x := newAffinity(config.AppConfigProxyAffinity{Cookie: "sid", TTL: 60, Key: "secret"})
+	now := time.Now()
+	value := x.encode("/api", "http://127.0.0.1:8080", now)
+	id := x.targetID("http://127.0.0.1:8080")
+	tampered := x.targetID("http://127.0.0.1:8081") + value[len(id):]
+
+	tests := []struct {
+		name  string
+		pool  string
+		value string
+		now   time.Time
+		want  string
+	}{
+		{name: "valid", pool: "/api", value: value, now: now, want: id},
+		{name: "other pool", pool: "/web", value: value, now: now, want: ""},
+		{name: "expired", pool: "/api", value: value, now: now.Add(2 * time.Minute), want: ""},
+		{name: "tampered", pool: "/api", value: tampered, now: now, want: ""},
+		{name: "garbage", pool: "/api", value: "qwe", now: now, want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := x.decode(tt.pool, tt.value, tt.now); got != tt.want {
+				t.Errorf("decode() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_upstreamPool_affinity(t *testing.T) {
+
+	e := echo.New()
+
+	pool, _ := newUpstreamPool(&proxyUpstream{
+		prefix:   "/",
+		server:   []proxyServer{{url: "http://127.0.0.1:1"}, {url: "http://127.0.0.1:2"}, {url: "http://127.0.0.1:3"}},
+		affinity: config.AppConfigProxyAffinity{Enabled: true, Cookie: "sid", Key: "secret"},
+	})
+
+	next := func(cookie string) (string, string) {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		if cookie != "" {
+			req.AddCookie(&http.Cookie{Name: "sid", Value: cookie})
+		}
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		target, err := pool.NextTarget(c)
+		if err != nil {
+			t.Fatalf("NextTarget() error: %v", err)
+		}
+		pool.releaseTarget(c)
+
+		newCookie := ""
+		for _, v := range rec.Result().Cookies() {
+			if v.Name == "sid" {
+				newCookie = v.Value
+			}
+		}
+		return target.Name, newCookie
+	}
+
+	first, cookie := next("")
+	if cookie == "" {
+		t.Fatalf("expected affinity cookie")
+	}
+
+	for range 5 {
+		if name, newCookie := next(cookie); name != first || newCookie != "" {
+			t.Fatalf("expected sticky target %v, got %v", first, name)
+		}
+	}
+
+	// fallback to balancer
+	pool.setHealthy(first, false)
+
+	other, newCookie := next(cookie)
+	if other == first || newCookie == "" {
+		t.Fatalf("expected other target and new cookie, got %v", other)
+	}
+
+	if name, _ := next(newCookie); name != other {
+		t.Fatalf("expected sticky target %v, got %v", other, name)
+	}
+}
@@ -0,0 +1,340 @@
+package middleware
+
+import (
+	"cmp"
+	"fmt"
+	"hash/crc32"
+	"math/rand/v2"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+)
+
+const (
+	BalancerRoundRobin         = "round_robin"
+	BalancerWeightedRoundRobin = "weighted_round_robin"
+	BalancerLeastConn          = "least_conn"
+	BalancerRandomTwo          = "random_two" // power of two random choices
+	BalancerHash               = "hash"       // consistent hash on client IP, header or cookie
+
+	// walk position of request for balancer: proxy attempt plus targets skipped by pool in this attempt
+	balancerAttemptKey = "_balancer_attempt"
+)
+
+// newBalancer balancer by strategy name, hashKey used by hash strategy: "ip", "header:X-User", "cookie:session"
+func newBalancer(strategy string, hashKey string, loads *loadCounter) (middleware.ProxyBalancer, error) {
+
+	switch strategy {
+	case "", BalancerRoundRobin:
+		return middleware.NewRoundRobinBalancer([]*middleware.ProxyTarget{}), nil
+	case BalancerWeightedRoundRobin:
+		b := &weightedRoundRobinBalancer{current: map[string]int{}}
+		b.onChange = b.prune
+		return b, nil
+	case BalancerLeastConn:
+		return &leastConnBalancer{loads: loads}, nil
+	case BalancerRandomTwo:
+		return &randomTwoBalancer{loads: loads}, nil
+	case BalancerHash:
+		extractor, err := newHashKeyExtractor(hashKey)
+		if err != nil {
+			return nil, err
+		}
+		b := &hashBalancer{key: extractor}
+		b.onChange = func() { b.ready = false }
+		return b, nil
+	}
+
+	return nil, fmt.Errorf("unknown balancer: %v", strategy)
+}
+
+// targetWeight weight of target from meta, default 1
+func targetWeight(t *middleware.ProxyTarget) int {
+	if w, ok := t.Meta["weight"].(int); ok && w > 0 {
+		return w
+	}
+	return 1
+}
+
+// balancerAttempt zero for first attempt, set by pool per retry and skipped target
+func balancerAttempt(c echo.Context) int {
+	if c == nil {
+		return 0
+	}
+	n, _ := c.Get(balancerAttemptKey).(int)
+	return n
+}
+
+// loadCounter in-flight requests per target
+type loadCounter struct {
+	mutex sync.Mutex
+	items map[string]int
+}
+
+func newLoadCounter() *loadCounter {
+	return &loadCounter{items: map[string]int{}}
+}
+
+func (x *loadCounter) inc(name string) {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+	x.items[name]++
+}
+
+func (x *loadCounter) dec(name string) {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+	if x.items[name] > 0 {
+		x.items[name]--
+	}
+}
+
+func (x *loadCounter) get(name string) int {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+	return x.items[name]
+}
+
+// baseBalancer targets list, onChange called under lock
+type baseBalancer struct {
+	mutex    sync.Mutex
+	targets  []*middleware.ProxyTarget
+	onChange func()
+}
+
+func (x *baseBalancer) AddTarget(target *middleware.ProxyTarget) bool {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+	for _, t := range x.targets {
+		if t.Name == target.Name {
+			return false
+		}
+	}
+	x.targets = append(x.targets, target)
+	if x.onChange != nil {
+		x.onChange()
+	}
+	return true
+}
+
+func (x *baseBalancer) RemoveTarget(name string) bool {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+	for i, t := range x.targets {
+		if t.Name == name {
+			x.targets = slices.Delete(x.targets, i, i+1)
+			if x.onChange != nil {
+				x.onChange()
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// weightedRoundRobinBalancer smooth weighted round robin (as nginx)
+type weightedRoundRobinBalancer struct {
+	baseBalancer
+	current map[string]int
+}
+
+func (x *weightedRoundRobinBalancer) Next(c echo.Context) *middleware.ProxyTarget {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+
+	if len(x.targets) == 0 {
+		return nil
+	}
+
+	var best *middleware.ProxyTarget
+	total := 0
+	for _, t := range x.targets {
+		w := targetWeight(t)
+		total += w
+		x.current[t.Name] += w
+		if best == nil || x.current[t.Name] > x.current[best.Name] {
+			best = t
+		}
+	}
+	x.current[best.Name] -= total
+
+	return best
+}
+
+// prune current weight of removed targets, call under lock
+func (x *weightedRoundRobinBalancer) prune() {
+	for name := range x.current {
+		if !slices.ContainsFunc(x.targets, func(t *middleware.ProxyTarget) bool { return t.Name == name }) {
+			delete(x.current, name)
+		}
+	}
+}
+
+// leastConnBalancer target with least in-flight requests per weight
+type leastConnBalancer struct {
+	baseBalancer
+	loads *loadCounter
+	i     int // rotate start for equal load
+}
+
+func (x *leastConnBalancer) Next(c echo.Context) *middleware.ProxyTarget {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+
+	n := len(x.targets)
+	if n == 0 {
+		return nil
+	}
+
+	x.i = (x.i + 1) % n
+
+	var best *middleware.ProxyTarget
+	bestLoad := 0.0
+	for i := range n {
+		t := x.targets[(x.i+i)%n]
+		load := float64(x.loads.get(t.Name)) / float64(targetWeight(t))
+		if best == nil || load < bestLoad {
+			best, bestLoad = t, load
+		}
+	}
+
+	return best
+}
+
+// randomTwoBalancer less loaded of two random targets
+type randomTwoBalancer struct {
+	baseBalancer
+	loads *loadCounter
+}
+
+func (x *randomTwoBalancer) Next(c echo.Context) *middleware.ProxyTarget {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+
+	n := len(x.targets)
+	switch n {
+	case 0:
+		return nil
+	case 1:
+		return x.targets[0]
+	}
+
+	i := rand.IntN(n)
+	j := rand.IntN(n - 1)
+	if j >= i {
+		j++
+	}
+
+	a, b := x.targets[i], x.targets[j]
+	loadA := float64(x.loads.get(a.Name)) / float64(targetWeight(a))
+	loadB := float64(x.loads.get(b.Name)) / float64(targetWeight(b))
+	if loadB < loadA {
+		return b
+	}
+
+	return a
+}
+
+// hashBalancer consistent hash ring, virtual nodes per weight
+type hashBalancer struct {
+	baseBalancer
+	key   func(c echo.Context) string
+	ring  []hashNode
+	ready bool
+}
+
+type hashNode struct {
+	hash   uint32
+	target *middleware.ProxyTarget
+}
+
+const hashReplicas = 100
+
+func (x *hashBalancer) build() {
+	x.ring = x.ring[:0]
+	for _, t := range x.targets {
+		for i := range hashReplicas * targetWeight(t) {
+			x.ring = append(x.ring, hashNode{
+				hash:   crc32.ChecksumIEEE([]byte(t.Name + "#" + strconv.Itoa(i))),
+				target: t,
+			})
+		}
+	}
+	slices.SortFunc(x.ring, func(a, b hashNode) int {
+		return cmp.Compare(a.hash, b.hash)
+	})
+	x.ready = true
+}
+
+func (x *hashBalancer) Next(c echo.Context) *middleware.ProxyTarget {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+
+	if len(x.targets) == 0 {
+		return nil
+	}
+	if !x.ready {
+		x.build()
+	}
+
+	key := ""
+	if c != nil {
+		key = x.key(c)
+	}
+	if key == "" {
+		return x.targets[rand.IntN(len(x.targets))]
+	}
+
+	h := crc32.ChecksumIEEE([]byte(key))
+	i, _ := slices.BinarySearchFunc(x.ring, h, func(n hashNode, h uint32) int {
+		return cmp.Compare(n.hash, h)
+	})
+
+	// on retry walk the ring to next distinct target
+	attempt := balancerAttempt(c)
+	seen := map[string]bool{}
+	for range len(x.ring) {
+		t := x.ring[i%len(x.ring)].target
+		if !seen[t.Name] {
+			if len(seen) == attempt%len(x.targets) {
+				return t
+			}
+			seen[t.Name] = true
+		}
+		i++
+	}
+
+	return x.ring[0].target
+}
+
+// newHashKeyExtractor key of request: "ip", "header:X-User", "cookie:session"
+func newHashKeyExtractor(hashKey string) (func(c echo.Context) string, error) {
+
+	source, name, _ := strings.Cut(hashKey, ":")
+
+	switch source {
+	case "", "ip":
+		return func(c echo.Context) string { return c.RealIP() }, nil
+	case "header":
+		if name == "" {
+			return nil, fmt.Errorf("hash key header name is empty: %v", hashKey)
+		}
+		return func(c echo.Context) string { return c.Request().Header.Get(name) }, nil
+	case "cookie":
+		if name == "" {
+			return nil, fmt.Errorf("hash key cookie name is empty: %v", hashKey)
+		}
+		return func(c echo.Context) string {
+			if cookie, err := c.Cookie(name); err == nil {
+				return cookie.Value
+			}
+			return ""
+		}, nil
+	}
+
+	return nil, fmt.Errorf("unknown hash key: %v", hashKey)
+}
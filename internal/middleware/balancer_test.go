@@ -0,0 +1,265 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+)
+
+func newTestTargets(weights ...int) []*middleware.ProxyTarget {
+	res := []*middleware.ProxyTarget{}
+	for i, w := range weights {
+		name := "http://127.0.0.1:" + strconv.Itoa(10000+i)
+		u, _ := url.Parse(name)
+		res = append(res, &middleware.ProxyTarget{Name: name, URL: u, Meta: echo.Map{"weight": w}})
+	}
+	return res
+}
+
+func newTestBalancer(t *testing.T, strategy string, hashKey string, loads *loadCounter, targets []*middleware.ProxyTarget) middleware.ProxyBalancer {
+	b, err := newBalancer(strategy, hashKey, loads)
+	if err != nil {
+		t.Fatalf("newBalancer() error: %v", err)
+	}
+	for _, v := range targets {
+		b.AddTarget(v)
+	}
+	return b
+}
+
+func newTestContext(e *echo.Echo, header string, value string) echo.Context {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	if header != "" {
+		req.Header.Set(header, value)
+	}
+	return e.NewContext(req, httptest.NewRecorder())
+}
+
+func Test_weightedRoundRobinBalancer(t *testing.T) {
+
+	targets := newTestTargets(3, 1, 0)
+	b := newTestBalancer(t, BalancerWeightedRoundRobin, "", nil, targets)
+
+	counts := map[string]int{}
+	for range 500 {
+		counts[b.Next(nil).Name]++
+	}
+
+	// weight 0 is 1
+	want := []int{300, 100, 100}
+	for i, v := range targets {
+		if counts[v.Name] != want[i] {
+			t.Errorf("target %v count = %v, want %v", v.Name, counts[v.Name], want[i])
+		}
+	}
+
+	// weight of removed target dropped
+	b.RemoveTarget(targets[2].Name)
+	if _, ok := b.(*weightedRoundRobinBalancer).current[targets[2].Name]; ok {
+		t.Errorf("current weight of removed target kept")
+	}
+
+	// smooth, heavy target interleaved
+	targets = newTestTargets(2, 1)
+	b = newTestBalancer(t, BalancerWeightedRoundRobin, "", nil, targets)
+	for i, v := range []int{0, 1, 0, 0, 1, 0} {
+		if got := b.Next(nil); got != targets[v] {
+			t.Errorf("Next() #%v = %v, want %v", i, got.Name, targets[v].Name)
+		}
+	}
+}
+
+func Test_leastConnBalancer(t *testing.T) {
+
+	loads := newLoadCounter()
+	targets := newTestTargets(1, 1, 2)
+	b := newTestBalancer(t, BalancerLeastConn, "", loads, targets)
+
+	// equal load, all targets used
+	counts := map[string]int{}
+	for range 300 {
+		counts[b.Next(nil).Name]++
+	}
+	for _, v := range targets {
+		if counts[v.Name] == 0 {
+			t.Errorf("target %v not used", v.Name)
+		}
+	}
+
+	// least loaded per weight
+	for range 4 {
+		loads.inc(targets[0].Name)
+	}
+	for range 2 {
+		loads.inc(targets[1].Name)
+	}
+	for range 2 {
+		loads.inc(targets[2].Name) // weight 2, load 1
+	}
+
+	for range 10 {
+		if got := b.Next(nil); got != targets[2] {
+			t.Errorf("Next() = %v, want %v", got.Name, targets[2].Name)
+		}
+	}
+}
+
+func Test_randomTwoBalancer(t *testing.T) {
+
+	loads := newLoadCounter()
+	targets := newTestTargets(1, 1, 1, 1)
+	b := newTestBalancer(t, BalancerRandomTwo, "", loads, targets)
+
+	// equal load, uniform distribution
+	counts := map[string]int{}
+	n := 4000
+	for range n {
+		counts[b.Next(nil).Name]++
+	}
+	for _, v := range targets {
+		if c := counts[v.Name]; c < n/4*7/10 || c > n/4*13/10 {
+			t.Errorf("target %v count = %v, want about %v", v.Name, c, n/4)
+		}
+	}
+
+	// most loaded target never picked
+	for range 10 {
+		loads.inc(targets[0].Name)
+	}
+	for range 1000 {
+		if got := b.Next(nil); got == targets[0] {
+			t.Fatalf("Next() = %v, most loaded target", got.Name)
+		}
+	}
+}
+
+func Test_hashBalancer(t *testing.T) {
+
+	e := echo.New()
+	targets := newTestTargets(1, 1, 1)
+
+	tests := []struct {
+		name    string
+		hashKey string
+		header  string
+	}{
+		{name: "ip", hashKey: "ip", header: echo.HeaderXRealIP},
+		{name: "header", hashKey: "header:X-User-ID", header: "X-User-ID"},
+		{name: "cookie", hashKey: "cookie:sid", header: "Cookie"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTestBalancer(t, BalancerHash, tt.hashKey, nil, targets)
+
+			keyValue := func(i int) string {
+				v := "10.0." + strconv.Itoa(i/256) + "." + strconv.Itoa(i%256)
+				if tt.hashKey == "cookie:sid" {
+					return "sid=" + v
+				}
+				return v
+			}
+
+			// stable and evenly distributed
+			n := 3000
+			counts := map[string]int{}
+			assigned := map[int]string{}
+			for i := range n {
+				got := b.Next(newTestContext(e, tt.header, keyValue(i))).Name
+				if again := b.Next(newTestContext(e, tt.header, keyValue(i))).Name; again != got {
+					t.Fatalf("key %v: Next() = %v then %v", keyValue(i), got, again)
+				}
+				counts[got]++
+				assigned[i] = got
+			}
+			for _, v := range targets {
+				if c := counts[v.Name]; c < n/3/2 || c > n/3*2 {
+					t.Errorf("target %v count = %v, want about %v", v.Name, c, n/3)
+				}
+			}
+
+			// consistent, keys of removed target only moved
+			b.RemoveTarget(targets[0].Name)
+			for i := range n {
+				got := b.Next(newTestContext(e, tt.header, keyValue(i))).Name
+				if assigned[i] != targets[0].Name && got != assigned[i] {
+					t.Fatalf("key %v moved from %v to %v", keyValue(i), assigned[i], got)
+				}
+			}
+		})
+	}
+}
+
+func Test_hashBalancer_retry(t *testing.T) {
+
+	e := echo.New()
+	targets := newTestTargets(1, 1, 1)
+	b := newTestBalancer(t, BalancerHash, "header:X-User-ID", nil, targets)
+
+	c := newTestContext(e, "X-User-ID", "user-1")
+	first := b.Next(c)
+	if again := b.Next(c); again != first {
+		t.Errorf("Next() of same attempt = %v, want %v", again.Name, first.Name)
+	}
+
+	seen := map[string]bool{}
+	for i := range len(targets) {
+		c.Set(balancerAttemptKey, i)
+		seen[b.Next(c).Name] = true
+	}
+	if len(seen) != len(targets) {
+		t.Errorf("retries used %v targets, want %v", len(seen), len(targets))
+	}
+}
+
+func Test_upstreamPool_attempt(t *testing.T) {
+
+	e := echo.New()
+	pool := &upstreamPool{name: "test", loads: newLoadCounter()}
+	pool.balancer, _ = newBalancer(BalancerHash, "header:X-User-ID", pool.loads)
+	for _, v := range newTestTargets(1, 1, 1) {
+		pool.AddTarget(v)
+	}
+
+	c := newTestContext(e, "X-User-ID", "user-1")
+	seen := map[string]bool{}
+	for range 3 {
+		target, err := pool.NextTarget(c)
+		if err != nil {
+			t.Fatalf("NextTarget() error: %v", err)
+		}
+		seen[target.Name] = true
+	}
+	if len(seen) != 3 {
+		t.Errorf("attempts used %v targets, want 3", len(seen))
+	}
+	if n, _ := c.Get(poolAttemptKey).(int); n != 3 {
+		t.Errorf("attempts = %v, want 3", n)
+	}
+}
+
+func Test_newBalancer(t *testing.T) {
+
+	tests := []struct {
+		strategy string
+		hashKey  string
+		wantErr  bool
+	}{
+		{strategy: "", wantErr: false},
+		{strategy: BalancerRoundRobin, wantErr: false},
+		{strategy: BalancerHash, hashKey: "header:", wantErr: true},
+		{strategy: BalancerHash, hashKey: "query:id", wantErr: true},
+		{strategy: "unknown", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.strategy+" "+tt.hashKey, func(t *testing.T) {
+			if _, err := newBalancer(tt.strategy, tt.hashKey, nil); (err != nil) != tt.wantErr {
+				t.Errorf("newBalancer() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,168 @@
+package middleware
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"go-proxy/internal/config"
+	"go-proxy/internal/service"
+	xlog "go-proxy/internal/util/utillog"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// ErrClientCertRequired denotes an error raised when verified client certificate is missing or not allowed
+var ErrClientCertRequired = echo.NewHTTPError(http.StatusForbidden, "client certificate required")
+
+// clientAuth rules of verified client certificate
+type clientAuth struct {
+	verify string
+	allow  []string
+}
+
+func newClientAuth(verify string, allow []string) *clientAuth {
+	res := &clientAuth{verify: verify}
+	for _, v := range allow {
+		if v = strings.ToLower(strings.TrimSpace(v)); v != "" {
+			res.allow = append(res.allow, v)
+		}
+	}
+	return res
+}
+
+// clientCert verified leaf certificate of request, nil if not given or not verified
+func clientCert(r *http.Request) *x509.Certificate {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return r.TLS.VerifiedChains[0][0]
+}
+
+// certIdentities subject, common name and SANs of cert
+func certIdentities(cert *x509.Certificate) []string {
+
+	res := []string{cert.Subject.String(), cert.Subject.CommonName}
+	res = append(res, cert.DNSNames...)
+	res = append(res, cert.EmailAddresses...)
+	for _, v := range cert.URIs {
+		res = append(res, v.String())
+	}
+	for _, v := range cert.IPAddresses {
+		res = append(res, v.String())
+	}
+
+	return res
+}
+
+// allowed cert match any allow rule, "*.example.com" matches any subdomain
+func (x *clientAuth) allowed(cert *x509.Certificate) bool {
+
+	if len(x.allow) == 0 {
+		return true
+	}
+
+	for _, id := range certIdentities(cert) {
+		id = strings.ToLower(id)
+		if id == "" {
+			continue
+		}
+		for _, v := range x.allow {
+			if matchHost(v, id) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// check request certificate, error if required and missing or not allowed
+func (x *clientAuth) check(c echo.Context) error {
+
+	cert := clientCert(c.Request())
+
+	if cert == nil {
+		if x.verify == config.ClientAuthRequire {
+			return ErrClientCertRequired
+		}
+		return nil
+	}
+
+	if !x.allowed(cert) {
+		xlog.Debug("client certificate not allowed: %v", cert.Subject)
+		return ErrClientCertRequired
+	}
+
+	return nil
+}
+
+// middleware check rules before next
+func (x *clientAuth) middleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if err := x.check(c); err != nil {
+			return err
+		}
+		return next(c)
+	}
+}
+
+// newClientCertHeaders remove client headers, set identity of verified client cert for upstream
+func newClientCertHeaders(cfg config.AppConfigClientAuth) echo.MiddlewareFunc {
+
+	headers := []string{}
+	for _, v := range []string{cfg.HeaderSubject, cfg.HeaderFingerprint, cfg.HeaderCert} {
+		if v != "" {
+			headers = append(headers, v)
+		}
+	}
+
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+
+			req := c.Request()
+
+			// not trust headers from client
+			for _, v := range headers {
+				req.Header.Del(v)
+			}
+
+			if cert := clientCert(req); cert != nil {
+				if cfg.HeaderSubject != "" {
+					req.Header.Set(cfg.HeaderSubject, cert.Subject.String())
+				}
+				if cfg.HeaderFingerprint != "" {
+					sum := sha256.Sum256(cert.Raw)
+					req.Header.Set(cfg.HeaderFingerprint, hex.EncodeToString(sum[:]))
+				}
+				if cfg.HeaderCert != "" {
+					data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+					req.Header.Set(cfg.HeaderCert, url.QueryEscape(string(data)))
+				}
+			}
+
+			return next(c)
+		}
+	}
+}
+
+func initClientAuth(e *echo.Echo, appService service.AppService) {
+
+	cfg := appService.Config().HTTPServer.ClientAuth
+
+	// client headers removed on every request, set only of verified cert
+	e.Use(newClientCertHeaders(cfg))
+
+	if cfg.CA == "" {
+		return
+	}
+
+	xlog.Info("client auth verify: %v allow: %v", cfg.Verify, cfg.Allow)
+
+	if len(cfg.Allow) > 0 {
+		e.Use(newClientAuth(cfg.Verify, cfg.Allow).middleware)
+	}
+}
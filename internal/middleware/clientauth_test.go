@@ -0,0 +1,186 @@
+package middleware
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"go-proxy/internal/config"
+	"go-proxy/internal/service"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+func newClientCert(t *testing.T, cn string, dnsNames ...string) *x509.Certificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: cn},
+		DNSNames:     dnsNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+
+	data, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := x509.ParseCertificate(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return cert
+}
+
+func newClientCertRequest(cert *x509.Certificate) *http.Request {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	if cert != nil {
+		req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+	}
+	return req
+}
+
+func Test_clientAuth_check(t *testing.T) {
+
+	svc := newClientCert(t, "svc", "svc.internal.example.com")
+	other := newClientCert(t, "other", "other.example.org")
+
+	tests := []struct {
+		name   string
+		verify string
+		allow  []string
+		cert   *x509.Certificate
+		ok     bool
+	}{
+		{name: "require missing", verify: config.ClientAuthRequire, cert: nil, ok: false},
+		{name: "request missing", verify: config.ClientAuthRequest, cert: nil, ok: true},
+		{name: "require any", verify: config.ClientAuthRequire, cert: other, ok: true},
+		{name: "allow common name", verify: config.ClientAuthRequire, allow: []string{"SVC"}, cert: svc, ok: true},
+		{name: "allow subject", verify: config.ClientAuthRequire, allow: []string{"cn=svc"}, cert: svc, ok: true},
+		{name: "allow wildcard san", verify: config.ClientAuthRequire, allow: []string{"*.example.com"}, cert: svc, ok: true},
+		{name: "not allowed", verify: config.ClientAuthRequire, allow: []string{"*.example.com"}, cert: other, ok: false},
+		{name: "empty rules", verify: config.ClientAuthRequest, allow: []string{" ", ""}, cert: other, ok: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := echo.New()
+			c := e.NewContext(newClientCertRequest(tt.cert), httptest.NewRecorder())
+
+			err := newClientAuth(tt.verify, tt.allow).check(c)
+			if (err == nil) != tt.ok {
+				t.Errorf("check() error = %v, want ok %v", err, tt.ok)
+			}
+			if err != nil && err != ErrClientCertRequired {
+				t.Errorf("check() error = %v, want %v", err, ErrClientCertRequired)
+			}
+		})
+	}
+}
+
+func Test_newClientCertHeaders(t *testing.T) {
+
+	cfg := config.AppConfigClientAuth{
+		HeaderSubject:     "X-Client-Cert-Subject",
+		HeaderFingerprint: "X-Client-Cert-Fingerprint",
+		HeaderCert:        "X-Client-Cert",
+	}
+
+	var got http.Header
+	next := func(c echo.Context) error {
+		got = c.Request().Header.Clone()
+		return nil
+	}
+
+	e := echo.New()
+
+	t.Run("spoofed headers removed", func(t *testing.T) {
+		req := newClientCertRequest(nil)
+		req.Header.Set(cfg.HeaderSubject, "CN=admin")
+		req.Header.Set(cfg.HeaderFingerprint, "00")
+		req.Header.Set(cfg.HeaderCert, "x")
+
+		if err := newClientCertHeaders(cfg)(next)(e.NewContext(req, httptest.NewRecorder())); err != nil {
+			t.Fatal(err)
+		}
+		for _, v := range []string{cfg.HeaderSubject, cfg.HeaderFingerprint, cfg.HeaderCert} {
+			if got.Get(v) != "" {
+				t.Errorf("header %v = %q, want empty", v, got.Get(v))
+			}
+		}
+	})
+
+	t.Run("verified cert forwarded", func(t *testing.T) {
+		cert := newClientCert(t, "svc", "svc.example.com")
+		req := newClientCertRequest(cert)
+		req.Header.Set(cfg.HeaderSubject, "CN=admin")
+
+		if err := newClientCertHeaders(cfg)(next)(e.NewContext(req, httptest.NewRecorder())); err != nil {
+			t.Fatal(err)
+		}
+
+		sum := sha256.Sum256(cert.Raw)
+
+		if v := got.Get(cfg.HeaderSubject); v != "CN=svc" {
+			t.Errorf("subject = %q, want %q", v, "CN=svc")
+		}
+		if v := got.Get(cfg.HeaderFingerprint); v != hex.EncodeToString(sum[:]) {
+			t.Errorf("fingerprint = %q", v)
+		}
+		if v := got.Get(cfg.HeaderCert); v == "" || v[:10] != "-----BEGIN" {
+			t.Errorf("cert = %q, want escaped PEM", v)
+		}
+	})
+}
+
+// configAppService app service of config
+type configAppService struct {
+	service.AppService
+	config *config.AppConfig
+}
+
+func (x *configAppService) Config() *config.AppConfig { return x.config }
+
+func Test_initClientAuth_withoutCA(t *testing.T) {
+
+	appConfig := config.NewAppConfig()
+
+	var got http.Header
+	e := echo.New()
+	initClientAuth(e, &configAppService{config: appConfig})
+	e.RouteNotFound("/*", func(c echo.Context) error {
+		got = c.Request().Header.Clone()
+		return nil
+	})
+
+	cfg := appConfig.HTTPServer.ClientAuth
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set(cfg.HeaderSubject, "CN=admin")
+	req.Header.Set(cfg.HeaderFingerprint, "00")
+	req.Header.Set(cfg.HeaderCert, "x")
+	e.ServeHTTP(httptest.NewRecorder(), req)
+
+	for _, v := range []string{cfg.HeaderSubject, cfg.HeaderFingerprint, cfg.HeaderCert} {
+		if got.Get(v) != "" {
+			t.Errorf("header %v = %q, want empty", v, got.Get(v))
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package middleware
+
+import (
+	"fmt"
+	"go-proxy/internal/config"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// clientIP client address of request through trusted proxies
+type clientIP struct {
+	trusted []netip.Prefix
+	hops    int // xff, trusted proxies in front, by trusted list if 0
+}
+
+// newIPExtractor extractor of mode, headers are used only from trusted proxies,
+// nil for legacy echo RealIP of X-Forwarded-For and X-Real-IP of any peer if mode not set
+func newIPExtractor(cfg config.AppConfigClientIP) (echo.IPExtractor, error) {
+
+	res := &clientIP{hops: cfg.Hops}
+
+	for _, v := range cfg.TrustedProxies {
+		prefix, err := parsePrefix(v)
+		if err != nil {
+			return nil, fmt.Errorf("trusted proxy: %w", err)
+		}
+		res.trusted = append(res.trusted, prefix)
+	}
+
+	switch cfg.Mode {
+	case "":
+		return nil, nil
+	case config.ClientIPDirect, config.ClientIPProxyProtocol: // peer address decoded by listener
+		return res.direct, nil
+	case config.ClientIPXFF:
+		return res.forwardedFor, nil
+	case config.ClientIPRealIP:
+		return res.realIP, nil
+	}
+
+	return nil, fmt.Errorf("client ip mode %q not supported", cfg.Mode)
+}
+
+// remoteAddr ip of connection peer, invalid if not ip
+func remoteAddr(req *http.Request) netip.Addr {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	addr, _ := netip.ParseAddr(host)
+	return addr.Unmap()
+}
+
+func (x *clientIP) isTrusted(addr netip.Addr) bool {
+	for _, v := range x.trusted {
+		if v.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// direct ip of connection peer, headers are ignored
+func (x *clientIP) direct(req *http.Request) string {
+	addr := remoteAddr(req)
+	if !addr.IsValid() {
+		return req.RemoteAddr
+	}
+	return addr.String()
+}
+
+// realIP X-Real-IP of trusted peer
+func (x *clientIP) realIP(req *http.Request) string {
+	addr := remoteAddr(req)
+	if !addr.IsValid() || !x.isTrusted(addr) {
+		return x.direct(req)
+	}
+	if v, err := netip.ParseAddr(strings.TrimSpace(req.Header.Get(echo.HeaderXRealIP))); err == nil {
+		return v.Unmap().String()
+	}
+	return addr.String()
+}
+
+// forwardedFor X-Forwarded-For from right of trusted peer while sender is trusted, by hops or trusted list,
+// invalid entry stops at proxy which added it
+func (x *clientIP) forwardedFor(req *http.Request) string {
+
+	sender := remoteAddr(req)
+	if !sender.IsValid() {
+		return x.direct(req)
+	}
+	if !x.isTrusted(sender) {
+		return sender.String()
+	}
+
+	ips := []string{}
+	for _, v := range req.Header.Values(echo.HeaderXForwardedFor) {
+		ips = append(ips, strings.Split(v, ",")...)
+	}
+
+	hop := 1
+	for i := len(ips) - 1; i >= 0; i-- {
+		if x.hops > 0 && hop > x.hops || x.hops == 0 && !x.isTrusted(sender) {
+			break
+		}
+		addr, err := netip.ParseAddr(strings.TrimSpace(ips[i]))
+		if err != nil {
+			break
+		}
+		sender = addr.Unmap()
+		hop++
+	}
+
+	return sender.String()
+}
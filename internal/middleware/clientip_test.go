@@ -0,0 +1,75 @@
+package middleware
+
+import (
+	"go-proxy/internal/config"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func Test_newIPExtractor(t *testing.T) {
+
+	trusted := []string{"10.0.0.0/8", "2001:db8::1"}
+
+	tests := []struct {
+		name   string
+		cfg    config.AppConfigClientIP
+		remote string
+		xff    []string
+		realIP string
+		want   string
+	}{
+		{name: "direct", cfg: config.AppConfigClientIP{Mode: config.ClientIPDirect}, remote: "1.1.1.1:1234", want: "1.1.1.1"},
+		{name: "direct ignores xff spoof", cfg: config.AppConfigClientIP{Mode: config.ClientIPDirect}, remote: "1.1.1.1:1234", xff: []string{"8.8.8.8"}, realIP: "8.8.4.4", want: "1.1.1.1"},
+		{name: "direct ipv6", cfg: config.AppConfigClientIP{Mode: config.ClientIPDirect}, remote: "[2001:db8::5]:1234", want: "2001:db8::5"},
+		{name: "direct mapped ipv4", cfg: config.AppConfigClientIP{Mode: config.ClientIPDirect}, remote: "[::ffff:1.1.1.1]:1234", want: "1.1.1.1"},
+
+		{name: "xff from trusted proxy", cfg: config.AppConfigClientIP{Mode: config.ClientIPXFF, TrustedProxies: trusted}, remote: "10.0.0.1:1234", xff: []string{"1.1.1.1"}, want: "1.1.1.1"},
+		{name: "xff from untrusted peer", cfg: config.AppConfigClientIP{Mode: config.ClientIPXFF, TrustedProxies: trusted}, remote: "1.1.1.1:1234", xff: []string{"8.8.8.8"}, want: "1.1.1.1"},
+		{name: "xff spoof prepended by client", cfg: config.AppConfigClientIP{Mode: config.ClientIPXFF, TrustedProxies: trusted}, remote: "10.0.0.1:1234", xff: []string{"8.8.8.8, 1.1.1.1"}, want: "1.1.1.1"},
+		{name: "xff spoof of trusted address", cfg: config.AppConfigClientIP{Mode: config.ClientIPXFF, TrustedProxies: trusted}, remote: "10.0.0.1:1234", xff: []string{"10.0.0.9, 1.1.1.1, 10.0.0.2"}, want: "1.1.1.1"},
+		{name: "xff chain of trusted proxies", cfg: config.AppConfigClientIP{Mode: config.ClientIPXFF, TrustedProxies: trusted}, remote: "10.0.0.1:1234", xff: []string{"1.1.1.1, 10.0.0.3", "10.0.0.2"}, want: "1.1.1.1"},
+		{name: "xff all trusted", cfg: config.AppConfigClientIP{Mode: config.ClientIPXFF, TrustedProxies: trusted}, remote: "10.0.0.1:1234", xff: []string{"10.0.0.3"}, want: "10.0.0.3"},
+		{name: "xff invalid entry", cfg: config.AppConfigClientIP{Mode: config.ClientIPXFF, TrustedProxies: trusted}, remote: "10.0.0.1:1234", xff: []string{"1.1.1.1, junk, 10.0.0.2"}, want: "10.0.0.2"},
+		{name: "xff without header", cfg: config.AppConfigClientIP{Mode: config.ClientIPXFF, TrustedProxies: trusted}, remote: "10.0.0.1:1234", want: "10.0.0.1"},
+		{name: "xff ipv6 proxy", cfg: config.AppConfigClientIP{Mode: config.ClientIPXFF, TrustedProxies: trusted}, remote: "[2001:db8::1]:1234", xff: []string{"2001:db8::7"}, want: "2001:db8::7"},
+		{name: "xff hops", cfg: config.AppConfigClientIP{Mode: config.ClientIPXFF, TrustedProxies: trusted, Hops: 2}, remote: "10.0.0.1:1234", xff: []string{"8.8.8.8, 2.2.2.2, 3.3.3.3"}, want: "2.2.2.2"},
+		{name: "xff hops untrusted peer", cfg: config.AppConfigClientIP{Mode: config.ClientIPXFF, TrustedProxies: trusted, Hops: 2}, remote: "1.1.1.1:1234", xff: []string{"8.8.8.8, 2.2.2.2, 3.3.3.3"}, want: "1.1.1.1"},
+		{name: "xff hops short header", cfg: config.AppConfigClientIP{Mode: config.ClientIPXFF, TrustedProxies: trusted, Hops: 3}, remote: "10.0.0.1:1234", xff: []string{"3.3.3.3"}, want: "3.3.3.3"},
+		{name: "xff hops without trusted list", cfg: config.AppConfigClientIP{Mode: config.ClientIPXFF, Hops: 1}, remote: "1.1.1.1:1234", xff: []string{"8.8.8.8"}, want: "1.1.1.1"},
+
+		{name: "real ip from trusted proxy", cfg: config.AppConfigClientIP{Mode: config.ClientIPRealIP, TrustedProxies: trusted}, remote: "10.0.0.1:1234", realIP: "1.1.1.1", want: "1.1.1.1"},
+		{name: "real ip from untrusted peer", cfg: config.AppConfigClientIP{Mode: config.ClientIPRealIP, TrustedProxies: trusted}, remote: "1.1.1.1:1234", realIP: "8.8.8.8", want: "1.1.1.1"},
+		{name: "real ip ignores xff", cfg: config.AppConfigClientIP{Mode: config.ClientIPRealIP, TrustedProxies: trusted}, remote: "10.0.0.1:1234", xff: []string{"8.8.8.8"}, want: "10.0.0.1"},
+		{name: "real ip invalid", cfg: config.AppConfigClientIP{Mode: config.ClientIPRealIP, TrustedProxies: trusted}, remote: "10.0.0.1:1234", realIP: "junk", want: "10.0.0.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			extractor, err := newIPExtractor(tt.cfg)
+			if err != nil {
+				t.Fatalf("newIPExtractor() error: %v", err)
+			}
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = tt.remote
+			for _, v := range tt.xff {
+				req.Header.Add("X-Forwarded-For", v)
+			}
+			if tt.realIP != "" {
+				req.Header.Set("X-Real-IP", tt.realIP)
+			}
+			if got := extractor(req); got != tt.want {
+				t.Errorf("extractor() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	if extractor, err := newIPExtractor(config.AppConfigClientIP{}); err != nil || extractor != nil {
+		t.Errorf("legacy extractor = %v, %v, want nil of echo RealIP", extractor, err)
+	}
+	if _, err := newIPExtractor(config.AppConfigClientIP{Mode: "forwarded"}); err == nil {
+		t.Errorf("expected mode error")
+	}
+	if _, err := newIPExtractor(config.AppConfigClientIP{Mode: config.ClientIPXFF, TrustedProxies: []string{"10.0.0.0/33"}}); err == nil {
+		t.Errorf("expected trusted proxy error")
+	}
+}
@@ -0,0 +1,240 @@
+package middleware
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"go-proxy/internal/config"
+	webfs "go-proxy/web"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// metrics of limiters by name, "global" or upstream name, inc/dec as limiters are replaced on reload
+var (
+	concurrencyInFlight = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "proxy_concurrency_in_flight",
+		Help: "Requests in flight of concurrency limiter.",
+	}, []string{"limiter"})
+	concurrencyQueueDepth = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "proxy_concurrency_queue_depth",
+		Help: "Requests waiting in queue of concurrency limiter.",
+	}, []string{"limiter"})
+	concurrencyShed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "proxy_concurrency_shed_total",
+		Help: "Requests shed by concurrency limiter, by reason queue_full or timeout.",
+	}, []string{"limiter", "reason"})
+)
+
+var (
+	errQueueFull    = errors.New("concurrency queue full")
+	errQueueTimeout = errors.New("concurrency queue timeout")
+)
+
+type concurrencyPriority struct {
+	path        string // static prefix
+	headerName  string
+	headerValue string
+	priority    int
+}
+
+// queueWaiter request waiting for slot, ready is closed on grant or shed
+type queueWaiter struct {
+	priority int
+	ready    chan struct{}
+	shed     bool // evicted by higher priority
+}
+
+// concurrencyLimiter in-flight requests limit with priority queue
+type concurrencyLimiter struct {
+	name       string
+	max        int
+	maxQueue   int
+	timeout    time.Duration
+	priorities []concurrencyPriority
+
+	mutex    sync.Mutex
+	inFlight int
+	queue    []*queueWaiter // by arrival
+}
+
+// newConcurrencyLimiter limiter of config, nil if unlimited
+func newConcurrencyLimiter(name string, cfg config.AppConfigConcurrency) *concurrencyLimiter {
+
+	if cfg.MaxInFlight <= 0 {
+		return nil
+	}
+
+	res := &concurrencyLimiter{
+		name:     name,
+		max:      cfg.MaxInFlight,
+		maxQueue: cfg.MaxQueue,
+		timeout:  time.Duration(cmp.Or(cfg.QueueTimeout, 5)) * time.Second,
+	}
+
+	for _, v := range cfg.Priorities {
+		p := concurrencyPriority{path: staticPrefix(v.Path), priority: v.Priority}
+		if v.Header != "" {
+			if headers := parseHeaders([]string{v.Header}); len(headers) > 0 {
+				p.headerName, p.headerValue = headers[0][0], headers[0][1]
+			}
+		}
+		res.priorities = append(res.priorities, p)
+	}
+
+	return res
+}
+
+// priority of first matched rule, 0 if none
+func (x *concurrencyLimiter) priority(req *http.Request) int {
+	for _, v := range x.priorities {
+		if v.path != "" && req.URL.Path != v.path && !strings.HasPrefix(req.URL.Path, v.path+"/") {
+			continue
+		}
+		if v.headerName != "" && req.Header.Get(v.headerName) != v.headerValue {
+			continue
+		}
+		return v.priority
+	}
+	return 0
+}
+
+// acquire slot, waits in queue until slot is released, deadline or context done
+func (x *concurrencyLimiter) acquire(ctx context.Context, priority int) error {
+
+	x.mutex.Lock()
+
+	if x.inFlight < x.max && len(x.queue) == 0 {
+		x.inFlight++
+		x.mutex.Unlock()
+		concurrencyInFlight.WithLabelValues(x.name).Inc()
+		return nil
+	}
+
+	if len(x.queue) >= x.maxQueue {
+		// evict newest of lowest priority if lower than request
+		i := -1
+		for j, v := range x.queue {
+			if v.priority < priority && (i < 0 || v.priority <= x.queue[i].priority) {
+				i = j
+			}
+		}
+		if i < 0 {
+			x.mutex.Unlock()
+			concurrencyShed.WithLabelValues(x.name, "queue_full").Inc()
+			return errQueueFull
+		}
+		evicted := x.queue[i]
+		x.removeWaiter(evicted)
+		evicted.shed = true
+		close(evicted.ready)
+	}
+
+	w := &queueWaiter{priority: priority, ready: make(chan struct{})}
+	x.queue = append(x.queue, w)
+	x.mutex.Unlock()
+	concurrencyQueueDepth.WithLabelValues(x.name).Inc()
+
+	timer := time.NewTimer(x.timeout)
+	defer timer.Stop()
+
+	var err error
+	select {
+	case <-w.ready:
+	case <-timer.C:
+		err = errQueueTimeout
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	if err != nil {
+		x.mutex.Lock()
+		removed := x.removeWaiter(w)
+		x.mutex.Unlock()
+		if !removed {
+			<-w.ready // granted or shed at same time
+			err = nil
+		}
+	}
+
+	if err == nil && w.shed {
+		err = errQueueFull
+	}
+
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, errQueueFull):
+		concurrencyShed.WithLabelValues(x.name, "queue_full").Inc()
+	case errors.Is(err, errQueueTimeout):
+		concurrencyShed.WithLabelValues(x.name, "timeout").Inc()
+	}
+	return err
+}
+
+// removeWaiter from queue, false if already granted or shed, under lock
+func (x *concurrencyLimiter) removeWaiter(w *queueWaiter) bool {
+	for i, v := range x.queue {
+		if v == w {
+			x.queue = append(x.queue[:i], x.queue[i+1:]...)
+			concurrencyQueueDepth.WithLabelValues(x.name).Dec()
+			return true
+		}
+	}
+	return false
+}
+
+// release slot, handed over to oldest waiter of highest priority
+func (x *concurrencyLimiter) release() {
+
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+
+	i := -1
+	for j, v := range x.queue {
+		if i < 0 || v.priority > x.queue[i].priority {
+			i = j
+		}
+	}
+	if i < 0 {
+		x.inFlight--
+		concurrencyInFlight.WithLabelValues(x.name).Dec()
+		return
+	}
+
+	w := x.queue[i]
+	x.removeWaiter(w)
+	close(w.ready)
+}
+
+// serve request in slot, 503 page if shed
+func (x *concurrencyLimiter) serve(c echo.Context, next echo.HandlerFunc) error {
+
+	req := c.Request()
+
+	if err := x.acquire(req.Context(), x.priority(req)); err != nil {
+		if req.Context().Err() != nil {
+			return err // client gone
+		}
+		data, _ := webfs.Status(http.StatusServiceUnavailable)
+		return c.HTMLBlob(http.StatusServiceUnavailable, data)
+	}
+	defer x.release()
+
+	return next(c)
+}
+
+// newConcurrency global in-flight requests limit
+func newConcurrency(limiter *concurrencyLimiter) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			return limiter.serve(c, next)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"go-proxy/internal/config"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// enqueue acquire in background, returns result after waiter is queued
+func enqueue(t *testing.T, limiter *concurrencyLimiter, priority int) chan error {
+	queued := func() int {
+		limiter.mutex.Lock()
+		defer limiter.mutex.Unlock()
+		n := 0
+		for _, v := range limiter.queue {
+			if v.priority == priority {
+				n++
+			}
+		}
+		return n
+	}
+	n := queued()
+
+	res := make(chan error, 1)
+	go func() { res <- limiter.acquire(context.Background(), priority) }()
+
+	for range 100 {
+		if queued() != n {
+			return res
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("request not queued")
+	return nil
+}
+
+func Test_concurrencyLimiter(t *testing.T) {
+
+	limiter := newConcurrencyLimiter("test", config.AppConfigConcurrency{MaxInFlight: 1, MaxQueue: 2})
+
+	if err := limiter.acquire(context.Background(), 0); err != nil {
+		t.Fatalf("acquire() error: %v", err)
+	}
+
+	low := enqueue(t, limiter, -1)
+	normal := enqueue(t, limiter, 0)
+
+	if err := limiter.acquire(context.Background(), -1); !errors.Is(err, errQueueFull) {
+		t.Errorf("acquire() of low priority on full queue = %v, want %v", err, errQueueFull)
+	}
+
+	high := enqueue(t, limiter, 1) // evicts low
+	if err := <-low; !errors.Is(err, errQueueFull) {
+		t.Errorf("evicted acquire() = %v, want %v", err, errQueueFull)
+	}
+	if got := testutil.ToFloat64(concurrencyQueueDepth.WithLabelValues("test")); got != 2 {
+		t.Errorf("queue depth = %v, want 2", got)
+	}
+
+	limiter.release()
+	if err := <-high; err != nil {
+		t.Errorf("high acquire() = %v, want first slot", err)
+	}
+	select {
+	case err := <-normal:
+		t.Fatalf("normal acquire() = %v before release", err)
+	default:
+	}
+
+	limiter.release()
+	if err := <-normal; err != nil {
+		t.Errorf("normal acquire() = %v", err)
+	}
+
+	limiter.release()
+	if limiter.inFlight != 0 || len(limiter.queue) != 0 {
+		t.Errorf("in flight = %v queue = %v, want empty", limiter.inFlight, len(limiter.queue))
+	}
+	if got := testutil.ToFloat64(concurrencyInFlight.WithLabelValues("test")); got != 0 {
+		t.Errorf("in flight gauge = %v, want 0", got)
+	}
+}
+
+func Test_concurrencyLimiter_timeout(t *testing.T) {
+
+	limiter := newConcurrencyLimiter("test_timeout", config.AppConfigConcurrency{MaxInFlight: 1, MaxQueue: 1})
+	limiter.timeout = 50 * time.Millisecond
+
+	shed := testutil.ToFloat64(concurrencyShed.WithLabelValues("test_timeout", "timeout"))
+
+	if err := limiter.acquire(context.Background(), 0); err != nil {
+		t.Fatalf("acquire() error: %v", err)
+	}
+	if err := limiter.acquire(context.Background(), 0); !errors.Is(err, errQueueTimeout) {
+		t.Errorf("acquire() = %v, want %v", err, errQueueTimeout)
+	}
+	if got := testutil.ToFloat64(concurrencyShed.WithLabelValues("test_timeout", "timeout")) - shed; got != 1 {
+		t.Errorf("shed timeout = %v, want 1", got)
+	}
+	if len(limiter.queue) != 0 {
+		t.Errorf("queue = %v, want empty after timeout", len(limiter.queue))
+	}
+}
+
+func Test_newConcurrency(t *testing.T) {
+
+	limiter := newConcurrencyLimiter("test_http", config.AppConfigConcurrency{
+		MaxInFlight: 1,
+		Priorities:  []config.AppConfigConcurrencyPriority{{Path: "/reports", Priority: -1}, {Header: "X-Priority: high", Priority: 1}},
+	})
+
+	started := make(chan struct{})
+	done := make(chan struct{})
+
+	e := echo.New()
+	e.Use(newConcurrency(limiter))
+	e.RouteNotFound("/*", func(c echo.Context) error {
+		if c.Request().URL.Path == "/slow" {
+			close(started)
+			<-done
+		}
+		return c.String(http.StatusOK, "ok")
+	})
+
+	go e.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/slow", nil))
+	<-started
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("status = %v, want %v", rec.Code, http.StatusServiceUnavailable)
+	}
+	close(done)
+
+	req := httptest.NewRequest(http.MethodGet, "/reports/daily", nil)
+	if got := limiter.priority(req); got != -1 {
+		t.Errorf("priority of route = %v, want -1", got)
+	}
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("X-Priority", "high")
+	if got := limiter.priority(req); got != 1 {
+		t.Errorf("priority of header = %v, want 1", got)
+	}
+}
@@ -0,0 +1,149 @@
+package middleware
+
+import (
+	"context"
+	"go-proxy/internal/config"
+	xlog "go-proxy/internal/util/utillog"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4/middleware"
+)
+
+// healthChecker probes upstream targets and marks them healthy or unhealthy in pool
+type healthChecker struct {
+	pool   *upstreamPool
+	cfg    config.AppConfigProxyHealthCheck
+	client *http.Client
+	done   chan struct{}
+}
+
+// healthState consecutive check results of one target
+type healthState struct {
+	healthy bool
+	rise    int
+	fall    int
+}
+
+// observe apply check result, return true if health state changed
+func (x *healthState) observe(ok bool, cfg config.AppConfigProxyHealthCheck) bool {
+
+	if ok {
+		x.rise++
+		x.fall = 0
+		if !x.healthy && x.rise >= cfg.Rise {
+			x.healthy = true
+			return true
+		}
+	} else {
+		x.fall++
+		x.rise = 0
+		if x.healthy && x.fall >= cfg.Fall {
+			x.healthy = false
+			return true
+		}
+	}
+
+	return false
+}
+
+func newHealthChecker(pool *upstreamPool, cfg config.AppConfigProxyHealthCheck) *healthChecker {
+
+	if cfg.Interval <= 0 {
+		cfg.Interval = 10
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 2
+	}
+	if cfg.Rise <= 0 {
+		cfg.Rise = 1
+	}
+	if cfg.Fall <= 0 {
+		cfg.Fall = 1
+	}
+
+	return &healthChecker{
+		pool: pool,
+		cfg:  cfg,
+		done: make(chan struct{}),
+		client: &http.Client{
+			Timeout: time.Duration(cfg.Timeout) * time.Second,
+			// health of target itself, not of redirect location
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}
+}
+
+// start run probe loop for each target of pool
+func (x *healthChecker) start() {
+
+	xlog.Info("upstream %v health check: %+v", x.pool.name, x.cfg)
+
+	for _, v := range x.pool.list() {
+		go x.run(v)
+	}
+}
+
+func (x *healthChecker) run(target *middleware.ProxyTarget) {
+
+	ticker := time.NewTicker(time.Duration(x.cfg.Interval) * time.Second)
+	defer ticker.Stop()
+
+	state := &healthState{healthy: true}
+
+	probe := func() {
+		if state.observe(x.check(target), x.cfg) {
+			x.pool.setHealthy(target.Name, state.healthy)
+		}
+	}
+
+	probe() // first probe on start, not after interval
+
+	for {
+		select {
+		case <-x.done:
+			return
+		case <-ticker.C:
+			probe()
+		}
+	}
+}
+
+// stop probe loops, on config reload
+func (x *healthChecker) stop() {
+	close(x.done)
+}
+
+// check single probe of target
+func (x *healthChecker) check(target *middleware.ProxyTarget) bool {
+
+	checkURL := strings.TrimSuffix(target.URL.String(), "/") + x.cfg.Path
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(x.cfg.Timeout)*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, checkURL, nil)
+	if err != nil {
+		xlog.Error("health check %v error: %v", checkURL, err)
+		return false
+	}
+
+	resp, err := x.client.Do(req)
+	if err != nil {
+		xlog.Debug("health check %v error: %v", checkURL, err)
+		return false
+	}
+	defer resp.Body.Close()
+
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024)) // keep-alive
+
+	if x.cfg.Status > 0 {
+		return resp.StatusCode == x.cfg.Status
+	}
+
+	return resp.StatusCode >= 200 && resp.StatusCode < 400
+}
@@ -0,0 +1,106 @@
+package middleware
+
+import (
+	"go-proxy/internal/config"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func Test_healthState_observe(t *testing.T) {
+
+	cfg := config.AppConfigProxyHealthCheck{Rise: 2, Fall: 3}
+
+	tests := []struct {
+		name    string
+		checks  []bool
+		healthy bool
+	}{
+		{name: "Test-1", checks: []bool{false, false}, healthy: true},
+		{name: "Test-2", checks: []bool{false, false, false}, healthy: false},
+		{name: "Test-3", checks: []bool{false, false, false, true}, healthy: false},
+		{name: "Test-4", checks: []bool{false, false, false, true, true}, healthy: true},
+		{name: "Test-5", checks: []bool{false, true, false, false}, healthy: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			state := &healthState{healthy: true}
+			for _, v := range tt.checks {
+				state.observe(v, cfg)
+			}
+			if state.healthy != tt.healthy {
+				t.Errorf("healthy = %v, want %v", state.healthy, tt.healthy)
+			}
+		})
+	}
+}
+
+func Test_healthChecker_check(t *testing.T) {
+
+	status := atomic.Int32{}
+	status.Store(http.StatusOK)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/health" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(int(status.Load()))
+	}))
+	defer srv.Close()
+
+	pool, _ := newUpstreamPool(&proxyUpstream{prefix: "/", server: []proxyServer{{url: srv.URL}}})
+	target := pool.list()[0]
+
+	checker := newHealthChecker(pool, config.AppConfigProxyHealthCheck{Path: "/health", Fall: 1, Rise: 1})
+
+	if !checker.check(target) {
+		t.Errorf("expected healthy target")
+	}
+
+	status.Store(http.StatusServiceUnavailable)
+
+	if checker.check(target) {
+		t.Errorf("expected unhealthy target")
+	}
+
+	pool.setHealthy(target.Name, false)
+
+	if _, err := pool.NextTarget(nil); err != ErrNoUpstream {
+		t.Errorf("expected error %v, got %v", ErrNoUpstream, err)
+	}
+
+	pool.setHealthy(target.Name, true)
+
+	if next, err := pool.NextTarget(nil); err != nil || next != target {
+		t.Errorf("expected target %v, got %v error %v", target.Name, next, err)
+	}
+}
+
+func Test_healthChecker_start(t *testing.T) {
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	pool, _ := newUpstreamPool(&proxyUpstream{prefix: "/", server: []proxyServer{{url: srv.URL}}})
+
+	checker := newHealthChecker(pool, config.AppConfigProxyHealthCheck{Path: "/health", Interval: 3600, Fall: 1})
+	checker.start()
+	defer checker.stop()
+
+	// unhealthy before first interval
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if _, err := pool.NextTarget(nil); err == ErrNoUpstream {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected unhealthy target after first probe")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
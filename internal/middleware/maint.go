@@ -0,0 +1,265 @@
+package middleware
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"go-proxy/internal/config"
+	xlog "go-proxy/internal/util/utillog"
+	webfs "go-proxy/web"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// MaintMode maintenance switch, from config or sys api
+type MaintMode struct {
+	Enabled    bool     `json:"enabled"`
+	Routes     []string `json:"routes"`      // path prefixes "/api/*", empty is all
+	RetryAfter int      `json:"retry_after"` // seconds, until window end if scheduled
+	Start      string   `json:"start"`       // RFC3339 scheduled window
+	End        string   `json:"end"`         // RFC3339, empty is open window
+}
+
+// MaintStatus current maintenance mode for sys api
+type MaintStatus struct {
+	MaintMode
+	Active   bool `json:"active"`   // requests of routes get maintenance page now
+	Override bool `json:"override"` // set by sys api, kept on config reload
+}
+
+// maintMode parsed MaintMode
+type maintMode struct {
+	mode       MaintMode
+	routes     []string // static prefixes
+	retryAfter time.Duration
+	start      time.Time
+	end        time.Time
+}
+
+// maintOverride set by sys api, nil is mode from config
+var maintOverride atomic.Pointer[maintMode]
+
+func newMaintMode(mode MaintMode) (*maintMode, error) {
+
+	res := &maintMode{
+		mode:       mode,
+		retryAfter: time.Duration(mode.RetryAfter) * time.Second,
+	}
+
+	if res.retryAfter <= 0 {
+		res.retryAfter = 10 * time.Second
+	}
+
+	for _, v := range mode.Routes {
+		res.routes = append(res.routes, staticPrefix(v))
+	}
+
+	var err error
+	if mode.Start != "" {
+		if res.start, err = time.Parse(time.RFC3339, mode.Start); err != nil {
+			return nil, fmt.Errorf("maintenance start: %w", err)
+		}
+	}
+	if mode.End != "" {
+		if res.end, err = time.Parse(time.RFC3339, mode.End); err != nil {
+			return nil, fmt.Errorf("maintenance end: %w", err)
+		}
+		if !res.start.IsZero() && !res.end.After(res.start) {
+			return nil, fmt.Errorf("maintenance end %v before start %v", mode.End, mode.Start)
+		}
+	}
+
+	return res, nil
+}
+
+// scheduled window is set
+func (x *maintMode) scheduled() bool {
+	return !x.start.IsZero() || !x.end.IsZero()
+}
+
+// active if enabled or now in scheduled window
+func (x *maintMode) active(now time.Time) bool {
+	if x.mode.Enabled {
+		return true
+	}
+	if !x.scheduled() {
+		return false
+	}
+	return (x.start.IsZero() || !now.Before(x.start)) && (x.end.IsZero() || now.Before(x.end))
+}
+
+// matchRoute path in maintenance routes
+func (x *maintMode) matchRoute(path string) bool {
+	if len(x.routes) == 0 {
+		return true
+	}
+	for _, v := range x.routes {
+		if v == "" || path == v || strings.HasPrefix(path, v+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// retryAfterSeconds until window end, or configured value
+func (x *maintMode) retryAfterSeconds(now time.Time) int {
+	if !x.end.IsZero() && !x.mode.Enabled {
+		if d := x.end.Sub(now); d > 0 {
+			return int((d + time.Second - 1) / time.Second)
+		}
+	}
+	return int(x.retryAfter / time.Second)
+}
+
+// SetMaint switch maintenance mode at runtime, kept on config reload until reset
+func SetMaint(mode MaintMode) error {
+
+	res, err := newMaintMode(mode)
+	if err != nil {
+		return err
+	}
+
+	maintOverride.Store(res)
+
+	xlog.Warn("maintenance mode set: %+v", mode)
+
+	return nil
+}
+
+// ResetMaint back to maintenance mode from config
+func ResetMaint() {
+	maintOverride.Store(nil)
+
+	xlog.Warn("maintenance mode reset to config")
+}
+
+// GetMaint current maintenance mode
+func GetMaint() MaintStatus {
+
+	mode := maintOverride.Load()
+	override := mode != nil
+
+	if mode == nil {
+		if rt := activeRuntime.Load(); rt != nil {
+			mode = rt.maint
+		}
+	}
+
+	if mode == nil {
+		return MaintStatus{}
+	}
+
+	return MaintStatus{
+		MaintMode: mode.mode,
+		Active:    mode.active(time.Now()),
+		Override:  override,
+	}
+}
+
+// maintBypass requests reaching backend in maintenance
+type maintBypass struct {
+	allow       []netip.Prefix
+	headerName  string
+	headerValue string
+}
+
+func newMaintBypass(cfg config.AppConfigMaint) (*maintBypass, error) {
+
+	res := &maintBypass{}
+
+	for _, v := range cfg.Allow {
+		prefix, err := parsePrefix(v)
+		if err != nil {
+			return nil, fmt.Errorf("maintenance allow: %w", err)
+		}
+		res.allow = append(res.allow, prefix)
+	}
+
+	if cfg.BypassHeader != "" {
+		headers := parseHeaders([]string{cfg.BypassHeader})
+		if len(headers) == 0 || headers[0][1] == "" {
+			return nil, fmt.Errorf("maintenance bypass header not match \"Name: value\"")
+		}
+		res.headerName, res.headerValue = headers[0][0], headers[0][1]
+	}
+
+	return res, nil
+}
+
+// parsePrefix ip "10.0.0.1" or cidr "10.0.0.0/8"
+func parsePrefix(value string) (netip.Prefix, error) {
+	if strings.Contains(value, "/") {
+		prefix, err := netip.ParsePrefix(value)
+		return prefix.Masked(), err
+	}
+	addr, err := netip.ParseAddr(value)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// containsIP ip in any prefix, false if ip not valid
+func containsIP(prefixes []netip.Prefix, ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, v := range prefixes {
+		if v.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func (x *maintBypass) match(c echo.Context) bool {
+
+	if len(x.allow) > 0 && containsIP(x.allow, c.RealIP()) {
+		return true
+	}
+
+	if x.headerName != "" {
+		value := c.Request().Header.Get(x.headerName)
+		if value != "" && subtle.ConstantTimeCompare([]byte(value), []byte(x.headerValue)) == 1 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// newMaintenance maintenance page of mode from sys api or config
+func newMaintenance(mode *maintMode, bypass *maintBypass) echo.MiddlewareFunc {
+
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+
+		return func(c echo.Context) error {
+
+			current := maintOverride.Load()
+			if current == nil {
+				current = mode
+			}
+
+			now := time.Now()
+
+			if !current.active(now) || !current.matchRoute(c.Request().URL.Path) || bypass.match(c) {
+				return next(c)
+			}
+
+			data, err := webfs.Page("maint.html")
+			if err != nil {
+				return err
+			}
+			c.Response().Header().Set("Retry-After", strconv.Itoa(current.retryAfterSeconds(now))) // seconds
+
+			return c.HTMLBlob(http.StatusServiceUnavailable, data)
+		}
+	}
+}
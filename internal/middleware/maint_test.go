@@ -0,0 +1,118 @@
+package middleware
+
+import (
+	"go-proxy/internal/config"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+func Test_maintMode_active(t *testing.T) {
+
+	now := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name string
+		mode MaintMode
+		want bool
+	}{
+		{name: "disabled", mode: MaintMode{}, want: false},
+		{name: "enabled", mode: MaintMode{Enabled: true}, want: true},
+		{name: "in window", mode: MaintMode{Start: "2025-01-01T11:00:00Z", End: "2025-01-01T13:00:00Z"}, want: true},
+		{name: "before window", mode: MaintMode{Start: "2025-01-01T13:00:00Z", End: "2025-01-01T14:00:00Z"}, want: false},
+		{name: "after window", mode: MaintMode{Start: "2025-01-01T10:00:00Z", End: "2025-01-01T11:00:00Z"}, want: false},
+		{name: "open window", mode: MaintMode{Start: "2025-01-01T11:00:00Z"}, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mode, err := newMaintMode(tt.mode)
+			if err != nil {
+				t.Fatalf("newMaintMode() error: %v", err)
+			}
+			if got := mode.active(now); got != tt.want {
+				t.Errorf("active() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := newMaintMode(MaintMode{Start: "2025-01-01T11:00:00Z", End: "2025-01-01T10:00:00Z"}); err == nil {
+		t.Errorf("expected window error")
+	}
+	if _, err := newMaintMode(MaintMode{Start: "tomorrow"}); err == nil {
+		t.Errorf("expected time error")
+	}
+}
+
+func Test_newMaintenance(t *testing.T) {
+
+	defer ResetMaint()
+
+	mode, _ := newMaintMode(MaintMode{Routes: []string{"/api/*"}, RetryAfter: 30})
+	bypass, err := newMaintBypass(config.AppConfigMaint{
+		Allow:        []string{"10.0.0.0/8", "192.168.1.1"},
+		BypassHeader: "X-Maint-Bypass: secret",
+	})
+	if err != nil {
+		t.Fatalf("newMaintBypass() error: %v", err)
+	}
+
+	e := echo.New()
+	e.Pre(newMaintenance(mode, bypass))
+	e.RouteNotFound("/*", func(c echo.Context) error { return c.String(http.StatusOK, "ok") })
+
+	do := func(path string, ip string, header string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.RemoteAddr = ip + ":1234"
+		if header != "" {
+			req.Header.Set("X-Maint-Bypass", header)
+		}
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := do("/api/users", "1.1.1.1", ""); rec.Code != http.StatusOK {
+		t.Fatalf("status = %v, want %v before switch", rec.Code, http.StatusOK)
+	}
+
+	if err := SetMaint(MaintMode{Enabled: true, Routes: []string{"/api/*"}, RetryAfter: 30}); err != nil {
+		t.Fatalf("SetMaint() error: %v", err)
+	}
+
+	rec := do("/api/users", "1.1.1.1", "")
+	if rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Retry-After") != "30" {
+		t.Errorf("status = %v retry after = %v, want maintenance", rec.Code, rec.Header().Get("Retry-After"))
+	}
+
+	tests := []struct {
+		name   string
+		path   string
+		ip     string
+		header string
+	}{
+		{name: "other route", path: "/web", ip: "1.1.1.1"},
+		{name: "route prefix not path prefix", path: "/apiv2", ip: "1.1.1.1"},
+		{name: "allowed cidr", path: "/api/users", ip: "10.1.2.3"},
+		{name: "allowed ip", path: "/api/users", ip: "192.168.1.1"},
+		{name: "bypass header", path: "/api/users", ip: "1.1.1.1", header: "secret"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if rec := do(tt.path, tt.ip, tt.header); rec.Code != http.StatusOK {
+				t.Errorf("status = %v, want %v", rec.Code, http.StatusOK)
+			}
+		})
+	}
+
+	if rec := do("/api/users", "1.1.1.1", "wrong"); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("status = %v, want %v with wrong bypass header", rec.Code, http.StatusServiceUnavailable)
+	}
+
+	ResetMaint()
+	if rec := do("/api/users", "1.1.1.1", ""); rec.Code != http.StatusOK {
+		t.Errorf("status = %v, want %v after reset", rec.Code, http.StatusOK)
+	}
+}
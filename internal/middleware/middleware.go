@@ -1,20 +1,23 @@
 package middleware
 
 import (
+	"cmp"
+	"context"
 	"fmt"
+	"go-proxy/internal/config"
 	"go-proxy/internal/config/consts"
 	"go-proxy/internal/service"
 	"go-proxy/internal/util/utilhttp"
 	xlog "go-proxy/internal/util/utillog"
 	webfs "go-proxy/web"
 	"net/http"
-	"net/url"
-	"strconv"
+	"slices"
 	"strings"
 	"time"
 
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
+	"github.com/redis/go-redis/v9"
 	"golang.org/x/time/rate"
 )
 
@@ -23,14 +26,34 @@ var (
 	ErrRateLimitExceeded = echo.NewHTTPError(http.StatusTooManyRequests, "rate limit exceeded")
 	// ErrExtractorError denotes an error raised when extractor function is unsuccessful
 	ErrExtractorError = echo.NewHTTPError(http.StatusForbidden, "error while extracting identifier")
+	// ErrNoUpstream denotes an error raised when upstream has no available target
+	ErrNoUpstream = echo.NewHTTPError(http.StatusServiceUnavailable, "no healthy upstream")
 )
 
-func Init(e *echo.Echo, appService service.AppService) {
+// Init middlewares and proxy routes, returns runtime to activate and close on config reload
+func Init(e *echo.Echo, appService service.AppService) *Runtime {
 
 	appConfig := appService.Config()
 
+	rt := newRuntime()
+	defer func() {
+		if r := recover(); r != nil {
+			rt.Close() // partially built
+			panic(r)
+		}
+	}()
+
 	e.HTTPErrorHandler = newHTTPErrorHandler(appService)
 
+	ipExtractor, err := newIPExtractor(appConfig.HTTPServer.ClientIP)
+	if err != nil {
+		xlog.Panic("error on client ip config: %v", err)
+	}
+	e.IPExtractor = ipExtractor
+	if ipExtractor == nil {
+		xlog.Warn("client_ip mode not set, X-Forwarded-For and X-Real-IP of any peer are trusted, deprecated: set client_ip.mode")
+	}
+
 	e.Use(middleware.Recover()) // !!!
 
 	initGeoIP(e, appService) // .Pre
@@ -53,29 +76,38 @@ func Init(e *echo.Echo, appService service.AppService) {
 		e.Use(middleware.LoggerWithConfig(cfg))
 	}
 
-	initMaintenance(e, appService)
+	initMaintenance(e, appService, rt)
 	initRedirect(e, appService)
+	initClientAuth(e, appService)
 	initContentSecurity(e, appService)
-	initRateLimit(e, appService)
+	initRateLimit(e, appService, rt)
+	initConcurrency(e, appService)
 	initRequestID(e, appService)
 
-	initProxy(e, appService)
+	initProxy(e, appService, rt)
 
 	{
 		// prevent log
 		e.GET("/favicon.ico", func(c echo.Context) error { return c.NoContent(http.StatusNotFound) })
 	}
+
+	return rt
 }
 
 func newHTTPErrorHandler(appService service.AppService) echo.HTTPErrorHandler {
 
 	appConfig := appService.Config()
-	overrideStatus := appConfig.Proxy.OverrideStatus
+	vhosts := newVirtualHosts(appConfig.VirtualHosts)
 
 	return func(err error, c echo.Context) {
 
 		var status int
 
+		overrideStatus := appConfig.Proxy.OverrideStatus
+		if vh := vhosts.find(c.Request()); vh != nil && vh.OverrideStatus != nil {
+			overrideStatus = vh.OverrideStatus
+		}
+
 		if len(overrideStatus) > 0 {
 
 			resp := c.Response()
@@ -147,33 +179,35 @@ func newHTTPErrorHandler(appService service.AppService) echo.HTTPErrorHandler {
 
 }
 
-func initMaintenance(e *echo.Echo, appService service.AppService) {
+func initMaintenance(e *echo.Echo, appService service.AppService, rt *Runtime) {
 
 	appConfig := appService.Config()
-	// appConfig.IsMaint = true
-	if appConfig.IsMaint {
-
-		e.Pre(func(next echo.HandlerFunc) echo.HandlerFunc {
-
-			return func(c echo.Context) error {
-
-				// err := next(c)
-
-				// return err
-
-				data, err := webfs.Page("maint.html")
-				if err != nil {
-					return err
-				}
-				c.Response().Header().Set("Retry-After", strconv.Itoa(10)) // seconds
+	cfg := appConfig.Maint
+
+	mode, err := newMaintMode(MaintMode{
+		Enabled:    appConfig.IsMaint,
+		Routes:     cfg.Routes,
+		RetryAfter: cfg.RetryAfter,
+		Start:      cfg.Start,
+		End:        cfg.End,
+	})
+	if err != nil {
+		xlog.Panic("error on maintenance config: %v", err)
+	}
 
-				return c.HTMLBlob(http.StatusServiceUnavailable, data)
-			}
+	bypass, err := newMaintBypass(cfg)
+	if err != nil {
+		xlog.Panic("error on maintenance config: %v", err)
+	}
 
-		})
+	rt.maint = mode
 
+	if appConfig.IsMaint || mode.scheduled() {
+		xlog.Warn("maintenance mode: %+v", mode.mode)
 	}
 
+	// always installed, may be switched by sys api
+	e.Pre(newMaintenance(mode, bypass))
 }
 
 func initRedirect(e *echo.Echo, appService service.AppService) {
@@ -194,14 +228,28 @@ func initRedirect(e *echo.Echo, appService service.AppService) {
 		return (len(strings.SplitN(c.Request().Host, ".", 3)) > 2)
 	}
 
+	vhosts := newVirtualHosts(appConfig.VirtualHosts)
+
+	if slices.ContainsFunc(appConfig.VirtualHosts, func(v config.AppConfigVirtualHost) bool { return v.RedirectTo != "" }) {
+		e.Pre(newVirtualHostRedirect(vhosts))
+	}
+
+	redirectHTTPS := func(vh *config.AppConfigVirtualHost) *bool { return vh.RedirectHTTPS }
+	redirectWWW := func(vh *config.AppConfigVirtualHost) *bool { return vh.RedirectWWW }
+
 	// e.Pre(middleware.HTTPSWWWRedirectWithConfig(middleware.RedirectConfig{Skipper: hasSubDomain}))
 	//
-	if appConfig.HTTPServer.RedirectHTTPS {
-		e.Pre(middleware.HTTPSRedirectWithConfig(middleware.RedirectConfig{})) // may be 307
+	if vhosts.anyRedirect(appConfig.HTTPServer.RedirectHTTPS, redirectHTTPS) {
+		e.Pre(middleware.HTTPSRedirectWithConfig(middleware.RedirectConfig{
+			Skipper: vhosts.redirectSkipper(appConfig.HTTPServer.RedirectHTTPS, redirectHTTPS),
+		})) // may be 307
 	}
 
-	if appConfig.HTTPServer.RedirectWWW {
-		e.Pre(middleware.WWWRedirectWithConfig(middleware.RedirectConfig{Skipper: hasSubDomain}))
+	if vhosts.anyRedirect(appConfig.HTTPServer.RedirectWWW, redirectWWW) {
+		skipWWW := vhosts.redirectSkipper(appConfig.HTTPServer.RedirectWWW, redirectWWW)
+		e.Pre(middleware.WWWRedirectWithConfig(middleware.RedirectConfig{
+			Skipper: func(c echo.Context) bool { return hasSubDomain(c) || skipWWW(c) },
+		}))
 	}
 	//
 	// e.Pre(middleware.HTTPSNonWWWRedirect())
@@ -433,7 +481,7 @@ func csrfAddCookieAndValidateMiddleware(_ service.AppService) echo.MiddlewareFun
 
 }
 
-func initRateLimit(e *echo.Echo, appService service.AppService) {
+func initRateLimit(e *echo.Echo, appService service.AppService, rt *Runtime) {
 	// TODO for public use (rate limit, cache, headers time out)
 
 	appConfig := appService.Config()
@@ -441,40 +489,73 @@ func initRateLimit(e *echo.Echo, appService service.AppService) {
 	rateLimit := appConfig.HTTPServer.RateLimit
 	rateBurst := appConfig.HTTPServer.RateBurst
 
+	rules := []config.AppConfigRateRule{}
 	if rateLimit > 0.000001 { //
-		rateStoreConfig := middleware.RateLimiterMemoryStoreConfig{
-			Rate:      rate.Limit(rateLimit), //   rate.Limit(10),
-			Burst:     rateBurst,
-			ExpiresIn: 60 * time.Second,
-		}
+		rules = append(rules, config.AppConfigRateRule{Rate: rateLimit, Burst: rateBurst}) // per ip, key without rule name
+	}
+	for i, v := range appConfig.HTTPServer.RateRules {
+		v.Name = cmp.Or(v.Name, fmt.Sprintf("rule%v", i))
+		rules = append(rules, v)
+	}
 
-		xlog.Info("starting rate control, store config: %v", rateStoreConfig)
+	if len(rules) == 0 {
+		xlog.Warn("rate limit not active")
+		return
+	}
 
-		rateLimiterConfig := middleware.RateLimiterConfig{
+	var client *redis.Client
+	if appConfig.HTTPServer.RateStore == config.RateStoreRedis {
+		client = newRedisClient(appConfig.Redis)
+		rt.onClose(func() { _ = client.Close() })
 
-			Skipper: middleware.DefaultSkipper,
+		xlog.Info("rate control store: redis %v", client.Options().Addr)
 
-			Store: middleware.NewRateLimiterMemoryStoreWithConfig(
-				rateStoreConfig,
-			),
+		// requests are counted by memory store until redis is reachable, e.g. auth of stock redis fails with default user
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		if err := client.Ping(ctx).Err(); err != nil {
+			xlog.Warn("rate control store: redis %v not available, memory store used until redis is up: %v", client.Options().Addr, err)
+		}
+		cancel()
+	}
 
-			IdentifierExtractor: func(ctx echo.Context) (string, error) {
-				id := ctx.RealIP()
-				return id, nil
-			},
+	rateRules := []*rateRule{}
+	for _, v := range rules {
+		storeConfig := RateLimiterStoreConfig{
+			Rate:  rate.Limit(v.Rate),
+			Burst: v.Burst,
+		}
+		if v.Action == config.RateActionDelay {
+			storeConfig.Delay = time.Duration(cmp.Or(v.MaxDelay, 1)) * time.Second
+		}
 
-			ErrorHandler: func(context echo.Context, err error) error {
-				return context.JSON(http.StatusForbidden, nil)
-			},
+		xlog.Info("starting rate control, rule: %v store config: %v", cmp.Or(v.Name, "ip"), storeConfig)
 
-			DenyHandler: func(context echo.Context, identifier string, err error) error {
-				return context.JSON(http.StatusTooManyRequests, nil)
-			},
+		var store rateStore = NewRateLimiterMemoryStore(storeConfig)
+		if client != nil {
+			prefix := "rate:"
+			if v.Name != "" {
+				prefix += v.Name + ":"
+			}
+			store = NewRateLimiterRedisStore(client, RateLimiterRedisStoreConfig{
+				RateLimiterStoreConfig: storeConfig,
+				Prefix:                 prefix,
+				Fallback:               store.(*RateLimiterMemoryStore),
+			})
 		}
 
-		e.Use(middleware.RateLimiterWithConfig(rateLimiterConfig))
-	} else {
-		xlog.Warn("rate limit not active")
+		rateRules = append(rateRules, newRateRule(v, store))
+	}
+
+	e.Use(newRateLimit(rateRules))
+}
+
+func initConcurrency(e *echo.Echo, appService service.AppService) {
+
+	appConfig := appService.Config()
+
+	if limiter := newConcurrencyLimiter("global", appConfig.HTTPServer.Concurrency); limiter != nil {
+		xlog.Info("starting concurrency control: %+v", appConfig.HTTPServer.Concurrency)
+		e.Use(newConcurrency(limiter))
 	}
 }
 
@@ -498,119 +579,3 @@ func initRequestID(e *echo.Echo, appService service.AppService) {
 	}
 
 }
-func initProxy(e *echo.Echo, appService service.AppService) {
-
-	appConfig := appService.Config()
-	{
-
-		for _, upstream := range appConfig.Proxy.Upstreams {
-
-			// httputil.NewSingleHostReverseProxy(serverURL)
-
-			trg, err := newProxyUpstream(upstream)
-			if err != nil {
-				xlog.Panic("error on try add proxy upstream: %v", err)
-			}
-
-			{
-
-				balancer := middleware.NewRoundRobinBalancer([]*middleware.ProxyTarget{})
-
-				for _, v := range trg.server {
-					xlog.Info("adding proxy upstream: %v => %v", trg.prefix, v)
-					serverURL, err := url.Parse(v) // downstream
-					if err != nil {
-						panic(fmt.Errorf("error on parse proxy upstream %v: %v", upstream, err))
-					}
-					// .NewRandomBalancer()
-					balancer.AddTarget(&middleware.ProxyTarget{
-						URL:  serverURL,
-						Name: v, // !!! server ID
-					})
-				}
-
-				proxyConfig := middleware.DefaultProxyConfig
-				proxyConfig.Balancer = balancer
-				// proxyConfig.RetryCount = 0 // 0, meaning requests are never retried
-				proxyConfig.RetryCount = len(trg.server) - 1
-				proxyConfig.Rewrite = trg.rewrite
-				proxyConfig.ErrorHandler = func(c echo.Context, err error) error {
-					return err
-				}
-				proxyConfig.ModifyResponse = func(r *http.Response) error {
-					return nil
-				}
-				funcMw := middleware.ProxyWithConfig(proxyConfig)
-				e.RouteNotFound(trg.prefix, nil, funcMw)
-			}
-		}
-
-	}
-
-}
-
-type proxyUpstream struct {
-	server  []string
-	prefix  string
-	rewrite map[string]string
-}
-
-func newProxyUpstream(upstream string) (*proxyUpstream, error) {
-
-	upstream = strings.TrimSpace(upstream)
-	// parts := strings.SplitN(upstream, " ", 2)
-	// upstream = strings.TrimSpace(parts[0])
-	// http://127.0.0.1:10082/test2?server=127.0.0.1:10083
-
-	parsedURL, err := url.Parse(upstream)
-
-	if err != nil {
-		return nil, fmt.Errorf("error on parse proxy upstream %v: %v", upstream, err)
-		// panic()
-	}
-
-	r := &proxyUpstream{}
-	r.server = append(r.server,
-		fmt.Sprintf("%s://%s", parsedURL.Scheme, parsedURL.Host /*has port*/),
-	)
-	args := parsedURL.Query()
-
-	{
-		// extra servers
-		serverExt := args["server"]
-		for _, v := range serverExt {
-			r.server = append(r.server,
-				fmt.Sprintf("%s://%s", parsedURL.Scheme, v /*has port*/),
-			)
-		}
-	}
-
-	{
-		rewrite := args["rewrite"]
-
-		if len(rewrite) > 0 {
-			xlog.Info("rewrite path conds: %+v", rewrite)
-		}
-
-		for _, v := range rewrite {
-			parts := strings.SplitN(v, ":", 2)
-			if len(parts) != 2 {
-				xlog.Error("[ERROR] cannot parse token for rewrite: %s", v)
-				continue // may be panic
-			}
-
-			if len(r.rewrite) == 0 {
-				r.rewrite = map[string]string{}
-			}
-			r.rewrite[parts[0]] = parts[1]
-		}
-
-		if len(rewrite) > 0 {
-			xlog.Info("rewrite path map:%+v", r.rewrite)
-		}
-	}
-
-	r.prefix = parsedURL.Path
-
-	return r, nil
-}
@@ -0,0 +1,250 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"go-proxy/internal/config"
+	xlog "go-proxy/internal/util/utillog"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+)
+
+// outlierState passive health of target, updated by real traffic
+type outlierState struct {
+	failures     int       // consecutive failures
+	ejections    int       // ejections in a row, grows backoff
+	ejected      bool      //
+	ejectedUntil time.Time //
+	halfOpen     bool      // ejection expired, waiting for trial request
+	trial        bool      // trial request in flight
+	trialID      uint64    // sequence of trial requests, release only by its request
+}
+
+func normalizeOutlier(cfg config.AppConfigProxyOutlier) config.AppConfigProxyOutlier {
+
+	if cfg.BaseEjection <= 0 {
+		cfg.BaseEjection = 30
+	}
+	if cfg.MaxEjection < cfg.BaseEjection {
+		cfg.MaxEjection = cfg.BaseEjection
+	}
+	if cfg.MaxEjectionPercent <= 0 {
+		cfg.MaxEjectionPercent = 50
+	}
+	cfg.MaxEjectionPercent = min(cfg.MaxEjectionPercent, 100)
+
+	return cfg
+}
+
+// ejectionTime base ejection doubled for each ejection in a row, limited by max
+func ejectionTime(cfg config.AppConfigProxyOutlier, ejections int) time.Duration {
+
+	base := time.Duration(cfg.BaseEjection) * time.Second
+	maxEjection := time.Duration(cfg.MaxEjection) * time.Second
+
+	res := base
+	for i := 1; i < ejections && res < maxEjection; i++ {
+		res *= 2
+	}
+
+	return min(res, maxEjection)
+}
+
+// report result of proxied request to target
+func (x *upstreamPool) report(name string, failed bool) {
+
+	if x.outlier.Consecutive <= 0 {
+		return
+	}
+
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+
+	t := x.find(name)
+	if t == nil {
+		return
+	}
+
+	s := &t.outlier
+
+	if !failed {
+		s.failures = 0
+		if s.halfOpen {
+			s.halfOpen = false
+			s.trial = false
+			s.ejections = 0
+			xlog.Info("upstream %v target recovered: %v", x.name, name)
+		}
+		return
+	}
+
+	s.failures++
+
+	if s.ejected {
+		return // in-flight request of ejected target
+	}
+
+	if s.halfOpen {
+		x.eject(t) // failed trial
+		return
+	}
+
+	if s.failures >= x.outlier.Consecutive {
+		if !x.canEject() {
+			xlog.Warn("upstream %v target not ejected: %v, max ejection percent %v reached", x.name, name, x.outlier.MaxEjectionPercent)
+			return
+		}
+		x.eject(t)
+	}
+}
+
+// canEject ejected targets below max percent, at least one, call under lock
+func (x *upstreamPool) canEject() bool {
+	ejected := 0
+	for _, v := range x.targets {
+		if v.outlier.ejected {
+			ejected++
+		}
+	}
+	return ejected < max(1, len(x.targets)*x.outlier.MaxEjectionPercent/100)
+}
+
+// eject remove target from balancer for backoff time, call under lock
+func (x *upstreamPool) eject(t *poolTarget) {
+
+	s := &t.outlier
+
+	s.ejections++
+	s.ejected = true
+	s.halfOpen = false
+	s.trial = false
+
+	d := ejectionTime(x.outlier, s.ejections)
+	s.ejectedUntil = time.Now().Add(d)
+
+	x.sync(t)
+
+	xlog.Warn("upstream %v target ejected: %v for: %v failures: %v", x.name, t.target.Name, d, s.failures)
+
+	name := t.target.Name
+	time.AfterFunc(d, func() {
+		x.release(name)
+	})
+}
+
+// release ejected target to half-open state, next request is a trial
+func (x *upstreamPool) release(name string) {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+
+	t := x.find(name)
+	if t == nil || !t.outlier.ejected {
+		return
+	}
+
+	t.outlier.ejected = false
+	t.outlier.halfOpen = true
+	t.outlier.failures = 0
+	x.sync(t)
+
+	xlog.Info("upstream %v target half-open: %v", x.name, name)
+}
+
+// acquire check target can serve request, only one trial request for half-open target
+func (x *upstreamPool) acquire(name string) bool {
+
+	t := x.find(name)
+	if t == nil || !t.outlier.halfOpen {
+		return true
+	}
+
+	if t.outlier.trial {
+		return false
+	}
+
+	t.outlier.trial = true
+	t.outlier.trialID++
+
+	return true
+}
+
+// proxyTarget target of proxied request from context
+func proxyTarget(c echo.Context, contextKey string) *middleware.ProxyTarget {
+	t, _ := c.Get(contextKey).(*middleware.ProxyTarget)
+	return t
+}
+
+// isTargetError error of target (unreachable), not of client or balancer
+func isTargetError(err error) bool {
+
+	if errors.Is(err, ErrNoUpstream) {
+		return false
+	}
+
+	var errE *echo.HTTPError
+	if errors.As(err, &errE) {
+		return errE.Code == http.StatusBadGateway
+	}
+
+	return false
+}
+
+type proxyTargetKey struct{}
+
+// withProxyTarget request of target, upstream request and response of proxy keep target in context
+func withProxyTarget(req *http.Request, t *middleware.ProxyTarget) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), proxyTargetKey{}, t))
+}
+
+// requestTarget target of upstream request, nil if not set by pool
+func requestTarget(req *http.Request) *middleware.ProxyTarget {
+	t, _ := req.Context().Value(proxyTargetKey{}).(*middleware.ProxyTarget)
+	return t
+}
+
+// applyOutlier hooks proxy results to passive outlier detection of pool
+func (x *upstreamPool) applyOutlier(proxyConfig *middleware.ProxyConfig) {
+
+	if x.outlier.Consecutive <= 0 {
+		return
+	}
+
+	xlog.Info("upstream %v outlier detection: %+v", x.name, x.outlier)
+
+	contextKey := proxyConfig.ContextKey
+
+	reportError := func(c echo.Context, err error) {
+		if t := proxyTarget(c, contextKey); t != nil && isTargetError(err) {
+			x.report(t.Name, true)
+		}
+	}
+
+	retryFilter := proxyConfig.RetryFilter
+	if retryFilter == nil {
+		retryFilter = func(c echo.Context, err error) bool { return isTargetError(err) }
+	}
+	proxyConfig.RetryFilter = func(c echo.Context, err error) bool {
+		reportError(c, err)
+		return retryFilter(c, err)
+	}
+
+	// trial without result (client closed, no upstream) released by pool at end of request or on retry
+	errorHandler := proxyConfig.ErrorHandler
+	proxyConfig.ErrorHandler = func(c echo.Context, err error) error {
+		if !errors.Is(err, ErrNoUpstream) {
+			reportError(c, err)
+		}
+		return errorHandler(c, err)
+	}
+
+	modifyResponse := proxyConfig.ModifyResponse
+	proxyConfig.ModifyResponse = func(r *http.Response) error {
+		if t := requestTarget(r.Request); t != nil {
+			x.report(t.Name, r.StatusCode >= http.StatusInternalServerError)
+		}
+		return modifyResponse(r)
+	}
+}
@@ -0,0 +1,221 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"go-proxy/internal/config"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+)
+
+func Test_ejectionTime(t *testing.T) {
+
+	cfg := config.AppConfigProxyOutlier{BaseEjection: 10, MaxEjection: 60}
+
+	tests := []struct {
+		name      string
+		ejections int
+		want      time.Duration
+	}{
+		{name: "Test-1", ejections: 1, want: 10 * time.Second},
+		{name: "Test-2", ejections: 2, want: 20 * time.Second},
+		{name: "Test-3", ejections: 3, want: 40 * time.Second},
+		{name: "Test-4", ejections: 4, want: 60 * time.Second},
+		{name: "Test-5", ejections: 100, want: 60 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ejectionTime(cfg, tt.ejections); got != tt.want {
+				t.Errorf("ejectionTime() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_upstreamPool_report(t *testing.T) {
+
+	e := echo.New()
+	newContext := func() echo.Context {
+		return e.NewContext(httptest.NewRequest("GET", "/", nil), httptest.NewRecorder())
+	}
+
+	pool, _ := newUpstreamPool(&proxyUpstream{
+		prefix:  "/",
+		server:  []proxyServer{{url: "http://127.0.0.1:1"}, {url: "http://127.0.0.1:2"}},
+		outlier: config.AppConfigProxyOutlier{Consecutive: 2, BaseEjection: 3600},
+	})
+
+	name := "http://127.0.0.1:1"
+
+	pool.report(name, true)
+	pool.report(name, false) // reset
+	pool.report(name, true)
+
+	if pool.find(name).outlier.ejected {
+		t.Fatalf("expected not ejected target after non-consecutive failures")
+	}
+
+	pool.report(name, true)
+
+	if !pool.find(name).outlier.ejected {
+		t.Fatalf("expected ejected target")
+	}
+
+	for range 4 {
+		if next, _ := pool.NextTarget(newContext()); next == nil || next.Name == name {
+			t.Fatalf("expected other target, got %v", next)
+		}
+	}
+
+	pool.release(name)
+
+	// one trial request
+	trials := 0
+	for range 4 {
+		if next, _ := pool.NextTarget(newContext()); next != nil && next.Name == name {
+			trials++
+		}
+	}
+	if trials != 1 {
+		t.Fatalf("expected single trial request, got %v", trials)
+	}
+
+	pool.report(name, true) // trial failed
+
+	s := pool.find(name).outlier
+	if !s.ejected || s.ejections != 2 {
+		t.Fatalf("expected second ejection, got %+v", s)
+	}
+
+	pool.release(name)
+	pool.report(name, false) // trial succeeded
+
+	s = pool.find(name).outlier
+	if s.ejected || s.halfOpen || s.ejections != 0 {
+		t.Fatalf("expected recovered target, got %+v", s)
+	}
+}
+
+func Test_upstreamPool_applyOutlier(t *testing.T) {
+
+	e := echo.New()
+
+	pool, _ := newUpstreamPool(&proxyUpstream{
+		prefix:  "/",
+		server:  []proxyServer{{url: "http://127.0.0.1:1/a"}, {url: "http://127.0.0.1:1/b"}},
+		outlier: config.AppConfigProxyOutlier{Consecutive: 1, BaseEjection: 3600},
+	})
+
+	proxyConfig := middleware.ProxyConfig{
+		ContextKey:     "target",
+		ModifyResponse: func(*http.Response) error { return nil },
+		ErrorHandler:   func(c echo.Context, err error) error { return err },
+	}
+	pool.applyOutlier(&proxyConfig)
+
+	c := e.NewContext(httptest.NewRequest("GET", "/", nil), httptest.NewRecorder())
+	target, err := pool.NextTarget(c)
+	if err != nil {
+		t.Fatalf("NextTarget() error: %v", err)
+	}
+
+	// same host, response of target matched by target, not by host
+	res := &http.Response{StatusCode: http.StatusBadGateway, Request: c.Request().Clone(c.Request().Context())}
+	if err := proxyConfig.ModifyResponse(res); err != nil {
+		t.Fatalf("ModifyResponse() error: %v", err)
+	}
+
+	for _, v := range pool.targets {
+		if want := v.target == target; v.outlier.ejected != want {
+			t.Errorf("target %v ejected = %v, want %v", v.target.Name, v.outlier.ejected, want)
+		}
+	}
+}
+
+func Test_upstreamPool_trialRelease(t *testing.T) {
+
+	e := echo.New()
+
+	pool, _ := newUpstreamPool(&proxyUpstream{
+		prefix:  "/",
+		server:  []proxyServer{{url: "http://127.0.0.1:1"}},
+		outlier: config.AppConfigProxyOutlier{Consecutive: 1, BaseEjection: 3600},
+	})
+
+	name := "http://127.0.0.1:1"
+	pool.report(name, true)
+	pool.release(name)
+
+	// trial request ends without result, e.g. client closed
+	handler := pool.track(func(c echo.Context) error {
+		if _, err := pool.NextTarget(c); err != nil {
+			t.Fatalf("NextTarget() error: %v", err)
+		}
+		if _, err := pool.NextTarget(e.NewContext(httptest.NewRequest("GET", "/", nil), nil)); !errors.Is(err, ErrNoUpstream) {
+			t.Fatalf("NextTarget() of other request = %v, want %v", err, ErrNoUpstream)
+		}
+		return context.Canceled
+	})
+	_ = handler(e.NewContext(httptest.NewRequest("GET", "/", nil), httptest.NewRecorder()))
+
+	s := pool.find(name).outlier
+	if !s.halfOpen || s.trial {
+		t.Fatalf("expected half-open target without trial, got %+v", s)
+	}
+
+	// released trial of previous request does not release trial of next one
+	c := e.NewContext(httptest.NewRequest("GET", "/", nil), httptest.NewRecorder())
+	if _, err := pool.NextTarget(c); err != nil {
+		t.Fatalf("NextTarget() error: %v", err)
+	}
+	stale := e.NewContext(httptest.NewRequest("GET", "/", nil), httptest.NewRecorder())
+	stale.Set(poolTargetKey, name)
+	stale.Set(poolTrialKey, s.trialID)
+	pool.loads.inc(name)
+	pool.releaseTarget(stale)
+
+	if !pool.find(name).outlier.trial {
+		t.Fatalf("expected trial in flight")
+	}
+}
+
+func Test_upstreamPool_maxEjectionPercent(t *testing.T) {
+
+	pool, _ := newUpstreamPool(&proxyUpstream{
+		prefix: "/",
+		server: []proxyServer{
+			{url: "http://127.0.0.1:1"}, {url: "http://127.0.0.1:2"},
+			{url: "http://127.0.0.1:3"}, {url: "http://127.0.0.1:4"},
+		},
+		outlier: config.AppConfigProxyOutlier{Consecutive: 1, BaseEjection: 3600},
+	})
+
+	for _, v := range pool.targets {
+		pool.report(v.target.Name, true)
+	}
+
+	ejected := 0
+	for _, v := range pool.targets {
+		if v.outlier.ejected {
+			ejected++
+		}
+	}
+	if ejected != 2 {
+		t.Errorf("ejected targets = %v, want 2 of default 50%%", ejected)
+	}
+
+	single, _ := newUpstreamPool(&proxyUpstream{
+		prefix:  "/",
+		server:  []proxyServer{{url: "http://127.0.0.1:1"}},
+		outlier: config.AppConfigProxyOutlier{Consecutive: 1, BaseEjection: 3600, MaxEjectionPercent: 10},
+	})
+	single.report("http://127.0.0.1:1", true)
+	if !single.find("http://127.0.0.1:1").outlier.ejected {
+		t.Errorf("expected at least one ejected target")
+	}
+}
@@ -0,0 +1,326 @@
+package middleware
+
+import (
+	"fmt"
+	"go-proxy/internal/config"
+	"net/url"
+	"sync"
+	"time"
+
+	xlog "go-proxy/internal/util/utillog"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+)
+
+// upstreamPool keeps all targets of upstream and publishes available ones to balancer
+type upstreamPool struct {
+	name     string // upstream prefix
+	balancer middleware.ProxyBalancer
+	outlier  config.AppConfigProxyOutlier
+	loads    *loadCounter // in-flight requests per target
+	affinity *affinity    // sticky sessions, nil if disabled
+	mutex    sync.Mutex
+	targets  []*poolTarget
+}
+
+// context keys of target acquired by pool for request and of proxy attempts
+const (
+	poolTargetKey  = "_pool_target"
+	poolTrialKey   = "_pool_trial" // id of trial held by request for half-open target
+	poolAttemptKey = "_pool_attempt"
+)
+
+type poolTarget struct {
+	target  *middleware.ProxyTarget
+	healthy bool         // active health check
+	outlier outlierState // passive health check
+	added   bool         // published to balancer
+}
+
+func (x *poolTarget) available() bool {
+	return x.healthy && !x.outlier.ejected
+}
+
+func newUpstreamPool(upstream *proxyUpstream) (*upstreamPool, error) {
+
+	loads := newLoadCounter()
+
+	balancer, err := newBalancer(upstream.balancer, upstream.hashKey, loads)
+	if err != nil {
+		return nil, fmt.Errorf("error on balancer of proxy upstream %v: %v", upstream.name(), err)
+	}
+
+	res := &upstreamPool{
+		name:     upstream.name(),
+		balancer: balancer,
+		outlier:  normalizeOutlier(upstream.outlier),
+		loads:    loads,
+	}
+
+	if upstream.affinity.Enabled {
+		res.affinity = newAffinity(upstream.affinity)
+		xlog.Info("upstream %v affinity cookie: %v ttl: %v", res.name, res.affinity.cookie, res.affinity.ttl)
+	}
+
+	for _, v := range upstream.server {
+		serverURL, err := url.Parse(v.url) // downstream
+		if err != nil {
+			return nil, fmt.Errorf("error on parse proxy upstream %v: %v", upstream.name(), err)
+		}
+
+		res.AddTarget(&middleware.ProxyTarget{
+			URL:  serverURL,
+			Name: v.url, // !!! server ID
+			Meta: echo.Map{"weight": v.weight},
+		})
+	}
+
+	return res, nil
+}
+
+func (x *upstreamPool) find(name string) *poolTarget {
+	for _, v := range x.targets {
+		if v.target.Name == name {
+			return v
+		}
+	}
+	return nil
+}
+
+// sync add or remove target from balancer, call under lock
+func (x *upstreamPool) sync(t *poolTarget) {
+
+	available := t.available()
+
+	if available && !t.added {
+		t.added = x.balancer.AddTarget(t.target)
+	}
+
+	if !available && t.added {
+		x.balancer.RemoveTarget(t.target.Name)
+		t.added = false
+	}
+}
+
+func (x *upstreamPool) setHealthy(name string, healthy bool) {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+
+	if t := x.find(name); t != nil && t.healthy != healthy {
+		t.healthy = healthy
+		x.sync(t)
+
+		if healthy {
+			xlog.Info("upstream %v target healthy: %v", x.name, name)
+		} else {
+			xlog.Warn("upstream %v target unhealthy: %v", x.name, name)
+		}
+	}
+}
+
+// list all targets of pool
+func (x *upstreamPool) list() []*middleware.ProxyTarget {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+
+	res := make([]*middleware.ProxyTarget, 0, len(x.targets))
+	for _, v := range x.targets {
+		res = append(res, v.target)
+	}
+	return res
+}
+
+// AddTarget implements middleware.ProxyBalancer
+func (x *upstreamPool) AddTarget(target *middleware.ProxyTarget) bool {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+
+	if x.find(target.Name) != nil {
+		return false
+	}
+
+	t := &poolTarget{target: target, healthy: true}
+	x.targets = append(x.targets, t)
+	x.sync(t)
+
+	return true
+}
+
+// RemoveTarget implements middleware.ProxyBalancer
+func (x *upstreamPool) RemoveTarget(name string) bool {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+
+	for i, v := range x.targets {
+		if v.target.Name == name {
+			x.targets = append(x.targets[:i], x.targets[i+1:]...)
+			return x.balancer.RemoveTarget(name)
+		}
+	}
+
+	return false
+}
+
+// Next implements middleware.ProxyBalancer
+func (x *upstreamPool) Next(c echo.Context) *middleware.ProxyTarget {
+	return x.balancer.Next(c)
+}
+
+// NextTarget implements middleware.TargetProvider, error if no available target
+func (x *upstreamPool) NextTarget(c echo.Context) (*middleware.ProxyTarget, error) {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+
+	prev := x.releaseTarget(c) // retry of failed request
+
+	attempt := 0
+	if c != nil {
+		attempt, _ = c.Get(poolAttemptKey).(int)
+		c.Set(poolAttemptKey, attempt+1)
+	}
+
+	available := 0
+	for _, v := range x.targets {
+		if v.added {
+			available++
+		}
+	}
+
+	hasAffinity := x.affinity != nil && c != nil
+
+	if hasAffinity && prev == "" {
+		if t := x.stickyTarget(c); t != nil && x.acquire(t.target.Name) {
+			return x.take(c, t.target), nil
+		}
+	}
+
+	// skip previous target on retry and half-open targets with trial request in flight
+	for skip := range len(x.targets) {
+		if c != nil {
+			c.Set(balancerAttemptKey, attempt+skip)
+		}
+		t := x.balancer.Next(c)
+		if t == nil {
+			break
+		}
+		if t.Name == prev && available > 1 {
+			continue
+		}
+		if x.acquire(t.Name) {
+			if hasAffinity {
+				x.affinity.set(c, x.name, t.Name)
+			}
+			return x.take(c, t), nil
+		}
+	}
+
+	return nil, ErrNoUpstream
+}
+
+// take count request of target, call under lock
+func (x *upstreamPool) take(c echo.Context, t *middleware.ProxyTarget) *middleware.ProxyTarget {
+	x.loads.inc(t.Name)
+	if c != nil {
+		c.Set(poolTargetKey, t.Name)
+		if pt := x.find(t.Name); pt != nil && pt.outlier.halfOpen && pt.outlier.trial {
+			c.Set(poolTrialKey, pt.outlier.trialID)
+		}
+		c.SetRequest(withProxyTarget(c.Request(), t))
+	}
+	return t
+}
+
+// releaseTarget end of request to target acquired by NextTarget, return target name,
+// trial of half-open target without reported result is released, call under lock
+func (x *upstreamPool) releaseTarget(c echo.Context) string {
+	if c == nil {
+		return ""
+	}
+
+	name, _ := c.Get(poolTargetKey).(string)
+	if name != "" {
+		x.loads.dec(name)
+		c.Set(poolTargetKey, "")
+	}
+
+	if id, _ := c.Get(poolTrialKey).(uint64); id != 0 {
+		c.Set(poolTrialKey, uint64(0))
+		if t := x.find(name); t != nil && t.outlier.halfOpen && t.outlier.trialID == id {
+			t.outlier.trial = false
+		}
+	}
+
+	return name
+}
+
+// track middleware releases target at end of proxied request
+func (x *upstreamPool) track(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		defer func() {
+			x.mutex.Lock()
+			defer x.mutex.Unlock()
+			x.releaseTarget(c)
+		}()
+		return next(c)
+	}
+}
+
+// UpstreamTargetStatus state of upstream target
+type UpstreamTargetStatus struct {
+	Name         string     `json:"name"`
+	Available    bool       `json:"available"`
+	Healthy      bool       `json:"healthy"`
+	Ejected      bool       `json:"ejected"`
+	EjectedUntil *time.Time `json:"ejected_until,omitempty"`
+	Ejections    int        `json:"ejections"`
+	Failures     int        `json:"failures"`
+	HalfOpen     bool       `json:"half_open"`
+}
+
+// UpstreamStatus state of upstream
+type UpstreamStatus struct {
+	Name    string                 `json:"name"`
+	Targets []UpstreamTargetStatus `json:"targets"`
+}
+
+func (x *upstreamPool) status() UpstreamStatus {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+
+	res := UpstreamStatus{Name: x.name, Targets: []UpstreamTargetStatus{}}
+
+	for _, v := range x.targets {
+		s := UpstreamTargetStatus{
+			Name:      v.target.Name,
+			Available: v.available(),
+			Healthy:   v.healthy,
+			Ejected:   v.outlier.ejected,
+			Ejections: v.outlier.ejections,
+			Failures:  v.outlier.failures,
+			HalfOpen:  v.outlier.halfOpen,
+		}
+		if v.outlier.ejected {
+			until := v.outlier.ejectedUntil
+			s.EjectedUntil = &until
+		}
+		res.Targets = append(res.Targets, s)
+	}
+
+	return res
+}
+
+// UpstreamsStatus state of all upstreams and targets, for sys api
+func UpstreamsStatus() []UpstreamStatus {
+	items := []*upstreamPool{}
+	if rt := activeRuntime.Load(); rt != nil {
+		items = rt.pools
+	}
+
+	res := make([]UpstreamStatus, 0, len(items))
+	for _, v := range items {
+		res = append(res, v.status())
+	}
+
+	return res
+}
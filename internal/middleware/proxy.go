@@ -0,0 +1,645 @@
+package middleware
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"go-proxy/internal/config"
+	"go-proxy/internal/service"
+	xlog "go-proxy/internal/util/utillog"
+	"go-proxy/internal/util/utilnet"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+)
+
+func initProxy(e *echo.Echo, appService service.AppService, rt *Runtime) {
+
+	appConfig := appService.Config()
+	{
+
+		routes := []config.AppConfigProxyRoute{}
+
+		for _, upstream := range appConfig.Proxy.Upstreams {
+
+			route, err := parseProxyUpstream(upstream, appConfig.Proxy)
+			if err != nil {
+				xlog.Panic("error on try add proxy upstream: %v", err)
+			}
+
+			routes = append(routes, route)
+		}
+
+		routes = append(routes, appConfig.Proxy.Routes...)
+
+		// virtual host routes without own host bound to hosts of virtual host
+		routeHosts := make([][]string, len(routes))
+
+		for _, vhost := range appConfig.VirtualHosts {
+			for _, route := range vhost.Routes {
+				routes = append(routes, route)
+				if route.Host == "" {
+					routeHosts = append(routeHosts, vhost.Hosts)
+				} else {
+					routeHosts = append(routeHosts, nil)
+				}
+			}
+		}
+
+		upstreams := []*proxyUpstream{}
+
+		for i, route := range routes {
+
+			// httputil.NewSingleHostReverseProxy(serverURL)
+
+			trg, err := newProxyUpstream(route, appConfig.Proxy, appConfig.HTTPTransport)
+			if err != nil {
+				xlog.Panic("error on try add proxy upstream: %v", err)
+			}
+
+			for _, host := range routeHosts[i] {
+				trg.hosts = append(trg.hosts, strings.ToLower(host))
+			}
+
+			if err := trg.build(); err != nil {
+				xlog.Panic("error on try add proxy upstream: %v", err)
+			}
+
+			rt.addPool(trg.pool)
+			if trg.checker != nil {
+				rt.onClose(trg.checker.stop)
+			}
+			rt.onClose(trg.transport.CloseIdleConnections)
+
+			upstreams = append(upstreams, trg)
+		}
+
+		prefixes, dispatchers := newProxyDispatchers(upstreams)
+		for _, prefix := range prefixes {
+			e.RouteNotFound(prefix, dispatchers[prefix])
+		}
+
+	}
+
+}
+
+// proxyHostGroup upstreams with same prefix, exact host first, then wildcard, then any host
+type proxyHostGroup struct {
+	prefix string
+	items  []proxyHostUpstream
+}
+
+type proxyHostUpstream struct {
+	host     string // pattern
+	upstream *proxyUpstream
+}
+
+func newProxyHostGroup(prefix string, upstreams []*proxyUpstream) *proxyHostGroup {
+
+	items := []proxyHostUpstream{}
+	for _, v := range upstreams {
+		if len(v.hosts) == 0 {
+			items = append(items, proxyHostUpstream{upstream: v})
+		}
+		for _, host := range v.hosts {
+			items = append(items, proxyHostUpstream{host: host, upstream: v})
+		}
+	}
+
+	slices.SortStableFunc(items, func(a, b proxyHostUpstream) int {
+		return compareHost(a.host, b.host)
+	})
+
+	return &proxyHostGroup{prefix: prefix, items: items}
+}
+
+// find upstream of host, nil if no host matches
+func (x *proxyHostGroup) find(host string) *proxyUpstream {
+	for _, v := range x.items {
+		if matchHost(v.host, host) {
+			return v.upstream
+		}
+	}
+	return nil
+}
+
+// newProxyDispatchers handler of each prefix, upstream by request host, if no host of prefix matches,
+// then shorter prefixes matching request path, e.g. "/api/*" of one host falls back to "/*" of other host
+func newProxyDispatchers(upstreams []*proxyUpstream) ([]string, map[string]echo.HandlerFunc) {
+
+	prefixes := []string{}
+	hostRoutes := map[string][]*proxyUpstream{}
+	for _, v := range upstreams {
+		if _, ok := hostRoutes[v.prefix]; !ok {
+			prefixes = append(prefixes, v.prefix)
+		}
+		hostRoutes[v.prefix] = append(hostRoutes[v.prefix], v)
+	}
+
+	groups := []*proxyHostGroup{}
+	for _, prefix := range prefixes {
+		groups = append(groups, newProxyHostGroup(prefix, hostRoutes[prefix]))
+	}
+
+	// longest static prefix first
+	slices.SortStableFunc(groups, func(a, b *proxyHostGroup) int {
+		return len(staticPrefix(b.prefix)) - len(staticPrefix(a.prefix))
+	})
+
+	dispatchers := map[string]echo.HandlerFunc{}
+	for _, g := range groups {
+
+		if len(groups) == 1 && len(g.items) == 1 && g.items[0].host == "" {
+			dispatchers[g.prefix] = g.items[0].upstream.handler
+			continue
+		}
+
+		dispatchers[g.prefix] = func(c echo.Context) error {
+			host := requestHost(c.Request())
+			if v := g.find(host); v != nil {
+				return v.handler(c)
+			}
+			for _, other := range groups {
+				if other == g || !matchPrefix(other.prefix, c.Request().URL.Path) {
+					continue
+				}
+				if v := other.find(host); v != nil {
+					return v.handler(c)
+				}
+			}
+			return echo.ErrNotFound
+		}
+	}
+
+	return prefixes, dispatchers
+}
+
+// matchPrefix path matches route prefix, ":param" matches one segment, "*" matches rest
+func matchPrefix(prefix string, path string) bool {
+
+	pp := strings.Split(prefix, "/")
+	sp := strings.Split(path, "/")
+
+	for i, v := range pp {
+		if strings.HasPrefix(v, "*") {
+			return true
+		}
+		if i >= len(sp) {
+			return false
+		}
+		if strings.HasPrefix(v, ":") {
+			if sp[i] == "" {
+				return false
+			}
+			continue
+		}
+		if v != sp[i] {
+			return false
+		}
+	}
+
+	return len(pp) == len(sp)
+}
+
+type proxyServer struct {
+	url    string
+	weight int
+}
+
+type proxyUpstream struct {
+	server          []proxyServer
+	prefix          string
+	hosts           []string      // patterns "example.com", "*.example.com", any host if empty
+	stripPrefix     string        // static part of prefix to remove, empty if disabled
+	timeout         time.Duration // upstream request timeout
+	balancer        string
+	hashKey         string
+	rewrite         rewriteRules
+	health          config.AppConfigProxyHealthCheck
+	outlier         config.AppConfigProxyOutlier
+	affinity        config.AppConfigProxyAffinity
+	clientAuth      *clientAuth // nil if no route rules
+	tls             config.AppConfigProxyTLS
+	transportConfig config.AppConfigHTTPTransport
+	concurrency     config.AppConfigConcurrency
+
+	requestHeadersSet  [][]string
+	requestHeadersDel  []string
+	responseHeadersSet [][]string
+	responseHeadersDel []string
+
+	handler   echo.HandlerFunc
+	pool      *upstreamPool
+	checker   *healthChecker // nil if health check disabled
+	transport *http.Transport
+	limiter   *concurrencyLimiter // nil if unlimited
+}
+
+// name of upstream for logs and sys api
+func (x *proxyUpstream) name() string {
+	return strings.Join(x.hosts, ",") + x.prefix
+}
+
+// parseProxyUpstream shorthand "http://127.0.0.1:10082/test2?server=127.0.0.1:10083&rewrite=/a:/b" to route
+func parseProxyUpstream(upstream string, defaults config.AppConfigProxy) (config.AppConfigProxyRoute, error) {
+
+	upstream = strings.TrimSpace(upstream)
+	// parts := strings.SplitN(upstream, " ", 2)
+	// upstream = strings.TrimSpace(parts[0])
+	// http://127.0.0.1:10082/test2?server=127.0.0.1:10083
+
+	r := config.AppConfigProxyRoute{}
+
+	parsedURL, err := url.Parse(upstream)
+
+	if err != nil {
+		return r, fmt.Errorf("error on parse proxy upstream %v: %v", upstream, err)
+		// panic()
+	}
+
+	args := parsedURL.Query()
+
+	{
+		// main server weight "?weight=2"
+		weight := 1
+		if v := args.Get("weight"); v != "" {
+			weight, err = strconv.Atoi(v)
+			if err != nil {
+				return r, fmt.Errorf("error on parse weight of proxy upstream %v: %v", upstream, err)
+			}
+		}
+		r.Servers = append(r.Servers, config.AppConfigProxyServer{
+			URL:    fmt.Sprintf("%s://%s", parsedURL.Scheme, parsedURL.Host /*has port*/),
+			Weight: weight,
+		})
+	}
+
+	{
+		// extra servers "?server=127.0.0.1:10083@2", weight after "@"
+		serverExt := args["server"]
+		for _, v := range serverExt {
+			host, weightStr, hasWeight := strings.Cut(v, "@")
+			weight := 1
+			if hasWeight {
+				weight, err = strconv.Atoi(weightStr)
+				if err != nil {
+					return r, fmt.Errorf("error on parse weight of server %v of proxy upstream %v: %v", v, upstream, err)
+				}
+			}
+			r.Servers = append(r.Servers, config.AppConfigProxyServer{
+				URL:    fmt.Sprintf("%s://%s", parsedURL.Scheme, host /*has port*/),
+				Weight: weight,
+			})
+		}
+	}
+
+	{
+		r.Host = args.Get("host")
+		r.StripPrefix = args.Get("strip_prefix") == "1" || args.Get("strip_prefix") == "true"
+		r.Rewrite = args["rewrite"]
+		r.Balancer = args.Get("balancer")
+		r.HashKey = args.Get("hash_key")
+	}
+
+	{
+		// sticky sessions "?affinity=1" or "?affinity=cookie_name", defaults from config
+		affinity := defaults.Affinity
+
+		switch v := args.Get("affinity"); v {
+		case "":
+		case "0", "false":
+			affinity.Enabled = false
+		case "1", "true":
+			affinity.Enabled = true
+		default:
+			affinity.Enabled = true
+			affinity.Cookie = v
+		}
+
+		r.Affinity = &affinity
+	}
+
+	{
+		// health check and outlier detection, defaults from config
+		health := defaults.HealthCheck
+		outlier := defaults.Outlier
+
+		if v := args.Get("health"); v != "" {
+			health.Path = v
+		}
+
+		for name, p := range map[string]*int{
+			"timeout":               &r.Timeout,
+			"health_interval":       &health.Interval,
+			"health_timeout":        &health.Timeout,
+			"health_status":         &health.Status,
+			"health_rise":           &health.Rise,
+			"health_fall":           &health.Fall,
+			"outlier":               &outlier.Consecutive,
+			"outlier_base_ejection": &outlier.BaseEjection,
+			"outlier_max_ejection":  &outlier.MaxEjection,
+
+			"outlier_max_ejection_percent": &outlier.MaxEjectionPercent,
+		} {
+			if v := args.Get(name); v != "" {
+				n, err := strconv.Atoi(v)
+				if err != nil {
+					return r, fmt.Errorf("error on parse %v of proxy upstream %v: %v", name, upstream, err)
+				}
+				*p = n
+			}
+		}
+
+		r.HealthCheck = &health
+		r.Outlier = &outlier
+	}
+
+	r.Prefix = parsedURL.Path
+
+	return r, nil
+}
+
+// newProxyUpstream from route, empty route values from defaults of proxy and http transport
+func newProxyUpstream(route config.AppConfigProxyRoute, defaults config.AppConfigProxy, transport config.AppConfigHTTPTransport) (*proxyUpstream, error) {
+
+	r := &proxyUpstream{
+		prefix:   route.Prefix,
+		timeout:  time.Duration(route.Timeout) * time.Second,
+		balancer: cmp.Or(route.Balancer, defaults.Balancer),
+		hashKey:  cmp.Or(route.HashKey, defaults.HashKey),
+		health:   defaults.HealthCheck,
+		outlier:  defaults.Outlier,
+		affinity: defaults.Affinity,
+		tls:      defaults.TLS,
+
+		transportConfig: transport,
+		concurrency:     defaults.Concurrency,
+	}
+
+	if route.Host != "" {
+		r.hosts = []string{strings.ToLower(route.Host)}
+	}
+
+	if len(route.Servers) == 0 {
+		return nil, fmt.Errorf("proxy route %v has no servers", r.name())
+	}
+
+	for _, v := range route.Servers {
+		if v.URL == "" {
+			return nil, fmt.Errorf("proxy route %v has server with empty url", r.name())
+		}
+		r.server = append(r.server, proxyServer{url: v.URL, weight: max(v.Weight, 1)})
+	}
+
+	if route.StripPrefix {
+		r.stripPrefix = staticPrefix(route.Prefix)
+	}
+
+	if route.HealthCheck != nil {
+		r.health = *route.HealthCheck
+	}
+	if route.Outlier != nil {
+		r.outlier = *route.Outlier
+	}
+	if route.Affinity != nil {
+		r.affinity = *route.Affinity
+	}
+	if route.Concurrency != nil {
+		r.concurrency = *route.Concurrency
+	}
+	if route.TLS != nil {
+		r.tls = *route.TLS
+	}
+	if route.Transport != nil {
+		r.transportConfig = mergeTransport(*route.Transport, transport)
+	}
+	if route.ClientAuth != nil {
+		r.clientAuth = newClientAuth(route.ClientAuth.Verify, route.ClientAuth.Allow)
+	}
+
+	{
+		rewrite := route.Rewrite
+
+		if len(rewrite) > 0 {
+			xlog.Info("rewrite path conds: %+v", rewrite)
+		}
+
+		for _, v := range rewrite {
+			parts := strings.SplitN(v, ":", 2)
+			if len(parts) != 2 {
+				xlog.Error("[ERROR] cannot parse token for rewrite: %s", v)
+				continue // may be panic
+			}
+
+			rule, err := newLegacyRewriteRule(parts[0], parts[1])
+			if err != nil {
+				return nil, err
+			}
+			r.rewrite = append(r.rewrite, rule)
+		}
+
+		for _, v := range route.RewriteRules {
+			rule, err := newRewriteRule(v)
+			if err != nil {
+				return nil, err
+			}
+			xlog.Info("rewrite rule: %v => %v query: %v redirect: %v", v.Match, v.Replace, v.Query, v.Redirect)
+			r.rewrite = append(r.rewrite, rule)
+		}
+	}
+
+	r.requestHeadersSet = parseHeaders(route.RequestHeadersSet)
+	r.requestHeadersDel = route.RequestHeadersDel
+	r.responseHeadersSet = parseHeaders(route.ResponseHeadersSet)
+	r.responseHeadersDel = route.ResponseHeadersDel
+
+	return r, nil
+}
+
+// staticPrefix path before first wildcard or param without trailing slash, "/api/*" => "/api"
+func staticPrefix(prefix string) string {
+	if i := strings.IndexAny(prefix, "*:"); i >= 0 {
+		prefix = prefix[:i]
+	}
+	return strings.TrimSuffix(prefix, "/")
+}
+
+// parseHeaders "Name: value" to name-value pairs
+func parseHeaders(values []string) [][]string {
+	res := [][]string{}
+	for _, v := range values {
+		parts := strings.SplitN(v, ":", 2) // name=value
+		if len(parts) < 2 {
+			xlog.Error("[ERROR] cannot parse header: %s", v)
+			continue
+		}
+		res = append(res, []string{strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])})
+	}
+	return res
+}
+
+var proxyVarRe = regexp.MustCompile(`\$\{proxy_(\w+)\}`)
+
+// expandProxyVars "${proxy_ssl_cn}" of PROXY header of connection, empty if not sent
+func expandProxyVars(req *http.Request, value string) string {
+	header := utilnet.ProxyHeader(req.Context())
+	return proxyVarRe.ReplaceAllStringFunc(value, func(v string) string {
+		return utilnet.ProxyVar(header, proxyVarRe.FindStringSubmatch(v)[1])
+	})
+}
+
+// build upstream pool and proxy handler
+func (x *proxyUpstream) build() error {
+
+	for _, v := range x.server {
+		xlog.Info("adding proxy upstream: %v => %v weight: %v", x.name(), v.url, v.weight)
+	}
+
+	balancer, err := newUpstreamPool(x)
+	if err != nil {
+		return err
+	}
+
+	if x.balancer != "" {
+		xlog.Info("upstream %v balancer: %v %v", x.name(), x.balancer, x.hashKey)
+	}
+
+	x.pool = balancer
+
+	x.transport, err = newUpstreamTransport(x.transportConfig, x.tls)
+	if err != nil {
+		return fmt.Errorf("upstream %v: %w", x.name(), err)
+	}
+
+	if x.health.Path != "" {
+		x.checker = newHealthChecker(balancer, x.health)
+		x.checker.client.Transport = x.transport
+		x.checker.start()
+	}
+
+	x.limiter = newConcurrencyLimiter(x.name(), x.concurrency)
+	if x.limiter != nil {
+		xlog.Info("upstream %v concurrency: %+v", x.name(), x.concurrency)
+	}
+
+	proxyConfig := middleware.DefaultProxyConfig
+	proxyConfig.Balancer = balancer
+	proxyConfig.Transport = x.transport
+	if x.transportConfig != (config.AppConfigHTTPTransport{}) {
+		data, _ := json.Marshal(x.transportConfig) // values of pointers
+		xlog.Info("upstream %v transport: %s", x.name(), data)
+	}
+	if x.tls != (config.AppConfigProxyTLS{}) {
+		xlog.Info("upstream %v tls: ca: %v cert: %v server name: %v min version: %v", x.name(), x.tls.CA, x.tls.Cert, x.tls.ServerName, x.tls.MinVersion)
+		if x.tls.InsecureSkipVerify {
+			xlog.Warn("upstream %v tls certificate verification disabled", x.name())
+		}
+	}
+	// proxyConfig.RetryCount = 0 // 0, meaning requests are never retried
+	proxyConfig.RetryCount = len(x.server) - 1
+	proxyConfig.RetryFilter = func(c echo.Context, err error) bool {
+		// no retry after request timeout
+		return isTargetError(err) && c.Request().Context().Err() == nil
+	}
+	proxyConfig.ErrorHandler = func(c echo.Context, err error) error {
+		if x.timeout > 0 && c.Request().Context().Err() == context.DeadlineExceeded {
+			return echo.NewHTTPError(http.StatusGatewayTimeout, "upstream request timeout").SetInternal(context.DeadlineExceeded)
+		}
+		return err
+	}
+	proxyConfig.ModifyResponse = func(r *http.Response) error {
+		h := r.Header
+		for _, v := range x.responseHeadersDel {
+			h.Del(v)
+		}
+		for _, v := range x.responseHeadersSet {
+			h.Set(v[0], v[1])
+		}
+		return nil
+	}
+	balancer.applyOutlier(&proxyConfig)
+
+	proxyHandler := balancer.track(middleware.ProxyWithConfig(proxyConfig)(echo.NotFoundHandler))
+
+	timeoutHandler := func(c echo.Context) error {
+		if x.timeout > 0 {
+			ctx, cancel := context.WithTimeout(c.Request().Context(), x.timeout)
+			defer cancel()
+			c.SetRequest(c.Request().WithContext(ctx))
+		}
+		return proxyHandler(c)
+	}
+
+	x.handler = func(c echo.Context) error {
+
+		req := c.Request()
+
+		if x.clientAuth != nil {
+			if err := x.clientAuth.check(c); err != nil {
+				return err
+			}
+		}
+
+		if x.stripPrefix != "" {
+			stripPathPrefix(req, x.stripPrefix)
+		}
+
+		if sent, err := x.rewrite.apply(c); sent || err != nil {
+			return err
+		}
+
+		for _, v := range x.requestHeadersDel {
+			req.Header.Del(v)
+		}
+		for _, v := range x.requestHeadersSet {
+			value := v[1]
+			if strings.Contains(value, "${proxy_") {
+				// not sent by load balancer, client header is not passed
+				if value = expandProxyVars(req, value); value == "" {
+					req.Header.Del(v[0])
+					continue
+				}
+			}
+			req.Header.Set(v[0], value)
+		}
+
+		// queue time is not part of upstream timeout
+		if x.limiter != nil {
+			return x.limiter.serve(c, timeoutHandler)
+		}
+
+		return timeoutHandler(c)
+	}
+
+	return nil
+}
+
+// stripPathPrefix remove prefix from request path on segment boundary, "/api/users" => "/users", "/apiary" unchanged
+func stripPathPrefix(req *http.Request, prefix string) {
+
+	strip := func(path string) string {
+		if path == prefix {
+			return "/"
+		}
+		if strings.HasPrefix(path, prefix+"/") {
+			return path[len(prefix):]
+		}
+		return path
+	}
+
+	req.URL.Path = strip(req.URL.Path)
+	if req.URL.RawPath != "" {
+		req.URL.RawPath = strip(req.URL.RawPath)
+	}
+	if req.RequestURI != "" {
+		req.RequestURI = req.URL.RequestURI()
+	}
+}
@@ -0,0 +1,229 @@
+package middleware
+
+import (
+	"go-proxy/internal/config"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+func Test_parseProxyUpstream(t *testing.T) {
+
+	defaults := config.NewAppConfig().Proxy
+
+	route, err := parseProxyUpstream("http://127.0.0.1:8080/api/*?weight=2&server=127.0.0.1:8081@3&strip_prefix=1&timeout=5&host=example.com&health=/health&affinity=sid", defaults)
+	if err != nil {
+		t.Fatalf("parseProxyUpstream() error: %v", err)
+	}
+
+	want := []config.AppConfigProxyServer{
+		{URL: "http://127.0.0.1:8080", Weight: 2},
+		{URL: "http://127.0.0.1:8081", Weight: 3},
+	}
+	if len(route.Servers) != len(want) || route.Servers[0] != want[0] || route.Servers[1] != want[1] {
+		t.Errorf("servers = %+v, want %+v", route.Servers, want)
+	}
+	if route.Prefix != "/api/*" || route.Host != "example.com" || !route.StripPrefix || route.Timeout != 5 {
+		t.Errorf("unexpected route %+v", route)
+	}
+	if route.HealthCheck.Path != "/health" || route.HealthCheck.Interval != defaults.HealthCheck.Interval {
+		t.Errorf("unexpected health check %+v", route.HealthCheck)
+	}
+	if !route.Affinity.Enabled || route.Affinity.Cookie != "sid" {
+		t.Errorf("unexpected affinity %+v", route.Affinity)
+	}
+
+	if _, err := parseProxyUpstream("http://127.0.0.1:8080/?weight=qwe", defaults); err == nil {
+		t.Errorf("expected weight error")
+	}
+}
+
+func Test_staticPrefix(t *testing.T) {
+	tests := []struct {
+		prefix string
+		want   string
+	}{
+		{prefix: "/api/*", want: "/api"},
+		{prefix: "/api/v1", want: "/api/v1"},
+		{prefix: "/users/:id", want: "/users"},
+		{prefix: "/*", want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.prefix, func(t *testing.T) {
+			if got := staticPrefix(tt.prefix); got != tt.want {
+				t.Errorf("staticPrefix() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_matchPrefix(t *testing.T) {
+	tests := []struct {
+		prefix string
+		path   string
+		want   bool
+	}{
+		{prefix: "/*", path: "/api/users", want: true},
+		{prefix: "/api/*", path: "/api/users", want: true},
+		{prefix: "/api/*", path: "/api", want: true},
+		{prefix: "/api/*", path: "/apiary", want: false},
+		{prefix: "/users/:id", path: "/users/1", want: true},
+		{prefix: "/users/:id", path: "/users/1/posts", want: false},
+		{prefix: "/users/:id", path: "/users/", want: false},
+		{prefix: "/api/v1", path: "/api/v1", want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.prefix+" "+tt.path, func(t *testing.T) {
+			if got := matchPrefix(tt.prefix, tt.path); got != tt.want {
+				t.Errorf("matchPrefix() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_stripPathPrefix(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{path: "/api/users", want: "/users"},
+		{path: "/api/", want: "/"},
+		{path: "/api", want: "/"},
+		{path: "/api?q=1", want: "/?q=1"},
+		{path: "/apiary", want: "/apiary"},
+		{path: "/other/api/users", want: "/other/api/users"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			stripPathPrefix(req, "/api")
+			if req.RequestURI != tt.want {
+				t.Errorf("stripPathPrefix() = %v, want %v", req.RequestURI, tt.want)
+			}
+		})
+	}
+}
+
+func Test_proxyUpstream_handler(t *testing.T) {
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			time.Sleep(1500 * time.Millisecond)
+		}
+		w.Header().Set("Server", "backend")
+		w.Header().Set("X-Path", r.URL.Path)
+		w.Header().Set("X-Req-Header", r.Header.Get("X-Req"))
+		w.Header().Set("X-Req-Cookie", r.Header.Get("Cookie"))
+		w.Header().Set("X-Req-Client-CN", r.Header.Get("X-Client-CN"))
+		_, _ = io.WriteString(w, r.Host)
+	}))
+	defer backend.Close()
+
+	defaults := config.NewAppConfig().Proxy
+
+	routes := []config.AppConfigProxyRoute{
+		{
+			Prefix:             "/api/*",
+			Host:               "example.com",
+			Servers:            []config.AppConfigProxyServer{{URL: backend.URL}},
+			StripPrefix:        true,
+			Timeout:            1,
+			RequestHeadersSet:  []string{"X-Req: 1", "X-Client-CN: ${proxy_ssl_cn}"},
+			RequestHeadersDel:  []string{"Cookie"},
+			ResponseHeadersSet: []string{"X-Resp: 2"},
+			ResponseHeadersDel: []string{"Server"},
+		},
+		{
+			Prefix:             "/api/*",
+			Host:               "*.example.com",
+			Servers:            []config.AppConfigProxyServer{{URL: backend.URL}},
+			ResponseHeadersSet: []string{"X-Resp: wildcard"},
+		},
+		{
+			Prefix:  "/api/*",
+			Servers: []config.AppConfigProxyServer{{URL: backend.URL}},
+		},
+		{
+			Prefix:             "/v2/*",
+			Host:               "a.com",
+			Servers:            []config.AppConfigProxyServer{{URL: backend.URL}},
+			ResponseHeadersSet: []string{"X-Resp: a"},
+		},
+		{
+			Prefix:             "/*",
+			Host:               "b.com",
+			Servers:            []config.AppConfigProxyServer{{URL: backend.URL}},
+			ResponseHeadersSet: []string{"X-Resp: b"},
+		},
+	}
+
+	e := echo.New()
+	upstreams := []*proxyUpstream{}
+	for _, v := range routes {
+		trg, err := newProxyUpstream(v, defaults, config.AppConfigHTTPTransport{})
+		if err != nil {
+			t.Fatalf("newProxyUpstream() error: %v", err)
+		}
+		if err := trg.build(); err != nil {
+			t.Fatalf("build() error: %v", err)
+		}
+		upstreams = append(upstreams, trg)
+	}
+	prefixes, dispatchers := newProxyDispatchers(upstreams)
+	for _, prefix := range prefixes {
+		e.RouteNotFound(prefix, dispatchers[prefix])
+	}
+
+	do := func(host string, path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Host = host
+		req.Header.Set("Cookie", "a=b")
+		req.Header.Set("X-Client-CN", "spoofed")
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := do("example.com", "/api/users")
+	h := rec.Header()
+	if h.Get("X-Path") != "/users" || h.Get("X-Req-Header") != "1" || h.Get("X-Req-Cookie") != "" || h.Get("X-Req-Client-CN") != "" ||
+		h.Get("X-Resp") != "2" || h.Get("Server") != "" {
+		t.Errorf("unexpected response headers of host route: %v", h)
+	}
+
+	rec = do("www.example.com", "/api/users")
+	if h := rec.Header(); h.Get("X-Resp") != "wildcard" || h.Get("X-Path") != "/api/users" {
+		t.Errorf("unexpected response headers of wildcard route: %v", h)
+	}
+
+	rec = do("other.com", "/api/users")
+	h = rec.Header()
+	if h.Get("X-Path") != "/api/users" || h.Get("X-Req-Cookie") != "a=b" || h.Get("Server") != "backend" {
+		t.Errorf("unexpected response headers of default route: %v", h)
+	}
+
+	// host without route of longer prefix falls back to own shorter prefix
+	rec = do("a.com", "/v2/users")
+	if h := rec.Header(); rec.Code != http.StatusOK || h.Get("X-Resp") != "a" {
+		t.Errorf("unexpected response of prefix host route: %v %v", rec.Code, h)
+	}
+
+	rec = do("b.com", "/v2/users")
+	if h := rec.Header(); rec.Code != http.StatusOK || h.Get("X-Resp") != "b" || h.Get("X-Path") != "/v2/users" {
+		t.Errorf("unexpected response of fallback host route: %v %v", rec.Code, h)
+	}
+
+	rec = do("c.com", "/v2/users")
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("status = %v, want %v", rec.Code, http.StatusNotFound)
+	}
+
+	rec = do("example.com", "/api/slow")
+	if rec.Code != http.StatusGatewayTimeout {
+		t.Errorf("status = %v, want %v", rec.Code, http.StatusGatewayTimeout)
+	}
+}
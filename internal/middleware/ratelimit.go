@@ -0,0 +1,234 @@
+package middleware
+
+import (
+	"cmp"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"go-proxy/internal/config"
+	xlog "go-proxy/internal/util/utillog"
+	"math"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// rateRule rate limit rule of config with own store
+type rateRule struct {
+	name      string
+	path      string // static prefix
+	methods   []string
+	hosts     []string
+	countries []string
+	key       func(c echo.Context) string
+	action    string
+	limit     int // burst, RateLimit-Limit header
+	store     rateStore
+}
+
+func newRateRule(cfg config.AppConfigRateRule, store rateStore) *rateRule {
+
+	res := &rateRule{
+		name:   cfg.Name,
+		path:   staticPrefix(cfg.Path),
+		key:    rateKey(cfg.Key),
+		action: cmp.Or(cfg.Action, config.RateActionReject),
+		limit:  cfg.Burst,
+		store:  store,
+	}
+	if res.limit == 0 {
+		res.limit = int(math.Max(1, math.Ceil(cfg.Rate)))
+	}
+	for _, v := range cfg.Methods {
+		res.methods = append(res.methods, strings.ToUpper(v))
+	}
+	for _, v := range cfg.Hosts {
+		res.hosts = append(res.hosts, strings.ToLower(v))
+	}
+	for _, v := range cfg.Countries {
+		res.countries = append(res.countries, strings.ToUpper(v))
+	}
+
+	return res
+}
+
+// match request by path prefix, method, host and country
+func (x *rateRule) match(c echo.Context) bool {
+	req := c.Request()
+	if x.path != "" && req.URL.Path != x.path && !strings.HasPrefix(req.URL.Path, x.path+"/") {
+		return false
+	}
+	if len(x.methods) > 0 && !slices.Contains(x.methods, req.Method) {
+		return false
+	}
+	if len(x.hosts) > 0 {
+		host := requestHost(req)
+		if !slices.ContainsFunc(x.hosts, func(v string) bool { return matchHost(v, host) }) {
+			return false
+		}
+	}
+	if len(x.countries) > 0 && !slices.Contains(x.countries, req.Header.Get("X-Country-Code")) {
+		return false
+	}
+	return true
+}
+
+// rateKey extractor of key "ip", "subnet", "header:<name>", "cookie:<name>", "jwt:<claim>",
+// value prefixed with its kind so client values never match key of other kind,
+// client ip if value is empty, long values are hashed
+func rateKey(key string) func(c echo.Context) string {
+
+	kind, name, _ := strings.Cut(key, ":")
+
+	var value func(c echo.Context) string
+	switch kind {
+	case "", "ip":
+		return func(c echo.Context) string { return "ip:" + c.RealIP() }
+	case "subnet":
+		return func(c echo.Context) string { return "subnet:" + ipSubnet(c.RealIP()) }
+	case "header":
+		value = func(c echo.Context) string { return c.Request().Header.Get(name) }
+	case "cookie":
+		value = func(c echo.Context) string {
+			if v, err := c.Cookie(name); err == nil {
+				return v.Value
+			}
+			return ""
+		}
+	case "jwt":
+		value = func(c echo.Context) string { return jwtClaim(c.Request().Header.Get(echo.HeaderAuthorization), name) }
+	default:
+		xlog.Panic("rate rule key %q not supported", key)
+	}
+
+	return func(c echo.Context) string {
+		v := value(c)
+		switch {
+		case v == "":
+			return "ip:" + c.RealIP()
+		case len(v) > 64:
+			sum := sha256.Sum256([]byte(v))
+			v = hex.EncodeToString(sum[:])
+		}
+		return kind + ":" + v
+	}
+}
+
+// ipSubnet /24 of IPv4, /64 of IPv6
+func ipSubnet(ip string) string {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return ip
+	}
+	addr = addr.Unmap()
+	bits := 64
+	if addr.Is4() {
+		bits = 24
+	}
+	prefix, _ := addr.Prefix(bits)
+	return prefix.String()
+}
+
+// jwtClaim value of claim of bearer token, signature is not verified
+func jwtClaim(authorization string, claim string) string {
+	token, ok := strings.CutPrefix(authorization, "Bearer ")
+	if !ok {
+		return ""
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return ""
+	}
+	data, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return ""
+	}
+	claims := map[string]any{}
+	if err := json.Unmarshal(data, &claims); err != nil {
+		return ""
+	}
+	switch v := claims[claim].(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	return ""
+}
+
+// setRateHeaders RateLimit-* of rule, Retry-After if denied
+func setRateHeaders(h http.Header, limit int, res rateResult) {
+	seconds := func(d time.Duration) string {
+		return strconv.Itoa(int((d + time.Second - 1) / time.Second))
+	}
+	h.Set("RateLimit-Limit", strconv.Itoa(limit))
+	h.Set("RateLimit-Remaining", strconv.Itoa(res.remaining))
+	h.Set("RateLimit-Reset", seconds(res.reset))
+	if !res.allowed {
+		h.Set("Retry-After", seconds(max(res.retryAfter, time.Second)))
+	}
+}
+
+// newRateLimit apply all matched rules, headers of rule with least remaining requests
+func newRateLimit(rules []*rateRule) echo.MiddlewareFunc {
+
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+
+		return func(c echo.Context) error {
+
+			var (
+				delay time.Duration
+				tight *rateRule
+				res   rateResult
+			)
+
+			for _, rule := range rules {
+				if !rule.match(c) {
+					continue
+				}
+				key := rule.key(c)
+				r, err := rule.store.take(key)
+				if err != nil {
+					xlog.Error("rate rule %v: %v", rule.name, err)
+					continue
+				}
+				if rule.action == config.RateActionLog {
+					if !r.allowed {
+						xlog.Warn("rate rule %v exceeded by %v", rule.name, key)
+					}
+					continue
+				}
+				if !r.allowed {
+					setRateHeaders(c.Response().Header(), rule.limit, r)
+					return c.JSON(http.StatusTooManyRequests, nil) // same as deny handler of echo rate limiter
+				}
+				delay = max(delay, r.delay)
+				if tight == nil || r.remaining < res.remaining {
+					tight, res = rule, r
+				}
+			}
+
+			if tight != nil {
+				setRateHeaders(c.Response().Header(), tight.limit, res)
+			}
+
+			if delay > 0 {
+				timer := time.NewTimer(delay)
+				defer timer.Stop()
+				select {
+				case <-timer.C:
+				case <-c.Request().Context().Done():
+					return c.Request().Context().Err()
+				}
+			}
+
+			return next(c)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package middleware
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"go-proxy/internal/config"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+func Test_rateKey(t *testing.T) {
+
+	payload := base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"user-1","tenant":42}`))
+	token := "Bearer e30." + payload + ".sig"
+	sum := sha256.Sum256([]byte(strings.Repeat("k", 65)))
+	longHash := hex.EncodeToString(sum[:])
+
+	tests := []struct {
+		name   string
+		key    string
+		ip     string
+		header http.Header
+		want   string
+	}{
+		{name: "ip", key: "ip", ip: "1.2.3.4", want: "ip:1.2.3.4"},
+		{name: "default", key: "", ip: "1.2.3.4", want: "ip:1.2.3.4"},
+		{name: "subnet v4", key: "subnet", ip: "1.2.3.4", want: "subnet:1.2.3.0/24"},
+		{name: "subnet v6", key: "subnet", ip: "2001:db8:1:2:3::4", want: "subnet:2001:db8:1:2::/64"},
+		{name: "header", key: "header:X-API-Key", ip: "1.2.3.4", header: http.Header{"X-Api-Key": {"key-1"}}, want: "header:key-1"},
+		{name: "header missing", key: "header:X-API-Key", ip: "1.2.3.4", want: "ip:1.2.3.4"},
+		{name: "cookie", key: "cookie:session", ip: "1.2.3.4", header: http.Header{"Cookie": {"session=s-1"}}, want: "cookie:s-1"},
+		{name: "jwt claim", key: "jwt:sub", ip: "1.2.3.4", header: http.Header{"Authorization": {token}}, want: "jwt:user-1"},
+		{name: "jwt number claim", key: "jwt:tenant", ip: "1.2.3.4", header: http.Header{"Authorization": {token}}, want: "jwt:42"},
+		{name: "header spoofing ip key", key: "header:X-API-Key", ip: "1.2.3.4", header: http.Header{"X-Api-Key": {"ip:5.6.7.8"}}, want: "header:ip:5.6.7.8"},
+		{name: "header long value", key: "header:X-API-Key", ip: "1.2.3.4", header: http.Header{"X-Api-Key": {strings.Repeat("k", 65)}}, want: "header:" + longHash},
+		{name: "jwt invalid", key: "jwt:sub", ip: "1.2.3.4", header: http.Header{"Authorization": {"Bearer token"}}, want: "ip:1.2.3.4"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = net.JoinHostPort(tt.ip, "1234")
+			for k, v := range tt.header {
+				req.Header[k] = v
+			}
+			c := echo.New().NewContext(req, httptest.NewRecorder())
+			if got := rateKey(tt.key)(c); got != tt.want {
+				t.Errorf("rateKey() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_newRateLimit(t *testing.T) {
+
+	rule := func(cfg config.AppConfigRateRule) *rateRule {
+		storeConfig := RateLimiterStoreConfig{Rate: 1, Burst: cfg.Burst}
+		if cfg.Action == config.RateActionDelay {
+			storeConfig.Delay = time.Second
+		}
+		cfg.Rate = 1
+		return newRateRule(cfg, NewRateLimiterMemoryStore(storeConfig))
+	}
+
+	e := echo.New()
+	e.Use(newRateLimit([]*rateRule{
+		rule(config.AppConfigRateRule{Name: "login", Path: "/login", Methods: []string{"post"}, Burst: 2}),
+		rule(config.AppConfigRateRule{Name: "api", Path: "/api/*", Hosts: []string{"*.example.com"}, Key: "header:X-API-Key", Burst: 1, Action: config.RateActionDelay}),
+		rule(config.AppConfigRateRule{Name: "audit", Burst: 1, Action: config.RateActionLog}),
+	}))
+	e.RouteNotFound("/*", func(c echo.Context) error { return c.String(http.StatusOK, "ok") })
+
+	do := func(method string, target string, apiKey string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, nil)
+		req.RemoteAddr = "1.2.3.4:1234"
+		if apiKey != "" {
+			req.Header.Set("X-API-Key", apiKey)
+		}
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// login, burst 2
+	for i, want := range []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests} {
+		rec := do(http.MethodPost, "/login", "")
+		if rec.Code != want {
+			t.Fatalf("login #%v status = %v, want %v", i, rec.Code, want)
+		}
+		if rec.Header().Get("RateLimit-Limit") != "2" {
+			t.Errorf("login #%v RateLimit-Limit = %q, want 2", i, rec.Header().Get("RateLimit-Limit"))
+		}
+	}
+	rec := do(http.MethodPost, "/login", "")
+	if rec.Header().Get("Retry-After") != "1" || rec.Header().Get("RateLimit-Remaining") != "0" || rec.Header().Get("RateLimit-Reset") != "2" {
+		t.Errorf("deny headers = %v", rec.Header())
+	}
+	if rec.Header().Get(echo.HeaderContentType) != echo.MIMEApplicationJSON || rec.Body.String() != "null\n" {
+		t.Errorf("deny response = %q %q, want JSON null", rec.Header().Get(echo.HeaderContentType), rec.Body.String())
+	}
+	if rec := do(http.MethodGet, "/login", ""); rec.Code != http.StatusOK || rec.Header().Get("RateLimit-Limit") != "" {
+		t.Errorf("other method status = %v headers = %v, want not limited", rec.Code, rec.Header())
+	}
+	if rec := do(http.MethodPost, "/loginx", ""); rec.Code != http.StatusOK {
+		t.Errorf("other path status = %v, want %v", rec.Code, http.StatusOK)
+	}
+
+	// api, burst 1 then delayed up to 1s, per key and host
+	if rec := do(http.MethodGet, "http://a.example.com/api/users", "key-1"); rec.Code != http.StatusOK || rec.Header().Get("RateLimit-Remaining") != "0" {
+		t.Fatalf("api status = %v headers = %v", rec.Code, rec.Header())
+	}
+	start := time.Now()
+	delayed := make(chan *httptest.ResponseRecorder)
+	go func() { delayed <- do(http.MethodGet, "http://a.example.com/api/users", "key-1") }()
+
+	time.Sleep(100 * time.Millisecond)
+	if rec := do(http.MethodGet, "http://a.example.com/api/users", "key-1"); rec.Code != http.StatusTooManyRequests {
+		t.Errorf("api over delay status = %v, want %v", rec.Code, http.StatusTooManyRequests)
+	}
+	if rec := do(http.MethodGet, "http://a.example.com/api/users", "key-2"); rec.Code != http.StatusOK {
+		t.Errorf("other key status = %v, want %v", rec.Code, http.StatusOK)
+	}
+
+	if rec := <-delayed; rec.Code != http.StatusOK {
+		t.Errorf("delayed api status = %v, want %v", rec.Code, http.StatusOK)
+	}
+	if d := time.Since(start); d < 900*time.Millisecond {
+		t.Errorf("delay = %v, want about 1s", d)
+	}
+	if rec := do(http.MethodGet, "http://example.org/api/users", "key-1"); rec.Code != http.StatusOK {
+		t.Errorf("other host status = %v, want %v", rec.Code, http.StatusOK)
+	}
+}
@@ -0,0 +1,249 @@
+package middleware
+
+import (
+	"cmp"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"go-proxy/internal/config"
+	xlog "go-proxy/internal/util/utillog"
+	"math"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/time/rate"
+)
+
+// gcraScript GCRA on redis clock, KEYS[1] holds theoretical arrival time,
+// ARGV emission interval, burst tolerance and max delay, all in microseconds,
+// returns allowed, delay, remaining, reset and retry after
+var gcraScript = redis.NewScript(`
+local time = redis.call('TIME')
+local now = tonumber(time[1]) * 1000000 + tonumber(time[2])
+local interval = tonumber(ARGV[1])
+local tolerance = tonumber(ARGV[2])
+local tat = tonumber(redis.call('GET', KEYS[1])) or now
+if tat < now then
+	tat = now
+end
+local next = tat + interval
+if next - now > tolerance + tonumber(ARGV[3]) then
+	return {0, 0, 0, tat - now, next - now - tolerance}
+end
+redis.call('SET', KEYS[1], string.format('%.0f', next), 'PX', math.ceil((next - now) / 1000))
+return {1, math.max(0, next - now - tolerance), math.max(0, math.floor((tolerance - (next - now)) / interval)), next - now, 0}
+`)
+
+// rateResult state of key after request
+type rateResult struct {
+	allowed    bool
+	delay      time.Duration // wait before serving allowed request
+	remaining  int           // requests without delay
+	reset      time.Duration // until burst is fully available
+	retryAfter time.Duration // until next request is allowed, denied only
+}
+
+// rateStore counter of rate limit rule
+type rateStore interface {
+	take(key string) (rateResult, error)
+}
+
+// RateLimiterStoreConfig limits of store
+type RateLimiterStoreConfig struct {
+	Rate  rate.Limit    // requests per second
+	Burst int           // max(1, ceil(rate)) if 0
+	Delay time.Duration // max delay of requests over burst, 0 rejects them
+}
+
+// gcra limits in microseconds
+type gcra struct {
+	interval  int64 // emission interval of one request
+	tolerance int64 // burst
+	delay     int64
+}
+
+func newGCRA(cfg RateLimiterStoreConfig) gcra {
+	burst := cfg.Burst
+	if burst == 0 {
+		burst = int(math.Max(1, math.Ceil(float64(cfg.Rate))))
+	}
+	interval := int64(math.Ceil(float64(time.Second/time.Microsecond) / float64(cfg.Rate)))
+	return gcra{
+		interval:  interval,
+		tolerance: interval * int64(burst),
+		delay:     cfg.Delay.Microseconds(),
+	}
+}
+
+// take request at now with stored theoretical arrival time, returns new one, same as gcraScript
+func (x gcra) take(tat int64, now int64) (int64, rateResult) {
+	tat = max(tat, now)
+	next := tat + x.interval
+	if next-now > x.tolerance+x.delay {
+		return tat, rateResult{reset: micros(tat - now), retryAfter: micros(next - now - x.tolerance)}
+	}
+	return next, rateResult{
+		allowed:   true,
+		delay:     micros(max(0, next-now-x.tolerance)),
+		remaining: int(max(0, (x.tolerance-(next-now))/x.interval)),
+		reset:     micros(next - now),
+	}
+}
+
+func micros(v int64) time.Duration { return time.Duration(v) * time.Microsecond }
+
+// RateLimiterMemoryStore GCRA rate limiter store of one replica
+type RateLimiterMemoryStore struct {
+	gcra gcra
+	now  func() time.Time
+
+	mutex   sync.Mutex
+	tat     map[string]int64
+	cleanAt int64
+}
+
+// NewRateLimiterMemoryStore new store, idle keys are removed
+func NewRateLimiterMemoryStore(cfg RateLimiterStoreConfig) *RateLimiterMemoryStore {
+	return &RateLimiterMemoryStore{
+		gcra: newGCRA(cfg),
+		now:  time.Now,
+		tat:  map[string]int64{},
+	}
+}
+
+// Allow implements middleware.RateLimiterStore
+func (x *RateLimiterMemoryStore) Allow(identifier string) (bool, error) {
+	res, err := x.take(identifier)
+	return res.allowed && res.delay == 0, err
+}
+
+func (x *RateLimiterMemoryStore) take(key string) (rateResult, error) {
+
+	now := x.now().UnixMicro()
+
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+
+	if now >= x.cleanAt {
+		for k, v := range x.tat {
+			if v <= now {
+				delete(x.tat, k)
+			}
+		}
+		x.cleanAt = now + time.Minute.Microseconds()
+	}
+
+	tat, res := x.gcra.take(x.tat[key], now)
+	x.tat[key] = tat
+
+	return res, nil
+}
+
+// RateLimiterRedisStoreConfig limits of store, and redis failover
+type RateLimiterRedisStoreConfig struct {
+	RateLimiterStoreConfig
+	Prefix   string                  // key prefix, "rate:" if empty
+	Timeout  time.Duration           // redis call, 200ms if 0
+	Retry    time.Duration           // redis is skipped after error, 5s if 0
+	Fallback *RateLimiterMemoryStore // local store while redis is down, same limits if nil
+}
+
+// RateLimiterRedisStore rate limiter store shared by replicas,
+// requests are counted by fallback store while redis is down
+type RateLimiterRedisStore struct {
+	client   redis.Scripter
+	gcra     gcra
+	prefix   string
+	timeout  time.Duration
+	retry    time.Duration
+	fallback *RateLimiterMemoryStore
+
+	retryAt atomic.Int64 // unix nano, redis is skipped until
+	down    atomic.Bool
+}
+
+// NewRateLimiterRedisStore new store on redis client
+func NewRateLimiterRedisStore(client redis.Scripter, cfg RateLimiterRedisStoreConfig) *RateLimiterRedisStore {
+
+	fallback := cfg.Fallback
+	if fallback == nil {
+		fallback = NewRateLimiterMemoryStore(cfg.RateLimiterStoreConfig)
+	}
+
+	return &RateLimiterRedisStore{
+		client:   client,
+		gcra:     newGCRA(cfg.RateLimiterStoreConfig),
+		prefix:   cmp.Or(cfg.Prefix, "rate:"),
+		timeout:  cmp.Or(cfg.Timeout, 200*time.Millisecond),
+		retry:    cmp.Or(cfg.Retry, 5*time.Second),
+		fallback: fallback,
+	}
+}
+
+// Allow implements middleware.RateLimiterStore
+func (x *RateLimiterRedisStore) Allow(identifier string) (bool, error) {
+	res, err := x.take(identifier)
+	return res.allowed && res.delay == 0, err
+}
+
+func (x *RateLimiterRedisStore) take(key string) (rateResult, error) {
+
+	now := time.Now()
+	if now.UnixNano() < x.retryAt.Load() {
+		return x.fallback.take(key)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), x.timeout)
+	defer cancel()
+
+	res, err := gcraScript.Run(ctx, x.client, []string{x.prefix + key}, x.gcra.interval, x.gcra.tolerance, x.gcra.delay).Int64Slice()
+	if err == nil && len(res) != 5 {
+		err = fmt.Errorf("unexpected reply: %v", res)
+	}
+	if err != nil {
+		x.retryAt.Store(now.Add(x.retry).UnixNano())
+		if !x.down.Swap(true) {
+			xlog.Warn("rate store redis is down, local store is used: %v", err)
+		}
+		return x.fallback.take(key)
+	}
+	if x.down.Swap(false) {
+		xlog.Info("rate store redis is up")
+	}
+
+	return rateResult{
+		allowed:    res[0] == 1,
+		delay:      micros(res[1]),
+		remaining:  int(res[2]),
+		reset:      micros(res[3]),
+		retryAfter: micros(res[4]),
+	}, nil
+}
+
+// newRedisClient client of redis config, database index of db, fails fast to fallback store
+func newRedisClient(cfg config.Database) *redis.Client {
+
+	opts := &redis.Options{
+		Addr:            net.JoinHostPort(cfg.Host, cmp.Or(cfg.Port, "6379")),
+		Username:        cfg.User,
+		Password:        cfg.Password,
+		DB:              cfg.DB,
+		DialTimeout:     time.Second,
+		DialerRetries:   1,
+		ReadTimeout:     200 * time.Millisecond,
+		WriteTimeout:    200 * time.Millisecond,
+		MaxRetries:      -1, // fail fast, fallback to local store
+		PoolSize:        cfg.MaxOpen,
+		MaxIdleConns:    cfg.MaxIdle,
+		ConnMaxIdleTime: time.Duration(cfg.IdleTime) * time.Second,
+		DisableIdentity: true,
+	}
+	if cfg.SSL {
+		opts.TLSConfig = &tls.Config{ServerName: cfg.Host, MinVersion: tls.VersionTLS12}
+	}
+
+	return redis.NewClient(opts)
+}
@@ -0,0 +1,132 @@
+package middleware
+
+import (
+	"go-proxy/internal/config"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/labstack/echo/v4/middleware"
+)
+
+func newTestRedisStore(t *testing.T, s *miniredis.Miniredis, fallback *RateLimiterMemoryStore) *RateLimiterRedisStore {
+	client := newRedisClient(config.Database{Host: s.Host(), Port: s.Port()})
+	t.Cleanup(func() { _ = client.Close() })
+
+	return NewRateLimiterRedisStore(client, RateLimiterRedisStoreConfig{
+		RateLimiterStoreConfig: RateLimiterStoreConfig{Rate: 1, Burst: 3},
+		Retry:                  time.Millisecond,
+		Fallback:               fallback,
+	})
+}
+
+func allowN(t *testing.T, store middleware.RateLimiterStore, id string, n int) int {
+	res := 0
+	for range n {
+		ok, err := store.Allow(id)
+		if err != nil {
+			t.Fatalf("Allow() error: %v", err)
+		}
+		if ok {
+			res++
+		}
+	}
+	return res
+}
+
+func Test_RateLimiterRedisStore(t *testing.T) {
+
+	s := miniredis.RunT(t)
+	now := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	s.SetTime(now)
+
+	replica1 := newTestRedisStore(t, s, nil)
+	replica2 := newTestRedisStore(t, s, nil)
+
+	if got := allowN(t, replica1, "1.1.1.1", 2); got != 2 {
+		t.Errorf("replica1 allowed = %v, want 2", got)
+	}
+	if got := allowN(t, replica2, "1.1.1.1", 5); got != 1 {
+		t.Errorf("replica2 allowed = %v, want 1 of shared burst", got)
+	}
+	if got := allowN(t, replica2, "2.2.2.2", 5); got != 3 {
+		t.Errorf("other identifier allowed = %v, want 3", got)
+	}
+
+	if ttl := s.TTL("rate:1.1.1.1"); ttl <= 0 || ttl > 3*time.Second {
+		t.Errorf("ttl = %v, want up to burst interval", ttl)
+	}
+
+	s.SetTime(now.Add(2 * time.Second))
+	if got := allowN(t, replica1, "1.1.1.1", 5); got != 2 {
+		t.Errorf("allowed after 2s = %v, want 2", got)
+	}
+}
+
+func Test_RateLimiterRedisStore_fallback(t *testing.T) {
+
+	s := miniredis.RunT(t)
+	s.SetTime(time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC))
+
+	fallback := NewRateLimiterMemoryStore(RateLimiterStoreConfig{Rate: 1, Burst: 2})
+	store := newTestRedisStore(t, s, fallback)
+
+	if got := allowN(t, store, "1.1.1.1", 5); got != 3 {
+		t.Fatalf("allowed = %v, want 3 by redis", got)
+	}
+
+	s.Close()
+
+	if got := allowN(t, store, "1.1.1.1", 5); got != 2 {
+		t.Errorf("allowed = %v, want 2 by local store while redis is down", got)
+	}
+	if !store.down.Load() {
+		t.Errorf("store not marked down")
+	}
+
+	if err := s.Restart(); err != nil {
+		t.Fatalf("Restart() error: %v", err)
+	}
+	time.Sleep(10 * time.Millisecond) // retry
+
+	if got := allowN(t, store, "1.1.1.1", 5); got != 0 {
+		t.Errorf("allowed = %v, want 0 by redis state after restart", got)
+	}
+	if store.down.Load() {
+		t.Errorf("store still marked down")
+	}
+}
+
+func Test_RateLimiterStore_gcra(t *testing.T) {
+
+	s := miniredis.RunT(t)
+	now := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	s.SetTime(now)
+
+	client := newRedisClient(config.Database{Host: s.Host(), Port: s.Port()})
+	defer client.Close()
+
+	cfg := RateLimiterStoreConfig{Rate: 2, Burst: 2, Delay: time.Second}
+	memory := NewRateLimiterMemoryStore(cfg)
+	memory.now = func() time.Time { return now }
+	redisStore := NewRateLimiterRedisStore(client, RateLimiterRedisStoreConfig{RateLimiterStoreConfig: cfg})
+
+	want := []rateResult{
+		{allowed: true, remaining: 1, reset: 500 * time.Millisecond},
+		{allowed: true, remaining: 0, reset: time.Second},
+		{allowed: true, delay: 500 * time.Millisecond, reset: 1500 * time.Millisecond},
+		{allowed: true, delay: time.Second, reset: 2 * time.Second},
+		{allowed: false, reset: 2 * time.Second, retryAfter: 1500 * time.Millisecond},
+	}
+	for i, w := range want {
+		for name, store := range map[string]rateStore{"memory": memory, "redis": redisStore} {
+			got, err := store.take("1.1.1.1")
+			if err != nil {
+				t.Fatalf("%v take() error: %v", name, err)
+			}
+			if got != w {
+				t.Errorf("%v take() #%v = %+v, want %+v", name, i, got, w)
+			}
+		}
+	}
+}
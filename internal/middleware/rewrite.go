@@ -0,0 +1,118 @@
+package middleware
+
+import (
+	"fmt"
+	"go-proxy/internal/config"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+var (
+	rewriteRedirectStatus = []int{http.StatusMovedPermanently, http.StatusFound, http.StatusTemporaryRedirect, http.StatusPermanentRedirect}
+	rewriteGroupRe        = regexp.MustCompile(`\$(\d+)`)
+)
+
+type rewriteRule struct {
+	match    *regexp.Regexp
+	replace  string
+	query    bool
+	redirect int
+}
+
+// newRewriteRule compile rule, redirect status one of 301, 302, 307, 308
+func newRewriteRule(cfg config.AppConfigProxyRewrite) (*rewriteRule, error) {
+
+	match, err := regexp.Compile(cfg.Match)
+	if err != nil {
+		return nil, fmt.Errorf("rewrite rule %q: %w", cfg.Match, err)
+	}
+
+	if cfg.Redirect != 0 && !slices.Contains(rewriteRedirectStatus, cfg.Redirect) {
+		return nil, fmt.Errorf("rewrite rule %q: invalid redirect status %v", cfg.Match, cfg.Redirect)
+	}
+
+	return &rewriteRule{
+		match:    match,
+		replace:  cfg.Replace,
+		query:    cfg.Query,
+		redirect: cfg.Redirect,
+	}, nil
+}
+
+// newLegacyRewriteRule from "from:to" glob "/old/*:/new/$1", same as echo rewrite, matched on path with query
+func newLegacyRewriteRule(from string, to string) (*rewriteRule, error) {
+
+	k := regexp.QuoteMeta(from)
+	k = strings.ReplaceAll(k, `\*`, "(.*?)")
+	if strings.HasPrefix(k, `\^`) {
+		k = "^" + k[2:]
+	}
+
+	return newRewriteRule(config.AppConfigProxyRewrite{
+		Match:   k + "$",
+		Replace: rewriteGroupRe.ReplaceAllString(to, "$${$1}"), // "$1x" is group "1x" for regexp
+		Query:   true,
+	})
+}
+
+// apply rule to request, returns new uri and true if matched
+func (x *rewriteRule) apply(req *http.Request) (string, bool) {
+
+	src := req.URL.EscapedPath()
+	if x.query && req.URL.RawQuery != "" {
+		src += "?" + req.URL.RawQuery
+	}
+
+	m := x.match.FindStringSubmatchIndex(src)
+	if m == nil {
+		return "", false
+	}
+
+	res := string(x.match.ExpandString(nil, x.replace, src, m))
+
+	// keep original query if rule not rewrite it
+	if !x.query && req.URL.RawQuery != "" && !strings.Contains(res, "?") {
+		res += "?" + req.URL.RawQuery
+	}
+
+	return res, true
+}
+
+// rewriteRules ordered, first matched rule applied
+type rewriteRules []*rewriteRule
+
+// apply rewrite request url or redirect client, true if response sent
+func (x rewriteRules) apply(c echo.Context) (bool, error) {
+
+	req := c.Request()
+
+	for _, v := range x {
+
+		uri, ok := v.apply(req)
+		if !ok {
+			continue
+		}
+
+		if v.redirect != 0 {
+			return true, c.Redirect(v.redirect, uri)
+		}
+
+		u, err := req.URL.Parse(uri)
+		if err != nil {
+			return false, err
+		}
+
+		req.URL = u
+		if req.RequestURI != "" {
+			req.RequestURI = u.RequestURI()
+		}
+
+		return false, nil // rewrite only once
+	}
+
+	return false, nil
+}
@@ -0,0 +1,83 @@
+package middleware
+
+import (
+	"go-proxy/internal/config"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+func Test_rewriteRules_apply(t *testing.T) {
+
+	legacy, err := newLegacyRewriteRule("/old/*", "/new/$1x")
+	if err != nil {
+		t.Fatalf("newLegacyRewriteRule() error: %v", err)
+	}
+
+	rules := rewriteRules{legacy}
+	for _, v := range []config.AppConfigProxyRewrite{
+		{Match: `^/users/(\d+)$`, Replace: "/profile?id=$1"},
+		{Match: `^/users/(\w+)$`, Replace: "/by-name/$1"},
+		{Match: `^/search\?q=(\w+)$`, Replace: "/find/$1", Query: true},
+		{Match: `^/moved/(.*)$`, Replace: "https://example.com/$1", Redirect: http.StatusMovedPermanently},
+		{Match: `^/tmp/(.*)$`, Replace: "/other/$1", Redirect: http.StatusFound},
+	} {
+		rule, err := newRewriteRule(v)
+		if err != nil {
+			t.Fatalf("newRewriteRule() error: %v", err)
+		}
+		rules = append(rules, rule)
+	}
+
+	tests := []struct {
+		uri      string
+		want     string
+		status   int
+		location string
+	}{
+		{uri: "/old/a", want: "/new/ax"},
+		{uri: "/users/10", want: "/profile?id=10"},
+		{uri: "/users/bob?x=1", want: "/by-name/bob?x=1"},
+		{uri: "/search?q=go", want: "/find/go"},
+		{uri: "/search?q=go&page=2", want: "/search?q=go&page=2"},
+		{uri: "/moved/a?b=c", status: http.StatusMovedPermanently, location: "https://example.com/a?b=c"},
+		{uri: "/tmp/a", status: http.StatusFound, location: "/other/a"},
+		{uri: "/none", want: "/none"},
+	}
+
+	e := echo.New()
+	for _, tt := range tests {
+		t.Run(tt.uri, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.uri, nil)
+			rec := httptest.NewRecorder()
+			c := e.NewContext(req, rec)
+
+			sent, err := rules.apply(c)
+			if err != nil {
+				t.Fatalf("apply() error: %v", err)
+			}
+
+			if tt.status != 0 {
+				if !sent || rec.Code != tt.status || rec.Header().Get("Location") != tt.location {
+					t.Errorf("redirect = %v %v, want %v %v", rec.Code, rec.Header().Get("Location"), tt.status, tt.location)
+				}
+				return
+			}
+
+			if sent || req.URL.RequestURI() != tt.want || req.RequestURI != tt.want {
+				t.Errorf("uri = %v, want %v", req.URL.RequestURI(), tt.want)
+			}
+		})
+	}
+}
+
+func Test_newRewriteRule_errors(t *testing.T) {
+	if _, err := newRewriteRule(config.AppConfigProxyRewrite{Match: "(", Replace: "/"}); err == nil {
+		t.Errorf("expected regexp error")
+	}
+	if _, err := newRewriteRule(config.AppConfigProxyRewrite{Match: "^/a$", Replace: "/b", Redirect: 200}); err == nil {
+		t.Errorf("expected redirect status error")
+	}
+}
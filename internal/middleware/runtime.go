@@ -0,0 +1,46 @@
+package middleware
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// Runtime background tasks and upstream pools of middlewares built from one config,
+// replaced on config reload
+type Runtime struct {
+	pools   []*upstreamPool
+	maint   *maintMode // from config
+	closers []func()
+
+	closeOnce sync.Once
+}
+
+// activeRuntime runtime of handler serving requests, for sys api
+var activeRuntime atomic.Pointer[Runtime]
+
+func newRuntime() *Runtime {
+	return &Runtime{}
+}
+
+func (x *Runtime) addPool(pool *upstreamPool) {
+	x.pools = append(x.pools, pool)
+}
+
+// onClose add func to stop background task
+func (x *Runtime) onClose(fn func()) {
+	x.closers = append(x.closers, fn)
+}
+
+// Activate make runtime current, returns previous runtime or nil
+func (x *Runtime) Activate() *Runtime {
+	return activeRuntime.Swap(x)
+}
+
+// Close stop background tasks, in-flight requests are served until done
+func (x *Runtime) Close() {
+	x.closeOnce.Do(func() {
+		for _, fn := range x.closers {
+			fn()
+		}
+	})
+}
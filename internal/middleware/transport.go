@@ -0,0 +1,128 @@
+package middleware
+
+import (
+	"cmp"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"go-proxy/internal/config"
+	"go-proxy/internal/util/utiltls"
+	"net"
+	"net/http"
+	"os"
+	"time"
+)
+
+// newUpstreamTLSConfig client TLS config of upstream servers, nil if cfg is empty
+func newUpstreamTLSConfig(cfg config.AppConfigProxyTLS) (*tls.Config, error) {
+
+	if cfg == (config.AppConfigProxyTLS{}) {
+		return nil, nil
+	}
+
+	res := &tls.Config{
+		ServerName:         cfg.ServerName,
+		InsecureSkipVerify: cfg.InsecureSkipVerify, //nolint:gosec // dev only, checked by config
+	}
+
+	var err error
+	if res.MinVersion, err = utiltls.ParseVersion(cfg.MinVersion); err != nil {
+		return nil, fmt.Errorf("upstream tls min version: %w", err)
+	}
+
+	if cfg.CA != "" {
+		data, err := os.ReadFile(cfg.CA)
+		if err != nil {
+			return nil, fmt.Errorf("upstream tls ca: %w", err)
+		}
+		res.RootCAs = x509.NewCertPool()
+		if !res.RootCAs.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("upstream tls ca: no certificates in %v", cfg.CA)
+		}
+	}
+
+	if cfg.Cert != "" || cfg.Key != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.Cert, cfg.Key)
+		if err != nil {
+			return nil, fmt.Errorf("upstream tls client cert: %w", err)
+		}
+		res.Certificates = []tls.Certificate{cert}
+	}
+
+	return res, nil
+}
+
+// mergeTransport zero values of route transport from defaults of http_transport
+func mergeTransport(route config.AppConfigHTTPTransport, defaults config.AppConfigHTTPTransport) config.AppConfigHTTPTransport {
+	return config.AppConfigHTTPTransport{
+		MaxIdleConns:          cmp.Or(route.MaxIdleConns, defaults.MaxIdleConns),
+		MaxIdleConnsPerHost:   cmp.Or(route.MaxIdleConnsPerHost, defaults.MaxIdleConnsPerHost),
+		IdleConnTimeout:       cmp.Or(route.IdleConnTimeout, defaults.IdleConnTimeout),
+		MaxConnsPerHost:       cmp.Or(route.MaxConnsPerHost, defaults.MaxConnsPerHost),
+		DialTimeout:           cmp.Or(route.DialTimeout, defaults.DialTimeout),
+		KeepAlive:             cmp.Or(route.KeepAlive, defaults.KeepAlive),
+		ResponseHeaderTimeout: cmp.Or(route.ResponseHeaderTimeout, defaults.ResponseHeaderTimeout),
+		TLSHandshakeTimeout:   cmp.Or(route.TLSHandshakeTimeout, defaults.TLSHandshakeTimeout),
+		DisableKeepAlives:     cmp.Or(route.DisableKeepAlives, defaults.DisableKeepAlives),
+		DisableHTTP2:          cmp.Or(route.DisableHTTP2, defaults.DisableHTTP2),
+	}
+}
+
+// newUpstreamTransport own transport of upstream, zero values of cfg are defaults of http.DefaultTransport
+func newUpstreamTransport(cfg config.AppConfigHTTPTransport, tlsCfg config.AppConfigProxyTLS) (*http.Transport, error) {
+
+	tlsConfig, err := newUpstreamTLSConfig(tlsCfg)
+	if err != nil {
+		return nil, err
+	}
+
+	base, ok := http.DefaultTransport.(*http.Transport)
+	if !ok {
+		return nil, fmt.Errorf("http.DefaultTransport is not *http.Transport")
+	}
+
+	res := base.Clone()
+	res.TLSClientConfig = tlsConfig
+
+	second := func(v int) time.Duration { return time.Duration(v) * time.Second }
+
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second, // as http.DefaultTransport
+		KeepAlive: 30 * time.Second,
+	}
+	if cfg.DialTimeout > 0 {
+		dialer.Timeout = second(cfg.DialTimeout)
+	}
+	if cfg.KeepAlive != 0 {
+		dialer.KeepAlive = second(cfg.KeepAlive) // negative is disabled
+	}
+	res.DialContext = dialer.DialContext
+
+	if cfg.MaxIdleConns > 0 {
+		res.MaxIdleConns = cfg.MaxIdleConns
+	}
+	if cfg.MaxIdleConnsPerHost > 0 {
+		res.MaxIdleConnsPerHost = cfg.MaxIdleConnsPerHost
+	}
+	if cfg.IdleConnTimeout > 0 {
+		res.IdleConnTimeout = second(cfg.IdleConnTimeout)
+	}
+	if cfg.MaxConnsPerHost > 0 {
+		res.MaxConnsPerHost = cfg.MaxConnsPerHost
+	}
+	if cfg.ResponseHeaderTimeout > 0 {
+		res.ResponseHeaderTimeout = second(cfg.ResponseHeaderTimeout)
+	}
+	if cfg.TLSHandshakeTimeout > 0 {
+		res.TLSHandshakeTimeout = second(cfg.TLSHandshakeTimeout)
+	}
+
+	res.DisableKeepAlives = cfg.DisableKeepAlives != nil && *cfg.DisableKeepAlives
+
+	if cfg.DisableHTTP2 != nil && *cfg.DisableHTTP2 {
+		res.ForceAttemptHTTP2 = false
+		res.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{} // non-nil disables h2
+	}
+
+	return res, nil
+}
@@ -0,0 +1,258 @@
+package middleware
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"go-proxy/internal/config"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// writePEM write blocks to file in dir, return path
+func writePEM(t *testing.T, dir string, name string, blocks ...*pem.Block) string {
+	t.Helper()
+
+	data := []byte{}
+	for _, v := range blocks {
+		data = append(data, pem.EncodeToMemory(v)...)
+	}
+
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+// writeClientPair self-signed client cert and key files
+func writeClientPair(t *testing.T, dir string, cn string) (certFile string, keyFile string, cert *x509.Certificate) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(2),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	data, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert, err = x509.ParseCertificate(data); err != nil {
+		t.Fatal(err)
+	}
+
+	keyData, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile = writePEM(t, dir, cn+".pem", &pem.Block{Type: "CERTIFICATE", Bytes: data})
+	keyFile = writePEM(t, dir, cn+".key", &pem.Block{Type: "PRIVATE KEY", Bytes: keyData})
+
+	return certFile, keyFile, cert
+}
+
+func Test_newUpstreamTLSConfig(t *testing.T) {
+
+	if cfg, err := newUpstreamTLSConfig(config.AppConfigProxyTLS{}); cfg != nil || err != nil {
+		t.Errorf("empty config = %v, %v, want nil", cfg, err)
+	}
+
+	cfg, err := newUpstreamTLSConfig(config.AppConfigProxyTLS{ServerName: "backend.internal", MinVersion: "1.3"})
+	if err != nil {
+		t.Fatalf("newUpstreamTLSConfig() error: %v", err)
+	}
+	if cfg.ServerName != "backend.internal" || cfg.MinVersion != tls.VersionTLS13 || cfg.RootCAs != nil {
+		t.Errorf("unexpected config %+v", cfg)
+	}
+
+	dir := t.TempDir()
+	bad := writePEM(t, dir, "bad.pem", &pem.Block{Type: "CERTIFICATE", Bytes: []byte("qwe")})
+
+	for _, v := range []config.AppConfigProxyTLS{
+		{MinVersion: "1.4"},
+		{CA: filepath.Join(dir, "missing.pem")},
+		{CA: filepath.Join(dir, "bad.pem")},
+		{Cert: bad, Key: bad},
+	} {
+		if _, err := newUpstreamTLSConfig(v); err == nil {
+			t.Errorf("expected error for %+v", v)
+		}
+	}
+}
+
+func Test_proxyUpstream_tls(t *testing.T) {
+
+	dir := t.TempDir()
+	clientCert, clientKey, client := writeClientPair(t, dir, "proxy")
+
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, r.TLS.PeerCertificates[0].Subject.CommonName)
+	}))
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(client)
+	backend.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	backend.StartTLS()
+	defer backend.Close()
+
+	// httptest cert is valid for example.com and 127.0.0.1
+	ca := writePEM(t, dir, "ca.pem", &pem.Block{Type: "CERTIFICATE", Bytes: backend.Certificate().Raw})
+
+	tests := []struct {
+		name   string
+		tls    *config.AppConfigProxyTLS
+		status int
+	}{
+		{name: "unknown authority", tls: nil, status: http.StatusBadGateway},
+		{name: "no client cert", tls: &config.AppConfigProxyTLS{CA: ca}, status: http.StatusBadGateway},
+		{name: "ca and client cert", tls: &config.AppConfigProxyTLS{CA: ca, Cert: clientCert, Key: clientKey}, status: http.StatusOK},
+		{name: "server name", tls: &config.AppConfigProxyTLS{CA: ca, Cert: clientCert, Key: clientKey, ServerName: "example.com"}, status: http.StatusOK},
+		{name: "wrong server name", tls: &config.AppConfigProxyTLS{CA: ca, Cert: clientCert, Key: clientKey, ServerName: "other.com"}, status: http.StatusBadGateway},
+		{name: "insecure", tls: &config.AppConfigProxyTLS{InsecureSkipVerify: true, Cert: clientCert, Key: clientKey}, status: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			trg, err := newProxyUpstream(config.AppConfigProxyRoute{
+				Prefix:  "/*",
+				Servers: []config.AppConfigProxyServer{{URL: backend.URL}},
+				TLS:     tt.tls,
+			}, config.NewAppConfig().Proxy, config.AppConfigHTTPTransport{})
+			if err != nil {
+				t.Fatalf("newProxyUpstream() error: %v", err)
+			}
+			if err := trg.build(); err != nil {
+				t.Fatalf("build() error: %v", err)
+			}
+			defer trg.transport.CloseIdleConnections()
+
+			e := echo.New()
+			e.RouteNotFound("/*", trg.handler)
+
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+
+			if rec.Code != tt.status {
+				t.Fatalf("status = %v, want %v", rec.Code, tt.status)
+			}
+			if rec.Code == http.StatusOK && rec.Body.String() != "proxy" {
+				t.Errorf("backend client cert = %q, want %q", rec.Body.String(), "proxy")
+			}
+		})
+	}
+}
+
+func Test_newUpstreamTransport(t *testing.T) {
+
+	defaults := config.AppConfigHTTPTransport{MaxIdleConns: 100, MaxConnsPerHost: 50, DialTimeout: 5}
+	route := config.AppConfigHTTPTransport{MaxConnsPerHost: 10, ResponseHeaderTimeout: 15, DisableHTTP2: new(true)}
+
+	cfg := mergeTransport(route, defaults)
+	if cfg.MaxIdleConns != 100 || cfg.MaxConnsPerHost != 10 || cfg.DialTimeout != 5 || cfg.ResponseHeaderTimeout != 15 || !*cfg.DisableHTTP2 {
+		t.Errorf("mergeTransport() = %+v", cfg)
+	}
+
+	tr, err := newUpstreamTransport(cfg, config.AppConfigProxyTLS{})
+	if err != nil {
+		t.Fatalf("newUpstreamTransport() error: %v", err)
+	}
+	if tr == http.DefaultTransport {
+		t.Fatalf("newUpstreamTransport() returned shared transport")
+	}
+	if tr.MaxIdleConns != 100 || tr.MaxConnsPerHost != 10 || tr.ResponseHeaderTimeout != 15*time.Second {
+		t.Errorf("unexpected transport limits %+v", tr)
+	}
+	if tr.ForceAttemptHTTP2 || tr.TLSNextProto == nil {
+		t.Errorf("http2 not disabled")
+	}
+
+	// defaults of http.DefaultTransport kept, shared transport not changed
+	def := http.DefaultTransport.(*http.Transport)
+	if tr.IdleConnTimeout != def.IdleConnTimeout || def.MaxConnsPerHost != 0 {
+		t.Errorf("unexpected idle timeout %v, default max conns %v", tr.IdleConnTimeout, def.MaxConnsPerHost)
+	}
+
+	tr, err = newUpstreamTransport(config.AppConfigHTTPTransport{}, config.AppConfigProxyTLS{})
+	if err != nil {
+		t.Fatalf("newUpstreamTransport() error: %v", err)
+	}
+	if !tr.ForceAttemptHTTP2 {
+		t.Errorf("http2 disabled by default")
+	}
+
+	// route turns off options enabled by defaults
+	defaults = config.AppConfigHTTPTransport{DisableKeepAlives: new(true), DisableHTTP2: new(true)}
+	route = config.AppConfigHTTPTransport{DisableKeepAlives: new(false), DisableHTTP2: new(false)}
+
+	tr, err = newUpstreamTransport(mergeTransport(route, defaults), config.AppConfigProxyTLS{})
+	if err != nil {
+		t.Fatalf("newUpstreamTransport() error: %v", err)
+	}
+	if tr.DisableKeepAlives || !tr.ForceAttemptHTTP2 {
+		t.Errorf("route override of disabled keep-alives and http2 not applied")
+	}
+}
+
+func Test_proxyUpstream_responseHeaderTimeout(t *testing.T) {
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			time.Sleep(1500 * time.Millisecond)
+		}
+		_, _ = io.WriteString(w, "ok")
+	}))
+	defer backend.Close()
+
+	trg, err := newProxyUpstream(config.AppConfigProxyRoute{
+		Prefix:    "/*",
+		Servers:   []config.AppConfigProxyServer{{URL: backend.URL}},
+		Transport: &config.AppConfigHTTPTransport{ResponseHeaderTimeout: 1},
+	}, config.NewAppConfig().Proxy, config.AppConfigHTTPTransport{MaxConnsPerHost: 5})
+	if err != nil {
+		t.Fatalf("newProxyUpstream() error: %v", err)
+	}
+	if err := trg.build(); err != nil {
+		t.Fatalf("build() error: %v", err)
+	}
+	defer trg.transport.CloseIdleConnections()
+
+	if trg.transport.MaxConnsPerHost != 5 {
+		t.Errorf("max conns per host = %v, want default 5", trg.transport.MaxConnsPerHost)
+	}
+
+	e := echo.New()
+	e.RouteNotFound("/*", trg.handler)
+
+	for path, status := range map[string]int{"/": http.StatusOK, "/slow": http.StatusBadGateway} {
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		if rec.Code != status {
+			t.Errorf("%v status = %v, want %v", path, rec.Code, status)
+		}
+	}
+}
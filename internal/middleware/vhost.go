@@ -0,0 +1,138 @@
+package middleware
+
+import (
+	"cmp"
+	"go-proxy/internal/config"
+	xlog "go-proxy/internal/util/utillog"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// requestHost lower case host without port
+func requestHost(r *http.Request) string {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(host)
+}
+
+// matchHost pattern "example.com", "*.example.com" (any subdomain) or empty (any host)
+func matchHost(pattern string, host string) bool {
+	switch {
+	case pattern == "":
+		return true
+	case strings.HasPrefix(pattern, "*."):
+		return strings.HasSuffix(host, pattern[1:])
+	}
+	return pattern == host
+}
+
+// compareHost order of patterns, exact first, then longer wildcard, then any host
+func compareHost(a string, b string) int {
+	rank := func(pattern string) int {
+		switch {
+		case pattern == "":
+			return 0
+		case strings.HasPrefix(pattern, "*."):
+			return 1
+		}
+		return 2
+	}
+	if c := cmp.Compare(rank(b), rank(a)); c != 0 {
+		return c
+	}
+	return cmp.Compare(len(b), len(a))
+}
+
+type virtualHost struct {
+	host string // pattern
+	cfg  *config.AppConfigVirtualHost
+}
+
+// virtualHosts lookup of virtual host config by request host
+type virtualHosts []virtualHost
+
+func newVirtualHosts(items []config.AppConfigVirtualHost) virtualHosts {
+
+	res := virtualHosts{}
+
+	for i := range items {
+		for _, host := range items[i].Hosts {
+			res = append(res, virtualHost{host: strings.ToLower(host), cfg: &items[i]})
+		}
+	}
+
+	slices.SortStableFunc(res, func(a, b virtualHost) int {
+		return compareHost(a.host, b.host)
+	})
+
+	return res
+}
+
+// find virtual host of request, nil if not found
+func (x virtualHosts) find(r *http.Request) *config.AppConfigVirtualHost {
+
+	if len(x) == 0 {
+		return nil
+	}
+
+	host := requestHost(r)
+	for _, v := range x {
+		if matchHost(v.host, host) {
+			return v.cfg
+		}
+	}
+
+	return nil
+}
+
+// redirectSkipper skip redirect if disabled for virtual host of request, global value by default
+func (x virtualHosts) redirectSkipper(global bool, value func(vh *config.AppConfigVirtualHost) *bool) func(c echo.Context) bool {
+	return func(c echo.Context) bool {
+		if vh := x.find(c.Request()); vh != nil {
+			if v := value(vh); v != nil {
+				return !*v
+			}
+		}
+		return !global
+	}
+}
+
+// anyRedirect true if global or any virtual host enables redirect
+func (x virtualHosts) anyRedirect(global bool, value func(vh *config.AppConfigVirtualHost) *bool) bool {
+	if global {
+		return true
+	}
+	for _, v := range x {
+		if p := value(v.cfg); p != nil && *p {
+			return true
+		}
+	}
+	return false
+}
+
+// newVirtualHostRedirect redirect all requests of virtual host with "redirect_to"
+func newVirtualHostRedirect(vhosts virtualHosts) echo.MiddlewareFunc {
+
+	for _, v := range vhosts {
+		if v.cfg.RedirectTo != "" {
+			xlog.Info("virtual host redirect: %v => %v", v.host, v.cfg.RedirectTo)
+		}
+	}
+
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if vh := vhosts.find(c.Request()); vh != nil && vh.RedirectTo != "" {
+				return c.Redirect(http.StatusMovedPermanently,
+					strings.TrimSuffix(vh.RedirectTo, "/")+c.Request().RequestURI,
+				)
+			}
+			return next(c)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package middleware
+
+import (
+	"go-proxy/internal/config"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func Test_matchHost(t *testing.T) {
+	tests := []struct {
+		pattern string
+		host    string
+		want    bool
+	}{
+		{pattern: "", host: "example.com", want: true},
+		{pattern: "example.com", host: "example.com", want: true},
+		{pattern: "example.com", host: "www.example.com", want: false},
+		{pattern: "*.example.com", host: "www.example.com", want: true},
+		{pattern: "*.example.com", host: "a.b.example.com", want: true},
+		{pattern: "*.example.com", host: "example.com", want: false},
+		{pattern: "*.example.com", host: "badexample.com", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.pattern+" "+tt.host, func(t *testing.T) {
+			if got := matchHost(tt.pattern, tt.host); got != tt.want {
+				t.Errorf("matchHost() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_virtualHosts_find(t *testing.T) {
+
+	vhosts := newVirtualHosts([]config.AppConfigVirtualHost{
+		{Hosts: []string{"*.example.com"}, RedirectTo: "wildcard"},
+		{Hosts: []string{"*.api.example.com"}, RedirectTo: "api"},
+		{Hosts: []string{"WWW.example.com", "example.com"}, RedirectTo: "exact"},
+	})
+
+	tests := []struct {
+		host string
+		want string
+	}{
+		{host: "example.com", want: "exact"},
+		{host: "www.example.com:8443", want: "exact"},
+		{host: "shop.example.com", want: "wildcard"},
+		{host: "v1.api.example.com", want: "api"},
+		{host: "other.com", want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Host = tt.host
+			got := ""
+			if vh := vhosts.find(req); vh != nil {
+				got = vh.RedirectTo
+			}
+			if got != tt.want {
+				t.Errorf("find() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -6,22 +6,25 @@ import (
 	"github.com/labstack/echo/v4"
 
 	"go-proxy/internal/config/consts"
+	xmiddleware "go-proxy/internal/middleware"
 
 	"go-proxy/internal/service"
 
 	xlog "go-proxy/internal/util/utillog"
+	"go-proxy/internal/util/utilnet"
 
 	"github.com/labstack/echo-contrib/echoprometheus"
 	"github.com/labstack/echo/v4/middleware"
 )
 
+// Init app routes, rebuilt on config reload
 func Init(e *echo.Echo, appService service.AppService) {
 
 	initDebugController(e, appService)
-
-	initSys(e, appService)
 }
-func initSys(e *echo.Echo, appService service.AppService) {
+
+// InitSys sys api routes, once on start, serve in main listener or in own listener
+func InitSys(e *echo.Echo, appService service.AppService) {
 
 	// !!! DANGER for private(non-public) services only
 	// or use non-public port via echo.New()
@@ -31,7 +34,10 @@ func initSys(e *echo.Echo, appService service.AppService) {
 	listen := appConfig.HTTPServer.Listen
 	listenSys := appConfig.HTTPServer.ListenSys
 	sysMetrics := appConfig.HTTPServer.SysMetrics
-	hasAnyService := sysMetrics
+	sysUpstreams := appConfig.HTTPServer.SysUpstreams
+	sysReload := appConfig.HTTPServer.SysReload
+	sysMaint := appConfig.HTTPServer.SysMaint
+	hasAnyService := sysMetrics || sysUpstreams || sysReload || sysMaint
 	sysAPIKey := appConfig.HTTPServer.SysAPIKey
 	hasAPIKey := sysAPIKey != ""
 	hasListenSys := listenSys != ""
@@ -77,12 +83,73 @@ func initSys(e *echo.Echo, appService service.AppService) {
 
 	}
 
+	if sysUpstreams {
+		e.GET(
+			consts.PathSysUpstreamsAPI,
+			func(c echo.Context) error { return c.JSON(http.StatusOK, xmiddleware.UpstreamsStatus()) },
+			sysAPIAccessAuthMW,
+		) // upstream targets health and ejection state
+	}
+
+	if sysReload {
+		e.POST(
+			consts.PathSysReloadAPI,
+			func(c echo.Context) error {
+				if err := appService.Reload(); err != nil {
+					return c.JSON(http.StatusUnprocessableEntity, map[string]string{"error": err.Error()})
+				}
+				return c.JSON(http.StatusOK, struct{}{})
+			},
+			sysAPIAccessAuthMW,
+		) // reload config, invalid config rejected
+	}
+
+	if sysMaint {
+		e.GET(
+			consts.PathSysMaintAPI,
+			func(c echo.Context) error { return c.JSON(http.StatusOK, xmiddleware.GetMaint()) },
+			sysAPIAccessAuthMW,
+		)
+		e.POST(
+			consts.PathSysMaintAPI,
+			func(c echo.Context) error {
+				mode := xmiddleware.MaintMode{}
+				if err := c.Bind(&mode); err != nil {
+					return err
+				}
+				if err := xmiddleware.SetMaint(mode); err != nil {
+					return c.JSON(http.StatusUnprocessableEntity, map[string]string{"error": err.Error()})
+				}
+				return c.JSON(http.StatusOK, xmiddleware.GetMaint())
+			},
+			sysAPIAccessAuthMW,
+		) // switch maintenance mode, kept on config reload
+		e.DELETE(
+			consts.PathSysMaintAPI,
+			func(c echo.Context) error {
+				xmiddleware.ResetMaint()
+				return c.JSON(http.StatusOK, xmiddleware.GetMaint())
+			},
+			sysAPIAccessAuthMW,
+		) // back to maintenance mode from config
+	}
+
 	if startNewListener {
 
 		// start as async task
 		go func() {
 			xlog.Info("sys api serve on: %v main: %v", listenSys, listen)
 
+			if pp := appConfig.HTTPServer.ProxyProtocol; pp.ListenSys {
+				l, err := utilnet.Listen(listenSys, true, pp.Trusted)
+				if err != nil {
+					xlog.Error("%v", err)
+					return
+				}
+				xlog.Info("sys api PROXY protocol, trusted: %v", pp.Trusted)
+				e.Listener = l
+			}
+
 			if err := e.Start(listenSys); err != nil {
 				if err != http.ErrServerClosed {
 					xlog.Error("%v", err)
@@ -93,7 +160,8 @@ func initSys(e *echo.Echo, appService service.AppService) {
 		}()
 
 	} else {
-		xlog.Info("sys api server serve on main listener: %v", listen)
+		// outside of reloadable handler, maintenance can be switched off in maintenance mode
+		xlog.Warn("sys api serve on main listener: %v, without maintenance, geo ip and rate limit middlewares", listen)
 	}
 
 }
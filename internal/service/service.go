@@ -3,51 +3,42 @@ package service
 import (
 	"go-proxy/internal/config"
 	"os"
-
-	"time"
+	"slices"
+	"sync"
 
 	xlog "go-proxy/internal/util/utillog"
-	"net/http"
 )
 
 // AppService all services
 type AppService interface {
 	Config() *config.AppConfig
+	// Reload read config again, apply by reload handlers, keep current config on error
+	Reload() error
+	// OnReload add handler to prepare reloaded config
+	OnReload(handler ReloadHandler)
 	// Logger() logger.AppLogger
 }
-type defaultAppService struct {
-	configSource *config.AppConfigSource
-}
-
-func mustConfigRuntime(appConfig *config.AppConfig) {
-	t, ok := http.DefaultTransport.(*http.Transport)
 
-	if ok {
-		x := appConfig.HTTPTransport
+// ReloadHandler prepare state of reloaded config from app service with new config,
+// returns commit to apply prepared state, rollback to discard it if other handler rejects config,
+// or error to reject config
+type ReloadHandler func(appService AppService) (commit func(), rollback func(), err error)
 
-		if x.MaxIdleConns > 0 {
-			xlog.Info("set Http.Transport.MaxIdleConns=%v", x.MaxIdleConns)
-			t.MaxIdleConns = x.MaxIdleConns
-		}
-		if x.IdleConnTimeout > 0 {
-			xlog.Info("set Http.Transport.IdleConnTimeout=%v", x.IdleConnTimeout)
-			t.IdleConnTimeout = time.Duration(x.IdleConnTimeout) * time.Second
-		}
-		if x.MaxConnsPerHost > 0 {
-			xlog.Info("set Http.Transport.MaxConnsPerHost=%v", x.MaxConnsPerHost)
-			t.MaxConnsPerHost = x.MaxConnsPerHost
-		}
+type defaultAppService struct {
+	configSource *config.AppConfigSource
 
-		if x.MaxIdleConnsPerHost > 0 {
-			xlog.Info("set Http.Transport.MaxIdleConnsPerHost=%v", x.MaxIdleConnsPerHost)
-			t.MaxIdleConnsPerHost = x.MaxIdleConnsPerHost
-		}
+	reloadMutex    sync.Mutex
+	reloadHandlers []ReloadHandler
+}
 
-	} else {
-		xlog.Error("cannot init http.Transport")
-	}
+// configAppService app service with reloaded config, not yet applied
+type configAppService struct {
+	AppService
+	config *config.AppConfig
 }
 
+func (x *configAppService) Config() *config.AppConfig { return x.config }
+
 func (x *defaultAppService) mustConfig() {
 
 	d, _ := os.Getwd()
@@ -56,9 +47,7 @@ func (x *defaultAppService) mustConfig() {
 
 	x.configSource = config.MustNewAppConfigSource()
 
-	appConfig := x.Config() // first call, init
-
-	mustConfigRuntime(appConfig)
+	_ = x.Config() // first call, init
 
 }
 
@@ -82,3 +71,62 @@ func MustNewAppServiceProdNewAppServiceTesting() AppService {
 }
 
 func (x *defaultAppService) Config() *config.AppConfig { return x.configSource.Config() }
+
+func (x *defaultAppService) OnReload(handler ReloadHandler) {
+	x.reloadMutex.Lock()
+	defer x.reloadMutex.Unlock()
+
+	x.reloadHandlers = append(x.reloadHandlers, handler)
+}
+
+func (x *defaultAppService) Reload() error {
+
+	x.reloadMutex.Lock()
+	defer x.reloadMutex.Unlock()
+
+	xlog.Info("reloading config")
+
+	appConfig, err := x.configSource.Read()
+	if err != nil {
+		xlog.Error("reload config rejected: %v", err)
+		return err
+	}
+
+	next := &configAppService{AppService: x, config: appConfig}
+
+	commits := []func(){}
+	rollbacks := []func(){}
+	for _, handler := range x.reloadHandlers {
+		commit, rollback, err := handler(next)
+		if err != nil {
+			// discard state of prepared handlers, last first
+			for _, v := range slices.Backward(rollbacks) {
+				v()
+			}
+			xlog.Error("reload config rejected: %v", err)
+			return err
+		}
+		if commit != nil {
+			commits = append(commits, commit)
+		}
+		if rollback != nil {
+			rollbacks = append(rollbacks, rollback)
+		}
+	}
+
+	prev := x.configSource.Config()
+	x.configSource.Set(appConfig)
+
+	for _, commit := range commits {
+		commit()
+	}
+
+	diff := prev.Diff(appConfig)
+	for _, v := range diff {
+		xlog.Info("config changed: %v", v)
+	}
+
+	xlog.Info("config reloaded, changes: %v", len(diff))
+
+	return nil
+}
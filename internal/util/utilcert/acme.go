@@ -0,0 +1,164 @@
+package utilcert
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+const (
+	ChallengeTLSALPN = "tls-alpn-01" // on TLS listener
+	ChallengeHTTP    = "http-01"     // on plain listener
+)
+
+// LetsEncryptStagingURL directory of Let's Encrypt staging, untrusted certs for tests
+const LetsEncryptStagingURL = "https://acme-staging-v02.api.letsencrypt.org/directory"
+
+// ACMEOptions account and CA of automatic certificates
+type ACMEOptions struct {
+	DirectoryURL string        // Let's Encrypt if empty
+	CA           string        // PEM file of roots of directory url, system roots if empty
+	Email        string        // account contact
+	EABKeyID     string        // external account binding key id
+	EABHMACKey   string        // external account binding base64url HMAC key
+	RenewBefore  time.Duration // before expiry, 30 days if zero
+	Challenge    string        // tls-alpn-01 or http-01
+}
+
+// ConfigureACME set up manager of hosts with certs cached in dir
+func ConfigureACME(m *autocert.Manager, dir string, hosts []string, opts ACMEOptions) error {
+
+	m.Prompt = autocert.AcceptTOS
+	m.HostPolicy = autocert.HostWhitelist(hosts...)
+	m.Cache = autocert.DirCache(dir)
+	m.Email = opts.Email
+	m.RenewBefore = opts.RenewBefore
+
+	if opts.EABKeyID != "" || opts.EABHMACKey != "" {
+		key, err := decodeEABKey(opts.EABHMACKey)
+		if err != nil {
+			return fmt.Errorf("acme eab hmac key: %w", err)
+		}
+		m.ExternalAccountBinding = &acme.ExternalAccountBinding{KID: opts.EABKeyID, Key: key}
+	}
+
+	base, ok := http.DefaultTransport.(*http.Transport)
+	if !ok {
+		return fmt.Errorf("http.DefaultTransport is not *http.Transport")
+	}
+	transport := base.Clone()
+
+	if opts.CA != "" {
+		data, err := os.ReadFile(opts.CA)
+		if err != nil {
+			return fmt.Errorf("acme ca: %w", err)
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(data) {
+			return fmt.Errorf("acme ca: no certificates in %v", opts.CA)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: roots}
+	}
+
+	var rt http.RoundTripper = transport
+
+	switch opts.Challenge {
+	case "", ChallengeTLSALPN:
+	case ChallengeHTTP:
+		// autocert tries tls-alpn-01 first, not offered challenge is skipped
+		rt = &challengeFilter{next: transport, drop: ChallengeTLSALPN}
+		m.HTTPHandler(nil) // enable http-01, challenges served on plain listener
+	default:
+		return fmt.Errorf("acme challenge %q not one of %v", opts.Challenge, []string{ChallengeTLSALPN, ChallengeHTTP})
+	}
+
+	m.Client = &acme.Client{
+		DirectoryURL: opts.DirectoryURL,
+		HTTPClient:   &http.Client{Transport: rt},
+	}
+
+	return nil
+}
+
+// decodeEABKey base64url key of CA, padding optional
+func decodeEABKey(value string) ([]byte, error) {
+	if value == "" {
+		return nil, fmt.Errorf("key is empty")
+	}
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(value, "="))
+}
+
+// challengeFilter remove challenges of type drop from authorizations of CA
+type challengeFilter struct {
+	next http.RoundTripper
+	drop string
+}
+
+func (x *challengeFilter) RoundTrip(req *http.Request) (*http.Response, error) {
+
+	resp, err := x.next.RoundTrip(req)
+	if err != nil || resp.StatusCode != http.StatusOK || !strings.HasPrefix(resp.Header.Get("Content-Type"), "application/json") {
+		return resp, err
+	}
+
+	data, err := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	data = x.filter(data)
+
+	resp.Body = io.NopCloser(bytes.NewReader(data))
+	resp.ContentLength = int64(len(data))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(data)))
+
+	return resp, nil
+}
+
+// filter challenges of authorization json, other json not changed
+func (x *challengeFilter) filter(data []byte) []byte {
+
+	obj := map[string]json.RawMessage{}
+	if err := json.Unmarshal(data, &obj); err != nil || obj["challenges"] == nil {
+		return data
+	}
+
+	challenges := []json.RawMessage{}
+	if err := json.Unmarshal(obj["challenges"], &challenges); err != nil {
+		return data
+	}
+
+	challenges = slices.DeleteFunc(challenges, func(v json.RawMessage) bool {
+		var chal struct {
+			Type string `json:"type"`
+		}
+		return json.Unmarshal(v, &chal) == nil && chal.Type == x.drop
+	})
+
+	value, err := json.Marshal(challenges)
+	if err != nil {
+		return data
+	}
+	obj["challenges"] = value
+
+	res, err := json.Marshal(obj)
+	if err != nil {
+		return data
+	}
+
+	return res
+}
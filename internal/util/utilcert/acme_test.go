@@ -0,0 +1,257 @@
+package utilcert
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// acmeStandIn minimal ACME CA: directory, nonces, accounts with EAB and one authorization
+type acmeStandIn struct {
+	server  *httptest.Server
+	eabKID  string
+	eabKey  []byte
+	contact []string
+	eabOK   bool
+}
+
+type jws struct {
+	Protected string `json:"protected"`
+	Payload   string `json:"payload"`
+	Signature string `json:"signature"`
+}
+
+func newACMEStandIn(t *testing.T) *acmeStandIn {
+	t.Helper()
+
+	res := &acmeStandIn{eabKID: "kid-1", eabKey: []byte("0123456789abcdef0123456789abcdef")}
+
+	mux := http.NewServeMux()
+	url := func(path string) string { return res.server.URL + path }
+
+	mux.HandleFunc("/directory", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"newNonce":   url("/new-nonce"),
+			"newAccount": url("/new-account"),
+			"newOrder":   url("/new-order"),
+			"meta":       map[string]any{"externalAccountRequired": true},
+		})
+	})
+	mux.HandleFunc("/new-nonce", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Replay-Nonce", fmt.Sprint(time.Now().UnixNano()))
+	})
+	mux.HandleFunc("/new-account", func(w http.ResponseWriter, r *http.Request) {
+		var req jws
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		payload, _ := base64.RawURLEncoding.DecodeString(req.Payload)
+
+		var account struct {
+			Contact            []string `json:"contact"`
+			OnlyReturnExisting bool     `json:"onlyReturnExisting"`
+			EAB                *jws     `json:"externalAccountBinding"`
+		}
+		_ = json.Unmarshal(payload, &account)
+
+		if !account.OnlyReturnExisting {
+			res.contact = account.Contact
+			res.eabOK = res.verifyEAB(account.EAB, url("/new-account"))
+			if !res.eabOK {
+				w.Header().Set("Content-Type", "application/problem+json")
+				w.WriteHeader(http.StatusUnauthorized)
+				_, _ = io.WriteString(w, `{"type":"urn:ietf:params:acme:error:externalAccountRequired","detail":"eab"}`)
+				return
+			}
+		}
+
+		w.Header().Set("Replay-Nonce", fmt.Sprint(time.Now().UnixNano()))
+		w.Header().Set("Location", url("/account/1"))
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		_ = json.NewEncoder(w).Encode(map[string]any{"status": "valid", "contact": res.contact})
+	})
+	mux.HandleFunc("/authz/1", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Replay-Nonce", fmt.Sprint(time.Now().UnixNano()))
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"status":     "pending",
+			"identifier": map[string]string{"type": "dns", "value": "example.com"},
+			"challenges": []map[string]string{
+				{"type": ChallengeTLSALPN, "url": url("/chal/1"), "token": "t1", "status": "pending"},
+				{"type": ChallengeHTTP, "url": url("/chal/2"), "token": "t2", "status": "pending"},
+			},
+		})
+	})
+
+	res.server = httptest.NewTLSServer(mux)
+	t.Cleanup(res.server.Close)
+
+	return res
+}
+
+// verifyEAB HMAC of binding with key id of CA
+func (x *acmeStandIn) verifyEAB(eab *jws, url string) bool {
+
+	if eab == nil {
+		return false
+	}
+
+	data, _ := base64.RawURLEncoding.DecodeString(eab.Protected)
+	var protected struct {
+		Alg string `json:"alg"`
+		KID string `json:"kid"`
+		URL string `json:"url"`
+	}
+	_ = json.Unmarshal(data, &protected)
+
+	mac := hmac.New(sha256.New, x.eabKey)
+	mac.Write([]byte(eab.Protected + "." + eab.Payload))
+	sig, _ := base64.RawURLEncoding.DecodeString(eab.Signature)
+
+	return protected.KID == x.eabKID && protected.URL == url && hmac.Equal(sig, mac.Sum(nil))
+}
+
+// caFile roots of stand-in TLS server
+func (x *acmeStandIn) caFile(t *testing.T) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "acme-ca.pem")
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: x.server.Certificate().Raw})
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func newACMEManager(t *testing.T, opts ACMEOptions) *autocert.Manager {
+	t.Helper()
+
+	m := &autocert.Manager{}
+	if err := ConfigureACME(m, t.TempDir(), []string{"example.com"}, opts); err != nil {
+		t.Fatalf("ConfigureACME() error: %v", err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Client.Key = key
+
+	return m
+}
+
+// register account as autocert does
+func register(m *autocert.Manager) error {
+	_, err := m.Client.Register(context.Background(), &acme.Account{
+		Contact:                []string{"mailto:" + m.Email},
+		ExternalAccountBinding: m.ExternalAccountBinding,
+	}, autocert.AcceptTOS)
+	return err
+}
+
+func TestConfigureACME_account(t *testing.T) {
+
+	ca := newACMEStandIn(t)
+
+	opts := ACMEOptions{
+		DirectoryURL: ca.server.URL + "/directory",
+		CA:           ca.caFile(t),
+		Email:        "admin@example.com",
+		EABKeyID:     ca.eabKID,
+		EABHMACKey:   base64.RawURLEncoding.EncodeToString(ca.eabKey),
+		RenewBefore:  10 * 24 * time.Hour,
+	}
+
+	m := newACMEManager(t, opts)
+	if m.RenewBefore != opts.RenewBefore || m.Client.DirectoryURL != opts.DirectoryURL {
+		t.Errorf("unexpected manager %+v", m)
+	}
+
+	if err := register(m); err != nil {
+		t.Fatalf("register error: %v", err)
+	}
+	if !ca.eabOK || !slices.Equal(ca.contact, []string{"mailto:admin@example.com"}) {
+		t.Errorf("account eab: %v contact: %v", ca.eabOK, ca.contact)
+	}
+
+	// wrong binding key rejected by CA
+	opts.EABHMACKey = base64.RawURLEncoding.EncodeToString([]byte("wrong"))
+	if err := register(newACMEManager(t, opts)); err == nil {
+		t.Errorf("expected error of wrong eab key")
+	}
+
+	// CA not trusted without roots
+	opts.CA = ""
+	if err := register(newACMEManager(t, opts)); err == nil {
+		t.Errorf("expected error of untrusted CA")
+	}
+}
+
+func TestConfigureACME_challenge(t *testing.T) {
+
+	ca := newACMEStandIn(t)
+
+	for challenge, want := range map[string][]string{
+		"":               {ChallengeTLSALPN, ChallengeHTTP},
+		ChallengeTLSALPN: {ChallengeTLSALPN, ChallengeHTTP},
+		ChallengeHTTP:    {ChallengeHTTP},
+	} {
+		t.Run(challenge, func(t *testing.T) {
+			m := newACMEManager(t, ACMEOptions{
+				DirectoryURL: ca.server.URL + "/directory",
+				CA:           ca.caFile(t),
+				EABKeyID:     ca.eabKID,
+				EABHMACKey:   base64.RawURLEncoding.EncodeToString(ca.eabKey),
+				Challenge:    challenge,
+			})
+			if err := register(m); err != nil {
+				t.Fatalf("register error: %v", err)
+			}
+
+			authz, err := m.Client.GetAuthorization(context.Background(), ca.server.URL+"/authz/1")
+			if err != nil {
+				t.Fatalf("GetAuthorization() error: %v", err)
+			}
+
+			got := []string{}
+			for _, v := range authz.Challenges {
+				got = append(got, v.Type)
+			}
+			if !slices.Equal(got, want) {
+				t.Errorf("challenges = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestConfigureACME_errors(t *testing.T) {
+
+	for name, opts := range map[string]ACMEOptions{
+		"challenge": {Challenge: "dns-01"},
+		"eab key":   {EABKeyID: "kid", EABHMACKey: "!"},
+		"ca":        {CA: filepath.Join(t.TempDir(), "missing.pem")},
+	} {
+		if err := ConfigureACME(&autocert.Manager{}, t.TempDir(), nil, opts); err == nil {
+			t.Errorf("expected error of %v", name)
+		}
+	}
+}
@@ -0,0 +1,409 @@
+package utilcert
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	xlog "go-proxy/internal/util/utillog"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/ocsp"
+)
+
+// OCSPDir dir of cached OCSP responses in cert dir
+const OCSPDir = "ocsp"
+
+var errOCSPRevoked = errors.New("certificate status revoked")
+
+// OCSPStapler fetch, cache on disk and staple OCSP responses of served certificates,
+// certificates served without staple if responder is unreachable
+type OCSPStapler struct {
+	dir    string // cache dir, no disk cache if empty
+	client *http.Client
+	now    func() time.Time
+
+	mutex   sync.Mutex
+	entries map[string]*ocspEntry // by sha256 of leaf
+}
+
+// ocspEntry OCSP state of one certificate
+type ocspEntry struct {
+	id     string
+	leaf   *x509.Certificate
+	issuer *x509.Certificate
+	chain  [][]byte
+
+	staple     []byte
+	thisUpdate time.Time
+	nextUpdate time.Time
+	updating   bool
+	retryAt    time.Time // after failed update
+}
+
+// NewOCSPStapler responses cached in dir
+func NewOCSPStapler(dir string) *OCSPStapler {
+	return &OCSPStapler{
+		dir:     dir,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		now:     time.Now,
+		entries: map[string]*ocspEntry{},
+	}
+}
+
+// GetCertificate wrap get with staple of certificate, fetch in background on first use
+func (x *OCSPStapler) GetCertificate(get func(*tls.ClientHelloInfo) (*tls.Certificate, error)) func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+
+	return func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+
+		cert, err := get(hello)
+		if err != nil || cert == nil {
+			return cert, err
+		}
+
+		// tls-alpn-01 challenge certs of ACME
+		if slices.Contains(hello.SupportedProtos, acme.ALPNProto) {
+			return cert, nil
+		}
+
+		e, created := x.entry(cert)
+		if e == nil {
+			return cert, nil
+		}
+		if created {
+			go x.update(e)
+		}
+
+		staple := x.staple(e)
+		if staple == nil {
+			return cert, nil
+		}
+
+		res := *cert // shared cert not changed by handshakes
+		res.OCSPStaple = staple
+
+		return &res, nil
+	}
+}
+
+// Add certificates to staple, responses fetched by Refresh
+func (x *OCSPStapler) Add(certs ...*tls.Certificate) {
+	for _, v := range certs {
+		x.entry(v)
+	}
+}
+
+// Staple fetch or load cached response of cert now, for tests and warm up
+func (x *OCSPStapler) Staple(cert *tls.Certificate) ([]byte, error) {
+
+	e, _ := x.entry(cert)
+	if e == nil {
+		return nil, fmt.Errorf("no leaf certificate")
+	}
+
+	if err := x.update(e); err != nil {
+		return nil, err
+	}
+
+	return x.staple(e), nil
+}
+
+// entry of cert, created if not exists, nil if no OCSP server in cert
+func (x *OCSPStapler) entry(cert *tls.Certificate) (*ocspEntry, bool) {
+
+	if len(cert.Certificate) == 0 {
+		return nil, false
+	}
+
+	sum := sha256.Sum256(cert.Certificate[0])
+	id := hex.EncodeToString(sum[:])
+
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+
+	if e, ok := x.entries[id]; ok {
+		return e, false
+	}
+
+	leaf := cert.Leaf
+	if leaf == nil {
+		var err error
+		if leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return nil, false
+		}
+	}
+
+	if len(leaf.OCSPServer) == 0 {
+		return nil, false
+	}
+
+	e := &ocspEntry{id: id, leaf: leaf, chain: cert.Certificate}
+	x.entries[id] = e
+
+	return e, true
+}
+
+// staple of entry if not expired
+func (x *OCSPStapler) staple(e *ocspEntry) []byte {
+
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+
+	if e.staple == nil || !x.now().Before(e.nextUpdate) {
+		return nil
+	}
+
+	return e.staple
+}
+
+// refreshAt half of validity of response
+func (e *ocspEntry) refreshAt() time.Time {
+	return e.thisUpdate.Add(e.nextUpdate.Sub(e.thisUpdate) / 2)
+}
+
+// due staple missing or in second half of validity, not before retry time
+func (x *OCSPStapler) due(e *ocspEntry, now time.Time) bool {
+	if now.Before(e.retryAt) {
+		return false
+	}
+	return e.staple == nil || !now.Before(e.refreshAt())
+}
+
+// update load cached response or fetch from responder, previous staple kept on error
+func (x *OCSPStapler) update(e *ocspEntry) error {
+
+	x.mutex.Lock()
+	if e.updating || !x.due(e, x.now()) {
+		x.mutex.Unlock()
+		return nil
+	}
+	e.updating = true
+	x.mutex.Unlock()
+
+	err := x.load(e)
+
+	x.mutex.Lock()
+	e.updating = false
+	if err != nil {
+		e.retryAt = x.now().Add(time.Minute)
+	}
+	x.mutex.Unlock()
+
+	if err != nil {
+		xlog.Error("OCSP staple of %v not updated: %v", e.leaf.Subject.CommonName, err)
+	}
+
+	return err
+}
+
+func (x *OCSPStapler) load(e *ocspEntry) error {
+
+	if e.issuer == nil {
+		issuer, err := x.issuer(e)
+		if err != nil {
+			return err
+		}
+		e.issuer = issuer
+	}
+
+	// disk cache, on start or after reload of cert
+	if x.dir != "" && e.staple == nil {
+		if data, err := os.ReadFile(x.cachePath(e)); err == nil {
+			if resp, err := x.parse(e, data); err == nil {
+				x.set(e, data, resp)
+				if !x.due(e, x.now()) {
+					return nil
+				}
+			}
+		}
+	}
+
+	data, err := x.fetch(e)
+	if err != nil {
+		return err
+	}
+
+	resp, err := x.parse(e, data)
+	if errors.Is(err, errOCSPRevoked) {
+		x.drop(e) // cached good staple not served after revocation
+	}
+	if err != nil {
+		return err
+	}
+
+	x.set(e, data, resp)
+
+	xlog.Info("OCSP staple of %v updated, next update: %v", e.leaf.Subject.CommonName, resp.NextUpdate)
+
+	if x.dir != "" {
+		if err := os.MkdirAll(x.dir, 0o700); err != nil {
+			return err
+		}
+		if err := os.WriteFile(x.cachePath(e), data, 0o600); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (x *OCSPStapler) set(e *ocspEntry, data []byte, resp *ocsp.Response) {
+
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+
+	e.staple = data
+	e.thisUpdate = resp.ThisUpdate
+	e.nextUpdate = resp.NextUpdate
+	if e.nextUpdate.IsZero() {
+		e.nextUpdate = resp.ThisUpdate.Add(time.Hour) // newer info always available
+	}
+}
+
+// drop staple of entry and its disk cache
+func (x *OCSPStapler) drop(e *ocspEntry) {
+
+	x.mutex.Lock()
+	e.staple = nil
+	e.thisUpdate = time.Time{}
+	e.nextUpdate = time.Time{}
+	x.mutex.Unlock()
+
+	if x.dir != "" {
+		_ = os.Remove(x.cachePath(e))
+	}
+}
+
+func (x *OCSPStapler) cachePath(e *ocspEntry) string {
+	return filepath.Join(x.dir, e.id+".der")
+}
+
+// parse response, error if not good or expired
+func (x *OCSPStapler) parse(e *ocspEntry, data []byte) (*ocsp.Response, error) {
+
+	resp, err := ocsp.ParseResponseForCert(data, e.leaf, e.issuer)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.Status == ocsp.Revoked {
+		return nil, errOCSPRevoked
+	}
+	if resp.Status != ocsp.Good {
+		return nil, fmt.Errorf("certificate status %v", ocspStatus(resp.Status))
+	}
+
+	if !resp.NextUpdate.IsZero() && !x.now().Before(resp.NextUpdate) {
+		return nil, fmt.Errorf("response expired at %v", resp.NextUpdate)
+	}
+
+	return resp, nil
+}
+
+func ocspStatus(status int) string {
+	switch status {
+	case ocsp.Good:
+		return "good"
+	case ocsp.Revoked:
+		return "revoked"
+	default:
+		return "unknown"
+	}
+}
+
+// issuer from chain of cert or from issuing certificate url
+func (x *OCSPStapler) issuer(e *ocspEntry) (*x509.Certificate, error) {
+
+	if len(e.chain) > 1 {
+		return x509.ParseCertificate(e.chain[1])
+	}
+
+	if len(e.leaf.IssuingCertificateURL) == 0 {
+		return nil, fmt.Errorf("no issuer certificate")
+	}
+
+	resp, err := x.client.Get(e.leaf.IssuingCertificateURL[0])
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+
+	return x509.ParseCertificate(data)
+}
+
+// fetch response from first OCSP server of cert
+func (x *OCSPStapler) fetch(e *ocspEntry) ([]byte, error) {
+
+	req, err := ocsp.CreateRequest(e.leaf, e.issuer, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := x.client.Post(e.leaf.OCSPServer[0], "application/ocsp-request", bytes.NewReader(req))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("OCSP responder status %v", resp.StatusCode)
+	}
+
+	return io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+}
+
+// Refresh update due staples, drop entries of expired certificates
+func (x *OCSPStapler) Refresh() {
+
+	now := x.now()
+
+	x.mutex.Lock()
+	entries := []*ocspEntry{}
+	for id, e := range x.entries {
+		if !now.Before(e.leaf.NotAfter) {
+			delete(x.entries, id)
+			continue
+		}
+		entries = append(entries, e)
+	}
+	x.mutex.Unlock()
+
+	for _, e := range entries {
+		_ = x.update(e) // error logged
+	}
+}
+
+// Run refresh staples now and with interval until context done
+func (x *OCSPStapler) Run(ctx context.Context, interval time.Duration) {
+
+	x.Refresh()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			x.Refresh()
+		}
+	}
+}
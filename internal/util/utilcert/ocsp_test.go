@@ -0,0 +1,261 @@
+package utilcert
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// ocspResponder stand-in OCSP responder signed by issuer
+type ocspResponder struct {
+	server   *httptest.Server
+	issuer   *x509.Certificate
+	key      crypto.Signer
+	status   atomic.Int64
+	requests atomic.Int64
+	now      time.Time
+}
+
+func newOCSPResponder(t *testing.T, now time.Time) *ocspResponder {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuer, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res := &ocspResponder{issuer: issuer, key: key, now: now}
+	res.status.Store(int64(ocsp.Good))
+
+	res.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		res.requests.Add(1)
+
+		data, _ := io.ReadAll(r.Body)
+		req, err := ocsp.ParseRequest(data)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		resp, err := ocsp.CreateResponse(issuer, issuer, ocsp.Response{
+			Status:       int(res.status.Load()),
+			SerialNumber: req.SerialNumber,
+			ThisUpdate:   res.now,
+			NextUpdate:   res.now.Add(4 * time.Hour),
+			RevokedAt:    res.now,
+		}, key)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/ocsp-response")
+		_, _ = w.Write(resp)
+	}))
+	t.Cleanup(res.server.Close)
+
+	return res
+}
+
+// leaf cert with OCSP server of responder, issuer in chain
+func (x *ocspResponder) leaf(t *testing.T, host string) *tls.Certificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: host},
+		DNSNames:     []string{host},
+		NotBefore:    x.now.Add(-time.Hour),
+		NotAfter:     x.now.Add(24 * time.Hour),
+		OCSPServer:   []string{x.server.URL},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, x.issuer, &key.PublicKey, x.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &tls.Certificate{Certificate: [][]byte{der, x.issuer.Raw}, PrivateKey: key, Leaf: leaf}
+}
+
+func TestOCSPStapler(t *testing.T) {
+
+	now := time.Now().Truncate(time.Second)
+	responder := newOCSPResponder(t, now)
+	cert := responder.leaf(t, "example.com")
+	dir := filepath.Join(t.TempDir(), OCSPDir)
+
+	clock := now
+	stapler := NewOCSPStapler(dir)
+	stapler.now = func() time.Time { return clock }
+
+	get := stapler.GetCertificate(func(*tls.ClientHelloInfo) (*tls.Certificate, error) { return cert, nil })
+
+	staple, err := stapler.Staple(cert)
+	if err != nil || staple == nil {
+		t.Fatalf("Staple() = %v, %v", staple, err)
+	}
+	resp, err := ocsp.ParseResponseForCert(staple, cert.Leaf, responder.issuer)
+	if err != nil || resp.Status != ocsp.Good {
+		t.Fatalf("staple not valid: %v", err)
+	}
+
+	served, err := get(&tls.ClientHelloInfo{ServerName: "example.com"})
+	if err != nil || string(served.OCSPStaple) != string(staple) {
+		t.Fatalf("served cert without staple: %v", err)
+	}
+	if cert.OCSPStaple != nil {
+		t.Errorf("shared cert changed")
+	}
+
+	// cached on disk
+	if files, err := os.ReadDir(dir); err != nil || len(files) != 1 {
+		t.Errorf("staple not cached on disk: %v %v", files, err)
+	}
+
+	// no refresh in first half of validity
+	clock = now.Add(time.Hour)
+	stapler.Refresh()
+	if n := responder.requests.Load(); n != 1 {
+		t.Errorf("responder requests = %v, want 1", n)
+	}
+
+	// refresh before expiry
+	responder.now = now.Add(3 * time.Hour)
+	clock = now.Add(3 * time.Hour)
+	stapler.Refresh()
+	if n := responder.requests.Load(); n != 2 {
+		t.Errorf("responder requests = %v, want 2", n)
+	}
+
+	// responder unreachable, cert served with valid staple until expiry, then without staple
+	responder.server.Close()
+	clock = now.Add(5 * time.Hour)
+	stapler.Refresh()
+	if served, err := get(&tls.ClientHelloInfo{}); err != nil || served.OCSPStaple == nil {
+		t.Errorf("valid staple not served: %v", err)
+	}
+	clock = now.Add(8 * time.Hour)
+	if served, err := get(&tls.ClientHelloInfo{}); err != nil || served.OCSPStaple != nil {
+		t.Errorf("expired staple served: %v", err)
+	}
+}
+
+func TestOCSPStapler_diskCache(t *testing.T) {
+
+	now := time.Now().Truncate(time.Second)
+	responder := newOCSPResponder(t, now)
+	cert := responder.leaf(t, "example.com")
+	dir := filepath.Join(t.TempDir(), OCSPDir)
+
+	if _, err := NewOCSPStapler(dir).Staple(cert); err != nil {
+		t.Fatalf("Staple() error: %v", err)
+	}
+
+	// restart with responder down
+	responder.server.Close()
+
+	staple, err := NewOCSPStapler(dir).Staple(cert)
+	if err != nil || staple == nil {
+		t.Errorf("cached staple not loaded: %v", err)
+	}
+}
+
+func TestOCSPStapler_unreachable(t *testing.T) {
+
+	now := time.Now().Truncate(time.Second)
+	responder := newOCSPResponder(t, now)
+	cert := responder.leaf(t, "example.com")
+	responder.server.Close()
+
+	stapler := NewOCSPStapler("")
+	get := stapler.GetCertificate(func(*tls.ClientHelloInfo) (*tls.Certificate, error) { return cert, nil })
+
+	if _, err := stapler.Staple(cert); err == nil {
+		t.Errorf("expected error of unreachable responder")
+	}
+
+	served, err := get(&tls.ClientHelloInfo{})
+	if err != nil || served != cert || served.OCSPStaple != nil {
+		t.Errorf("cert not served without staple: %v", err)
+	}
+}
+
+func TestOCSPStapler_revoked(t *testing.T) {
+
+	now := time.Now().Truncate(time.Second)
+	responder := newOCSPResponder(t, now)
+	responder.status.Store(int64(ocsp.Revoked))
+	cert := responder.leaf(t, "example.com")
+
+	if _, err := NewOCSPStapler("").Staple(cert); err == nil {
+		t.Errorf("expected error of revoked certificate")
+	}
+}
+
+func TestOCSPStapler_revokedAfterGood(t *testing.T) {
+
+	now := time.Now().Truncate(time.Second)
+	responder := newOCSPResponder(t, now)
+	cert := responder.leaf(t, "example.com")
+	dir := filepath.Join(t.TempDir(), OCSPDir)
+
+	clock := now
+	stapler := NewOCSPStapler(dir)
+	stapler.now = func() time.Time { return clock }
+	get := stapler.GetCertificate(func(*tls.ClientHelloInfo) (*tls.Certificate, error) { return cert, nil })
+
+	if _, err := stapler.Staple(cert); err != nil {
+		t.Fatalf("Staple() error: %v", err)
+	}
+
+	// revoked on refresh, good staple still valid is not served
+	responder.status.Store(int64(ocsp.Revoked))
+	clock = now.Add(3 * time.Hour)
+	stapler.Refresh()
+
+	if served, err := get(&tls.ClientHelloInfo{}); err != nil || served.OCSPStaple != nil {
+		t.Errorf("staple served after revocation: %v", err)
+	}
+	if files, _ := os.ReadDir(dir); len(files) != 0 {
+		t.Errorf("cached staple not removed: %v", files)
+	}
+}
@@ -0,0 +1,290 @@
+package utilcert
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	xlog "go-proxy/internal/util/utillog"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	CertFile  = "cert.pem"
+	KeyFile   = "key.pem"
+	ChainFile = "chain.pem" // optional intermediates
+)
+
+// certExpiry not after of loaded certificates, for sys api metrics
+var certExpiry = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "tls_certificate_expiry_timestamp_seconds",
+	Help: "Expiry time of loaded TLS certificate in unix seconds.",
+}, []string{"host"})
+
+// Store certificates by server name, one cert/key pair per host from "<dir>/<host>/",
+// or single PEM file "<dir>/<host>" with key and cert
+type Store struct {
+	dir         string
+	hosts       []string
+	defaultHost string
+
+	mutex       sync.RWMutex
+	byHost      map[string]*tls.Certificate
+	certs       map[string]*tls.Certificate // by host and names of cert "example.com", "*.example.com"
+	defaultCert *tls.Certificate
+
+	stamps map[string]string // file states of hosts, for watch
+}
+
+// NewStore load certificates of hosts, default host cert served for unknown names, first host if empty
+func NewStore(dir string, hosts []string, defaultHost string) (*Store, error) {
+
+	if len(hosts) == 0 {
+		return nil, fmt.Errorf("certificate hosts are empty")
+	}
+
+	if defaultHost == "" {
+		defaultHost = hosts[0]
+	}
+
+	if !slices.Contains(hosts, defaultHost) {
+		return nil, fmt.Errorf("default certificate host %v not in hosts %v", defaultHost, hosts)
+	}
+
+	res := &Store{
+		dir:         dir,
+		hosts:       hosts,
+		defaultHost: defaultHost,
+	}
+
+	if err := res.Load(); err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// Load read all certificates, current certificates kept on error
+func (x *Store) Load() error {
+	return x.load(true)
+}
+
+// Reload read all certificates, broken pairs rejected and previous cert of host kept
+func (x *Store) Reload() {
+	_ = x.load(false)
+}
+
+// load certificates of hosts, if not strict previous cert of host kept on error
+func (x *Store) load(strict bool) error {
+
+	x.mutex.RLock()
+	prev := x.byHost
+	x.mutex.RUnlock()
+
+	byHost := map[string]*tls.Certificate{}
+	certs := map[string]*tls.Certificate{}
+	stamps := map[string]string{}
+
+	for _, host := range x.hosts {
+
+		stamps[host] = x.stamp(host)
+
+		cert, err := LoadPair(x.dir, host)
+		if err != nil {
+			if strict {
+				return err
+			}
+			cert = prev[host]
+			xlog.Error("certificate of %v rejected, previous kept: %v", host, err)
+			if cert == nil {
+				continue
+			}
+		} else {
+			xlog.Info("certificate loaded: %v names: %v expires: %v", host, cert.Leaf.DNSNames, cert.Leaf.NotAfter)
+		}
+
+		byHost[host] = cert
+
+		for _, name := range certNames(host, cert) {
+			if _, ok := certs[name]; !ok {
+				certs[name] = cert
+			}
+		}
+
+		certExpiry.WithLabelValues(host).Set(float64(cert.Leaf.NotAfter.Unix()))
+	}
+
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+
+	x.byHost = byHost
+	x.certs = certs
+	x.defaultCert = byHost[x.defaultHost]
+	x.stamps = stamps
+
+	return nil
+}
+
+// stamp modification times and sizes of cert files of host
+func (x *Store) stamp(host string) string {
+
+	path := filepath.Join(x.dir, host)
+	files := []string{path, filepath.Join(path, CertFile), filepath.Join(path, KeyFile), filepath.Join(path, ChainFile)}
+
+	res := []string{}
+	for _, v := range files {
+		info, err := os.Stat(v)
+		if err != nil || info.IsDir() {
+			res = append(res, "-")
+			continue
+		}
+		res = append(res, fmt.Sprintf("%v:%v", info.ModTime().UnixNano(), info.Size()))
+	}
+
+	return strings.Join(res, ",")
+}
+
+// Changed hosts with changed cert files since last load
+func (x *Store) Changed() []string {
+
+	x.mutex.RLock()
+	stamps := x.stamps
+	x.mutex.RUnlock()
+
+	res := []string{}
+	for _, host := range x.hosts {
+		if x.stamp(host) != stamps[host] {
+			res = append(res, host)
+		}
+	}
+
+	return res
+}
+
+// Watch poll cert files with interval until context done, reload on change,
+// new handshakes get new cert, open connections not affected
+func (x *Store) Watch(ctx context.Context, interval time.Duration) {
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if changed := x.Changed(); len(changed) > 0 {
+				xlog.Info("certificate files changed: %v", changed)
+				x.Reload()
+			}
+		}
+	}
+}
+
+// LoadPair cert and key of host, "<dir>/<host>/cert.pem" with optional "chain.pem" or "<dir>/<host>" PEM file
+func LoadPair(dir string, host string) (*tls.Certificate, error) {
+
+	path := filepath.Join(dir, host)
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("certificate of %v: %w", host, err)
+	}
+
+	var certPEM, keyPEM []byte
+
+	if info.IsDir() {
+		if certPEM, err = os.ReadFile(filepath.Join(path, CertFile)); err != nil {
+			return nil, fmt.Errorf("certificate of %v: %w", host, err)
+		}
+		if keyPEM, err = os.ReadFile(filepath.Join(path, KeyFile)); err != nil {
+			return nil, fmt.Errorf("certificate key of %v: %w", host, err)
+		}
+		chainPEM, err := os.ReadFile(filepath.Join(path, ChainFile))
+		if err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("certificate chain of %v: %w", host, err)
+		}
+		if len(chainPEM) > 0 {
+			certPEM = append(append(certPEM, '\n'), chainPEM...)
+		}
+	} else {
+		if certPEM, err = os.ReadFile(path); err != nil {
+			return nil, fmt.Errorf("certificate of %v: %w", host, err)
+		}
+		keyPEM = certPEM
+	}
+
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("certificate of %v: %w", host, err)
+	}
+
+	return &cert, nil
+}
+
+// certNames host and DNS names of cert, common name if no DNS names
+func certNames(host string, cert *tls.Certificate) []string {
+
+	res := []string{strings.ToLower(host)}
+
+	names := cert.Leaf.DNSNames
+	if len(names) == 0 && cert.Leaf.Subject.CommonName != "" {
+		names = []string{cert.Leaf.Subject.CommonName}
+	}
+
+	for _, v := range names {
+		res = append(res, strings.ToLower(v))
+	}
+
+	return res
+}
+
+// Certificates loaded certificates of hosts
+func (x *Store) Certificates() []*tls.Certificate {
+
+	x.mutex.RLock()
+	defer x.mutex.RUnlock()
+
+	res := []*tls.Certificate{}
+	for _, host := range x.hosts {
+		if cert, ok := x.byHost[host]; ok {
+			res = append(res, cert)
+		}
+	}
+
+	return res
+}
+
+// GetCertificate by SNI, exact name, then wildcard "*.example.com", then default
+func (x *Store) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+
+	name := strings.TrimSuffix(strings.ToLower(hello.ServerName), ".")
+
+	x.mutex.RLock()
+	defer x.mutex.RUnlock()
+
+	if name != "" {
+		if cert, ok := x.certs[name]; ok {
+			return cert, nil
+		}
+		if _, rest, ok := strings.Cut(name, "."); ok {
+			if cert, ok := x.certs["*."+rest]; ok {
+				return cert, nil
+			}
+		}
+	}
+
+	if x.defaultCert != nil {
+		return x.defaultCert, nil
+	}
+
+	return nil, fmt.Errorf("no certificate for %q", name)
+}
@@ -0,0 +1,170 @@
+package utilcert
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// writeCert self signed cert of names, to "<dir>/<host>/" or "<dir>/<host>" if single file
+func writeCert(t *testing.T, dir string, host string, names []string, single bool) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: names[0]},
+		DNSNames:     names,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+
+	if single {
+		if err := os.WriteFile(filepath.Join(dir, host), append(keyPEM, certPEM...), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	path := filepath.Join(dir, host)
+	if err := os.MkdirAll(path, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(path, CertFile), certPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(path, KeyFile), keyPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStore_GetCertificate(t *testing.T) {
+
+	dir := t.TempDir()
+
+	writeCert(t, dir, "example.com", []string{"example.com", "www.example.com"}, false)
+	writeCert(t, dir, "apps.example.com", []string{"*.apps.example.com"}, false)
+	writeCert(t, dir, "localhost", []string{"localhost"}, true)
+
+	store, err := NewStore(dir, []string{"example.com", "apps.example.com", "localhost"}, "localhost")
+	if err != nil {
+		t.Fatalf("NewStore() error: %v", err)
+	}
+
+	tests := []struct {
+		serverName string
+		want       string // first name of cert
+	}{
+		{serverName: "example.com", want: "example.com"},
+		{serverName: "WWW.example.com.", want: "example.com"},
+		{serverName: "shop.apps.example.com", want: "*.apps.example.com"},
+		{serverName: "a.shop.apps.example.com", want: "localhost"},
+		{serverName: "unknown.com", want: "localhost"},
+		{serverName: "", want: "localhost"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.serverName, func(t *testing.T) {
+			cert, err := store.GetCertificate(&tls.ClientHelloInfo{ServerName: tt.serverName})
+			if err != nil {
+				t.Fatalf("GetCertificate() error: %v", err)
+			}
+			if got := cert.Leaf.DNSNames[0]; got != tt.want {
+				t.Errorf("GetCertificate() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewStore_errors(t *testing.T) {
+
+	dir := t.TempDir()
+	writeCert(t, dir, "example.com", []string{"example.com"}, false)
+
+	if _, err := NewStore(dir, []string{"example.com"}, "other.com"); err == nil {
+		t.Errorf("expected default host error")
+	}
+	if _, err := NewStore(dir, []string{"example.com", "missing.com"}, ""); err == nil {
+		t.Errorf("expected missing cert error")
+	}
+
+	// key of other cert
+	other := t.TempDir()
+	writeCert(t, other, "example.com", []string{"example.com"}, false)
+	data, _ := os.ReadFile(filepath.Join(other, "example.com", KeyFile))
+	_ = os.WriteFile(filepath.Join(dir, "example.com", KeyFile), data, 0o600)
+
+	if _, err := NewStore(dir, []string{"example.com"}, ""); err == nil {
+		t.Errorf("expected key mismatch error")
+	}
+}
+
+func TestStore_Reload(t *testing.T) {
+
+	dir := t.TempDir()
+	writeCert(t, dir, "example.com", []string{"example.com"}, false)
+
+	store, err := NewStore(dir, []string{"example.com"}, "")
+	if err != nil {
+		t.Fatalf("NewStore() error: %v", err)
+	}
+
+	get := func() *tls.Certificate {
+		cert, _ := store.GetCertificate(&tls.ClientHelloInfo{ServerName: "example.com"})
+		return cert
+	}
+
+	first := get()
+	if got := testutil.ToFloat64(certExpiry.WithLabelValues("example.com")); got != float64(first.Leaf.NotAfter.Unix()) {
+		t.Errorf("expiry gauge = %v, want %v", got, first.Leaf.NotAfter.Unix())
+	}
+
+	if changed := store.Changed(); len(changed) != 0 {
+		t.Errorf("Changed() = %v, want no changes", changed)
+	}
+
+	// broken pair rejected, previous kept
+	certFile := filepath.Join(dir, "example.com", CertFile)
+	_ = os.WriteFile(certFile, []byte("broken"), 0o600)
+
+	if changed := store.Changed(); len(changed) != 1 {
+		t.Fatalf("Changed() = %v, want example.com", changed)
+	}
+	store.Reload()
+	if get() != first {
+		t.Errorf("expected previous certificate kept")
+	}
+
+	// renewed in place
+	writeCert(t, dir, "example.com", []string{"example.com"}, false)
+	store.Reload()
+	if renewed := get(); renewed == first || renewed.Leaf.SerialNumber.Cmp(first.Leaf.SerialNumber) == 0 {
+		t.Errorf("expected renewed certificate")
+	}
+}
@@ -0,0 +1,182 @@
+package utilconfig
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	xlog "go-proxy/internal/util/utillog"
+)
+
+// watchSource state of one config file or url
+type watchSource struct {
+	path string
+
+	// file
+	modTime time.Time
+	size    int64
+
+	// url
+	etag         string
+	lastModified string
+
+	sum    [sha256.Size]byte
+	exists bool
+}
+
+// Watcher polls config sources same as LoadConfig, files by modification time and size,
+// urls by ETag and Last-Modified, changed if content changed
+type Watcher struct {
+	sources []*watchSource
+	client  *http.Client
+}
+
+// NewWatcher of config file in dirs, current state is baseline
+func NewWatcher(dirs []string, fileName string) *Watcher {
+
+	res := &Watcher{
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+
+	for _, dir := range dirs {
+		path := dir + "/" + fileName
+		if !strings.HasPrefix(dir, "http") {
+			path, _ = filepath.Abs(filepath.Join(dir, fileName))
+		}
+		res.sources = append(res.sources, &watchSource{path: path})
+	}
+
+	_ = res.Poll() // baseline
+
+	return res
+}
+
+// Poll check all sources, returns changed sources
+func (x *Watcher) Poll() []string {
+
+	res := []string{}
+
+	for _, v := range x.sources {
+
+		var changed bool
+		var err error
+
+		if strings.HasPrefix(v.path, "http") {
+			changed, err = x.pollURL(v)
+		} else {
+			changed, err = x.pollFile(v)
+		}
+
+		if err != nil {
+			xlog.Warn("config watch %v error: %v", v.path, err)
+			continue
+		}
+
+		if changed {
+			res = append(res, v.path)
+		}
+	}
+
+	return res
+}
+
+// Start poll with interval until context done, call onChange with changed sources
+func (x *Watcher) Start(ctx context.Context, interval time.Duration, onChange func(changed []string)) {
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if changed := x.Poll(); len(changed) > 0 {
+				onChange(changed)
+			}
+		}
+	}
+}
+
+// update content state, true if content changed
+func (x *watchSource) update(exists bool, data []byte) bool {
+
+	sum := sha256.Sum256(data)
+	changed := exists != x.exists || sum != x.sum
+
+	x.exists = exists
+	x.sum = sum
+
+	return changed
+}
+
+func (x *Watcher) pollFile(v *watchSource) (bool, error) {
+
+	info, err := os.Stat(v.path)
+	if os.IsNotExist(err) {
+		return v.update(false, nil), nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if v.exists && info.ModTime().Equal(v.modTime) && info.Size() == v.size {
+		return false, nil
+	}
+
+	data, err := os.ReadFile(v.path)
+	if err != nil {
+		return false, err
+	}
+
+	v.modTime = info.ModTime()
+	v.size = info.Size()
+
+	return v.update(true, data), nil
+}
+
+func (x *Watcher) pollURL(v *watchSource) (bool, error) {
+
+	req, err := http.NewRequest(http.MethodGet, v.path, nil)
+	if err != nil {
+		return false, err
+	}
+
+	if v.etag != "" {
+		req.Header.Set("If-None-Match", v.etag)
+	}
+	if v.lastModified != "" {
+		req.Header.Set("If-Modified-Since", v.lastModified)
+	}
+
+	resp, err := x.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		return false, nil
+	case http.StatusOK:
+	default:
+		_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+		return false, fmt.Errorf("unexpected status: %v", resp.StatusCode)
+	}
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return false, err
+	}
+
+	v.etag = resp.Header.Get("ETag")
+	v.lastModified = resp.Header.Get("Last-Modified")
+
+	return v.update(true, data), nil
+}
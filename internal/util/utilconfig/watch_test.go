@@ -0,0 +1,78 @@
+package utilconfig
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWatcher_Poll_file(t *testing.T) {
+
+	dir := t.TempDir()
+	file := filepath.Join(dir, "config.test.json")
+
+	if err := os.WriteFile(file, []byte(`{"title":"a"}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	x := NewWatcher([]string{dir}, "config.test.json")
+
+	if changed := x.Poll(); len(changed) != 0 {
+		t.Errorf("Poll() = %v, want no changes", changed)
+	}
+
+	// same content, new modification time
+	now := time.Now().Add(time.Minute)
+	_ = os.Chtimes(file, now, now)
+	if changed := x.Poll(); len(changed) != 0 {
+		t.Errorf("Poll() = %v, want no changes of same content", changed)
+	}
+
+	if err := os.WriteFile(file, []byte(`{"title":"b"}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(time.Minute)
+	_ = os.Chtimes(file, now, now)
+	if changed := x.Poll(); len(changed) != 1 || changed[0] != file {
+		t.Errorf("Poll() = %v, want %v", changed, file)
+	}
+
+	_ = os.Remove(file)
+	if changed := x.Poll(); len(changed) != 1 {
+		t.Errorf("Poll() = %v, want removed file", changed)
+	}
+}
+
+func TestWatcher_Poll_url(t *testing.T) {
+
+	var body atomic.Value
+	body.Store(`{"title":"a"}`)
+	var notModified atomic.Int32
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		etag := `"` + body.Load().(string) + `"`
+		if r.Header.Get("If-None-Match") == etag {
+			notModified.Add(1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		_, _ = w.Write([]byte(body.Load().(string)))
+	}))
+	defer srv.Close()
+
+	x := NewWatcher([]string{srv.URL}, "config.test.json")
+
+	if changed := x.Poll(); len(changed) != 0 || notModified.Load() != 1 {
+		t.Errorf("Poll() = %v, not modified: %v, want no changes by ETag", changed, notModified.Load())
+	}
+
+	body.Store(`{"title":"b"}`)
+	if changed := x.Poll(); len(changed) != 1 || changed[0] != srv.URL+"/config.test.json" {
+		t.Errorf("Poll() = %v, want changed url", changed)
+	}
+}
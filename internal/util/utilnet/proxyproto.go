@@ -0,0 +1,156 @@
+package utilnet
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pires/go-proxyproto"
+	"github.com/pires/go-proxyproto/tlvparse"
+)
+
+// ProxyHeaderTimeout max wait of PROXY header after accept
+const ProxyHeaderTimeout = 5 * time.Second
+
+// NewProxyListener PROXY protocol v1/v2 of trusted sources "10.0.0.0/8", "10.0.0.1",
+// header required from trusted sources and decodes client address, connections of others are served as is
+func NewProxyListener(l net.Listener, trusted []string) (net.Listener, error) {
+
+	prefixes := []netip.Prefix{}
+	for _, v := range trusted {
+		prefix, err := netip.ParsePrefix(v)
+		if err != nil {
+			addr, err := netip.ParseAddr(v)
+			if err != nil {
+				return nil, fmt.Errorf("trusted source %q is not ip or cidr", v)
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		prefixes = append(prefixes, prefix)
+	}
+
+	// header of trusted source required, connection without header closed, header of untrusted source is not read
+	policy := func(upstream net.Addr) (proxyproto.Policy, error) {
+		if tcp, ok := upstream.(*net.TCPAddr); ok {
+			addr := tcp.AddrPort().Addr().Unmap()
+			for _, v := range prefixes {
+				if v.Contains(addr) {
+					return proxyproto.REQUIRE, nil
+				}
+			}
+		}
+		return proxyproto.SKIP, nil
+	}
+
+	return &proxyproto.Listener{
+		Listener:          l,
+		Policy:            policy,
+		ReadHeaderTimeout: ProxyHeaderTimeout,
+	}, nil
+}
+
+// Listen tcp listener of address, with PROXY protocol of trusted sources if enabled
+func Listen(address string, proxyProtocol bool, trusted []string) (net.Listener, error) {
+
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	if !proxyProtocol {
+		return l, nil
+	}
+
+	res, err := NewProxyListener(l, trusted)
+	if err != nil {
+		_ = l.Close()
+		return nil, err
+	}
+	return res, nil
+}
+
+type connKey struct{}
+
+// ConnContext keeps connection in context of its requests for ProxyHeader, http.Server.ConnContext
+func ConnContext(ctx context.Context, c net.Conn) context.Context {
+	return context.WithValue(ctx, connKey{}, c)
+}
+
+// ProxyHeader PROXY header of connection of request context, nil if none
+func ProxyHeader(ctx context.Context) *proxyproto.Header {
+
+	c, _ := ctx.Value(connKey{}).(net.Conn)
+	if tc, ok := c.(*tls.Conn); ok {
+		c = tc.NetConn()
+	}
+	if pc, ok := c.(*proxyproto.Conn); ok {
+		return pc.ProxyHeader()
+	}
+	return nil
+}
+
+// ProxyVar value of PROXY header variable, empty if not sent:
+// authority, unique_id, alpn, ssl ("1" if client used TLS), ssl_verified ("1" if client cert verified),
+// ssl_version, ssl_cipher, ssl_cn, aws_vpce_id, tlv_0xE0 (hex of custom type)
+func ProxyVar(h *proxyproto.Header, name string) string {
+
+	if h == nil {
+		return ""
+	}
+	tlvs, err := h.TLVs()
+	if err != nil {
+		return ""
+	}
+
+	find := func(t proxyproto.PP2Type) string {
+		for _, v := range tlvs {
+			if v.Type == t {
+				return string(v.Value)
+			}
+		}
+		return ""
+	}
+	flag := func(v bool) string {
+		if v {
+			return "1"
+		}
+		return ""
+	}
+
+	ssl, hasSSL := tlvparse.FindSSL(tlvs)
+	sslValue := func(v string, _ bool) string { return v }
+
+	switch name {
+	case "authority":
+		return find(proxyproto.PP2_TYPE_AUTHORITY)
+	case "unique_id":
+		return hex.EncodeToString([]byte(find(proxyproto.PP2_TYPE_UNIQUE_ID)))
+	case "alpn":
+		return find(proxyproto.PP2_TYPE_ALPN)
+	case "ssl":
+		return flag(hasSSL && ssl.ClientSSL())
+	case "ssl_verified":
+		return flag(hasSSL && ssl.ClientCertConn() && ssl.Verified())
+	case "ssl_version":
+		return sslValue(ssl.SSLVersion())
+	case "ssl_cipher":
+		return sslValue(ssl.SSLCipher())
+	case "ssl_cn":
+		return sslValue(ssl.ClientCN())
+	case "aws_vpce_id":
+		return tlvparse.FindAWSVPCEndpointID(tlvs)
+	}
+
+	if v, ok := strings.CutPrefix(name, "tlv_"); ok {
+		if t, err := strconv.ParseUint(v, 0, 8); err == nil {
+			return hex.EncodeToString([]byte(find(proxyproto.PP2Type(t))))
+		}
+	}
+
+	return ""
+}
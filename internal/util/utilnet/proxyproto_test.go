@@ -0,0 +1,134 @@
+package utilnet
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/pires/go-proxyproto"
+	"github.com/pires/go-proxyproto/tlvparse"
+)
+
+// serveProxy http server of PROXY listener, responds with remote address and PROXY variables
+func serveProxy(t *testing.T, trusted []string) string {
+
+	l, err := Listen("127.0.0.1:0", true, trusted)
+	if err != nil {
+		t.Fatalf("Listen() error: %v", err)
+	}
+
+	s := &http.Server{
+		ConnContext: ConnContext,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			h := ProxyHeader(r.Context())
+			host, _, _ := net.SplitHostPort(r.RemoteAddr)
+			_, _ = fmt.Fprintf(w, "%v|%v|%v|%v|%v|%v|%v", host,
+				ProxyVar(h, "authority"), ProxyVar(h, "ssl"), ProxyVar(h, "ssl_verified"),
+				ProxyVar(h, "ssl_version"), ProxyVar(h, "ssl_cn"), ProxyVar(h, "tlv_0xE0"))
+		}),
+	}
+	go func() { _ = s.Serve(l) }()
+	t.Cleanup(func() { _ = s.Close() })
+
+	return l.Addr().String()
+}
+
+// get request with PROXY header if not nil, status and body
+func get(t *testing.T, address string, header *proxyproto.Header) (int, string) {
+
+	c, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatalf("Dial() error: %v", err)
+	}
+	defer c.Close()
+
+	if header != nil {
+		if _, err := header.WriteTo(c); err != nil {
+			t.Fatalf("WriteTo() error: %v", err)
+		}
+	}
+	_, _ = io.WriteString(c, "GET / HTTP/1.1\r\nHost: test\r\nConnection: close\r\n\r\n")
+
+	res, err := http.ReadResponse(bufio.NewReader(c), nil)
+	if err != nil {
+		t.Fatalf("ReadResponse() error: %v", err)
+	}
+	defer res.Body.Close()
+	body, _ := io.ReadAll(res.Body)
+
+	return res.StatusCode, string(body)
+}
+
+func TestListen(t *testing.T) {
+
+	client := &net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: 40000}
+	dest := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 443}
+
+	v2 := proxyproto.HeaderProxyFromAddrs(2, client, dest)
+	ssl, err := tlvparse.PP2SSL{
+		Client: tlvparse.PP2_BITFIELD_CLIENT_SSL | tlvparse.PP2_BITFIELD_CLIENT_CERT_CONN,
+		TLV: []proxyproto.TLV{
+			{Type: proxyproto.PP2_SUBTYPE_SSL_VERSION, Value: []byte("TLSv1.3")},
+			{Type: proxyproto.PP2_SUBTYPE_SSL_CN, Value: []byte("client.example.com")},
+		},
+	}.Marshal()
+	if err != nil {
+		t.Fatalf("Marshal() error: %v", err)
+	}
+	if err := v2.SetTLVs([]proxyproto.TLV{
+		{Type: proxyproto.PP2_TYPE_AUTHORITY, Value: []byte("example.com")},
+		{Type: 0xE0, Value: []byte{0xca, 0xfe}},
+		ssl,
+	}); err != nil {
+		t.Fatalf("SetTLVs() error: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		trusted []string
+		header  *proxyproto.Header
+		status  int
+		want    string
+	}{
+		{name: "v1", trusted: []string{"127.0.0.1"}, header: proxyproto.HeaderProxyFromAddrs(1, client, dest), status: 200, want: "203.0.113.7||||||"},
+		{name: "v2 with TLVs", trusted: []string{"127.0.0.0/8"}, header: v2, status: 200, want: "203.0.113.7|example.com|1|1|TLSv1.3|client.example.com|cafe"},
+		{name: "trusted without header rejected", trusted: []string{"127.0.0.1"}, status: 400},
+		{name: "untrusted without header", trusted: []string{"10.0.0.0/8"}, status: 200, want: "127.0.0.1||||||"},
+		{name: "untrusted header not read", trusted: []string{"10.0.0.0/8"}, header: v2, status: 400},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, body := get(t, serveProxy(t, tt.trusted), tt.header)
+			if status != tt.status {
+				t.Fatalf("status = %v, want %v", status, tt.status)
+			}
+			if tt.want != "" && body != tt.want {
+				t.Errorf("body = %v, want %v", body, tt.want)
+			}
+		})
+	}
+
+	if _, err := Listen("127.0.0.1:0", true, []string{"junk"}); err == nil {
+		t.Errorf("expected trusted source error")
+	}
+}
+
+func TestProxyVar(t *testing.T) {
+
+	if got := ProxyVar(nil, "ssl"); got != "" {
+		t.Errorf("ProxyVar() of no header = %v, want empty", got)
+	}
+
+	h := proxyproto.HeaderProxyFromAddrs(2, &net.TCPAddr{IP: net.ParseIP("203.0.113.7")}, &net.TCPAddr{IP: net.ParseIP("10.0.0.1")})
+	if err := h.SetTLVs([]proxyproto.TLV{{Type: proxyproto.PP2_TYPE_UNIQUE_ID, Value: []byte{1, 2}}}); err != nil {
+		t.Fatalf("SetTLVs() error: %v", err)
+	}
+	for name, want := range map[string]string{"unique_id": "0102", "ssl": "", "ssl_cn": "", "tlv_junk": "", "other": ""} {
+		if got := ProxyVar(h, name); got != want {
+			t.Errorf("ProxyVar(%v) = %v, want %v", name, got, want)
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package utiltls
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	xlog "go-proxy/internal/util/utillog"
+)
+
+// TicketKeysKeep random keys kept for decryption of tickets issued before rotation, current included
+const TicketKeysKeep = 3
+
+// TicketKeys session ticket keys of TLS listener, shared by replicas from file or dir, random if no path.
+// First key encrypts new tickets, all keys decrypt.
+type TicketKeys struct {
+	path string
+
+	mutex sync.Mutex
+	keys  [][32]byte
+}
+
+// NewTicketKeys keys from file or dir path, random keys rotated locally if empty
+func NewTicketKeys(path string) *TicketKeys {
+	return &TicketKeys{path: path}
+}
+
+// Keys current keys, first is used for new tickets
+func (x *TicketKeys) Keys() [][32]byte {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+	return slices.Clone(x.keys)
+}
+
+// Rotate read keys from path or add new random key, previous keys kept on error
+func (x *TicketKeys) Rotate() error {
+
+	var keys [][32]byte
+	var err error
+
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+
+	if x.path != "" {
+		if keys, err = ReadTicketKeys(x.path); err != nil {
+			return err
+		}
+	} else {
+		var key [32]byte
+		if _, err := rand.Read(key[:]); err != nil {
+			return fmt.Errorf("session ticket key: %w", err)
+		}
+		keys = append([][32]byte{key}, x.keys...)
+		keys = keys[:min(len(keys), TicketKeysKeep)]
+	}
+
+	x.keys = keys
+
+	return nil
+}
+
+// Apply rotate keys and set them to cfg
+func (x *TicketKeys) Apply(cfg *tls.Config) error {
+
+	if err := x.Rotate(); err != nil {
+		return err
+	}
+
+	cfg.SetSessionTicketKeys(x.Keys())
+
+	return nil
+}
+
+// Run rotate keys of cfg with interval until context done
+func (x *TicketKeys) Run(ctx context.Context, cfg *tls.Config, interval time.Duration) {
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			xlog.Info("session ticket key rotation stopped")
+			return
+		case <-ticker.C:
+			if err := x.Apply(cfg); err != nil {
+				xlog.Error("session ticket keys not rotated, previous kept: %v", err)
+				continue
+			}
+			xlog.Info("session ticket keys rotated: %v keys", len(x.Keys()))
+		}
+	}
+}
+
+// ReadTicketKeys keys of file, one base64 or hex 32 bytes key per line, first line is current key,
+// or of files in dir, newest file first
+func ReadTicketKeys(path string) ([][32]byte, error) {
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("session ticket keys: %w", err)
+	}
+
+	files := []string{path}
+
+	if info.IsDir() {
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			return nil, fmt.Errorf("session ticket keys: %w", err)
+		}
+
+		type item struct {
+			name    string
+			modTime time.Time
+		}
+		items := []item{}
+		for _, v := range entries {
+			if v.IsDir() || strings.HasPrefix(v.Name(), ".") {
+				continue
+			}
+			info, err := v.Info()
+			if err != nil {
+				return nil, fmt.Errorf("session ticket keys: %w", err)
+			}
+			items = append(items, item{name: filepath.Join(path, v.Name()), modTime: info.ModTime()})
+		}
+		slices.SortFunc(items, func(a, b item) int {
+			if c := b.modTime.Compare(a.modTime); c != 0 {
+				return c
+			}
+			return strings.Compare(b.name, a.name)
+		})
+
+		files = files[:0]
+		for _, v := range items {
+			files = append(files, v.name)
+		}
+	}
+
+	res := [][32]byte{}
+
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("session ticket keys: %w", err)
+		}
+		keys, err := parseTicketKeys(data)
+		if err != nil {
+			return nil, fmt.Errorf("session ticket keys of %v: %w", file, err)
+		}
+		res = append(res, keys...)
+	}
+
+	if len(res) == 0 {
+		return nil, fmt.Errorf("session ticket keys: no keys in %v", path)
+	}
+
+	return res, nil
+}
+
+// parseTicketKeys lines of base64 or hex keys, empty lines and "#" comments skipped
+func parseTicketKeys(data []byte) ([][32]byte, error) {
+
+	res := [][32]byte{}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		value, err := hex.DecodeString(line)
+		if err != nil {
+			value, err = base64.StdEncoding.DecodeString(line)
+		}
+		if err != nil || len(value) != 32 {
+			return nil, fmt.Errorf("line %v: key must be 32 bytes in base64 or hex", n)
+		}
+
+		res = append(res, [32]byte(value))
+	}
+
+	return res, scanner.Err()
+}
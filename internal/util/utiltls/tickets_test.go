@@ -0,0 +1,257 @@
+package utiltls
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTicketKey(t *testing.T, fill byte) [32]byte {
+	t.Helper()
+	var key [32]byte
+	for i := range key {
+		key[i] = fill
+	}
+	return key
+}
+
+func TestReadTicketKeys(t *testing.T) {
+
+	dir := t.TempDir()
+	a, b, c := newTicketKey(t, 'a'), newTicketKey(t, 'b'), newTicketKey(t, 'c')
+
+	file := filepath.Join(dir, "keys")
+	data := "# current first\n" + base64.StdEncoding.EncodeToString(a[:]) + "\n\n" + hex.EncodeToString(b[:]) + "\n"
+	if err := os.WriteFile(file, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	keys, err := ReadTicketKeys(file)
+	if err != nil {
+		t.Fatalf("ReadTicketKeys() error: %v", err)
+	}
+	if len(keys) != 2 || keys[0] != a || keys[1] != b {
+		t.Errorf("ReadTicketKeys() = %x, want a, b", keys)
+	}
+
+	// dir, newest file first
+	keysDir := filepath.Join(dir, "keys.d")
+	if err := os.Mkdir(keysDir, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	for i, key := range [][32]byte{a, b, c} {
+		path := filepath.Join(keysDir, string(rune('1'+i))+".key")
+		if err := os.WriteFile(path, []byte(base64.StdEncoding.EncodeToString(key[:])), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, now, now.Add(time.Duration(i)*time.Minute)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(keysDir, ".hidden"), []byte("qwe"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	keys, err = ReadTicketKeys(keysDir)
+	if err != nil {
+		t.Fatalf("ReadTicketKeys() error: %v", err)
+	}
+	if len(keys) != 3 || keys[0] != c || keys[1] != b || keys[2] != a {
+		t.Errorf("ReadTicketKeys() of dir = %x, want c, b, a", keys)
+	}
+
+	for name, data := range map[string]string{
+		"short":  base64.StdEncoding.EncodeToString([]byte("short")),
+		"broken": "not a key",
+		"empty":  "# no keys\n",
+	} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ReadTicketKeys(path); err == nil {
+			t.Errorf("expected error for %v", name)
+		}
+	}
+}
+
+func TestTicketKeys_Rotate(t *testing.T) {
+
+	t.Run("random keys", func(t *testing.T) {
+		keys := NewTicketKeys("")
+		for range TicketKeysKeep + 2 {
+			prev := keys.Keys()
+			if err := keys.Rotate(); err != nil {
+				t.Fatalf("Rotate() error: %v", err)
+			}
+			got := keys.Keys()
+			if len(got) != min(len(prev)+1, TicketKeysKeep) {
+				t.Fatalf("keys = %v, want %v", len(got), min(len(prev)+1, TicketKeysKeep))
+			}
+			if len(prev) > 0 && got[1] != prev[0] {
+				t.Errorf("previous key not kept for decryption")
+			}
+		}
+	})
+
+	t.Run("shared file", func(t *testing.T) {
+		file := filepath.Join(t.TempDir(), "keys")
+		a, b := newTicketKey(t, 'a'), newTicketKey(t, 'b')
+		if err := os.WriteFile(file, []byte(hex.EncodeToString(a[:])), 0o600); err != nil {
+			t.Fatal(err)
+		}
+
+		keys := NewTicketKeys(file)
+		if err := keys.Rotate(); err != nil {
+			t.Fatalf("Rotate() error: %v", err)
+		}
+
+		// new key added by operator, old key kept for decryption
+		if err := os.WriteFile(file, []byte(hex.EncodeToString(b[:])+"\n"+hex.EncodeToString(a[:])), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if err := keys.Rotate(); err != nil {
+			t.Fatalf("Rotate() error: %v", err)
+		}
+		if got := keys.Keys(); len(got) != 2 || got[0] != b || got[1] != a {
+			t.Errorf("keys = %x, want b, a", got)
+		}
+
+		// broken file, previous keys kept
+		if err := os.WriteFile(file, []byte("qwe"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if err := keys.Rotate(); err == nil {
+			t.Errorf("expected error of broken file")
+		}
+		if got := keys.Keys(); len(got) != 2 || got[0] != b {
+			t.Errorf("keys = %x, want previous keys", got)
+		}
+	})
+}
+
+func TestTicketKeys_Run(t *testing.T) {
+
+	keys := NewTicketKeys("")
+	ctx, cancel := context.WithCancel(context.Background())
+
+	done := make(chan struct{})
+	go func() {
+		keys.Run(ctx, &tls.Config{}, 10*time.Millisecond)
+		close(done)
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("Run() not stopped on context done")
+	}
+
+	if len(keys.Keys()) == 0 {
+		t.Errorf("keys not rotated")
+	}
+}
+
+// newServerConfig TLS 1.2 server, ticket in handshake
+func newServerConfig(t *testing.T) *tls.Config {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "example.com"},
+		DNSNames:     []string{"example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+		MaxVersion:   tls.VersionTLS12,
+	}
+}
+
+// handshake client with server, returns true if session resumed
+func handshake(t *testing.T, server *tls.Config, client *tls.Config) bool {
+	t.Helper()
+
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- tls.Server(b, server).Handshake()
+	}()
+
+	conn := tls.Client(a, client)
+	if err := conn.Handshake(); err != nil {
+		t.Fatalf("client handshake error: %v", err)
+	}
+	if err := <-errs; err != nil {
+		t.Fatalf("server handshake error: %v", err)
+	}
+
+	return conn.ConnectionState().DidResume
+}
+
+func TestTicketKeys_replicas(t *testing.T) {
+
+	file := filepath.Join(t.TempDir(), "keys")
+	key := newTicketKey(t, 'k')
+	if err := os.WriteFile(file, []byte(hex.EncodeToString(key[:])), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	// replicas with shared keys
+	replicaA, replicaB := newServerConfig(t), newServerConfig(t)
+	for _, v := range []*tls.Config{replicaA, replicaB} {
+		if err := NewTicketKeys(file).Apply(v); err != nil {
+			t.Fatalf("Apply() error: %v", err)
+		}
+	}
+	// replica with own random keys
+	replicaC := newServerConfig(t)
+	if err := NewTicketKeys("").Apply(replicaC); err != nil {
+		t.Fatalf("Apply() error: %v", err)
+	}
+
+	client := &tls.Config{
+		ServerName:         "example.com",
+		InsecureSkipVerify: true, //nolint:gosec // self-signed test cert
+		ClientSessionCache: tls.NewLRUClientSessionCache(8),
+	}
+
+	if handshake(t, replicaA, client) {
+		t.Fatalf("first handshake resumed")
+	}
+	if !handshake(t, replicaB, client) {
+		t.Errorf("session of replica A not resumed on replica B")
+	}
+	if handshake(t, replicaC, client) {
+		t.Errorf("session resumed on replica with other keys")
+	}
+}
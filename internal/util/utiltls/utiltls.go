@@ -0,0 +1,230 @@
+package utiltls
+
+import (
+	"crypto/tls"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+const (
+	PresetModern       = "modern"       // TLS 1.3 only
+	PresetIntermediate = "intermediate" // TLS 1.2+, AEAD ciphers with forward secrecy
+	PresetLegacy       = "legacy"       // TLS 1.0+, CBC and RSA key exchange for old clients
+)
+
+// Presets names of presets
+var Presets = []string{PresetModern, PresetIntermediate, PresetLegacy}
+
+// Settings protocol versions, cipher suites and curves, empty values from preset, go defaults if no preset
+type Settings struct {
+	Preset       string
+	MinVersion   string   // "1.2"
+	MaxVersion   string   // "1.3"
+	CipherSuites []string // "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", TLS 1.2 and below, TLS 1.3 suites are not configurable
+	Curves       []string // "X25519", "P-256"
+}
+
+var versions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+var curves = map[string]tls.CurveID{
+	"x25519mlkem768": tls.X25519MLKEM768,
+	"x25519":         tls.X25519,
+	"p-256":          tls.CurveP256,
+	"p256":           tls.CurveP256,
+	"secp256r1":      tls.CurveP256,
+	"prime256v1":     tls.CurveP256,
+	"p-384":          tls.CurveP384,
+	"p384":           tls.CurveP384,
+	"secp384r1":      tls.CurveP384,
+	"p-521":          tls.CurveP521,
+	"p521":           tls.CurveP521,
+	"secp521r1":      tls.CurveP521,
+}
+
+var presets = map[string]Settings{
+	PresetModern: {
+		MinVersion: "1.3",
+		Curves:     []string{"X25519MLKEM768", "X25519", "P-256", "P-384"},
+	},
+	PresetIntermediate: {
+		MinVersion: "1.2",
+		CipherSuites: []string{
+			"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256",
+			"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256",
+			"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384",
+			"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384",
+			"TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256",
+			"TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256",
+		},
+		Curves: []string{"X25519MLKEM768", "X25519", "P-256", "P-384"},
+	},
+	PresetLegacy: {
+		MinVersion: "1.0",
+		CipherSuites: []string{
+			"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256",
+			"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256",
+			"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384",
+			"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384",
+			"TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256",
+			"TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256",
+			"TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA256",
+			"TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA256",
+			"TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA",
+			"TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA",
+			"TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA",
+			"TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA",
+			"TLS_RSA_WITH_AES_128_GCM_SHA256",
+			"TLS_RSA_WITH_AES_256_GCM_SHA384",
+			"TLS_RSA_WITH_AES_128_CBC_SHA256",
+			"TLS_RSA_WITH_AES_128_CBC_SHA",
+			"TLS_RSA_WITH_AES_256_CBC_SHA",
+			"TLS_RSA_WITH_3DES_EDE_CBC_SHA",
+		},
+		Curves: []string{"X25519", "P-256", "P-384", "P-521"},
+	},
+}
+
+// ParseVersion "1.2" to tls.VersionTLS12, 0 if empty
+func ParseVersion(value string) (uint16, error) {
+	if value == "" {
+		return 0, nil
+	}
+	if v, ok := versions[strings.TrimPrefix(strings.ToLower(value), "tls")]; ok {
+		return v, nil
+	}
+	return 0, fmt.Errorf("unknown TLS version %q", value)
+}
+
+// ParseCipherSuites go names of cipher suites, insecure suites allowed for legacy clients
+func ParseCipherSuites(values []string) ([]uint16, error) {
+
+	res := []uint16{}
+	all := append(tls.CipherSuites(), tls.InsecureCipherSuites()...)
+
+	for _, v := range values {
+		i := slices.IndexFunc(all, func(s *tls.CipherSuite) bool { return strings.EqualFold(s.Name, v) })
+		if i < 0 {
+			return nil, fmt.Errorf("unknown TLS cipher suite %q", v)
+		}
+		res = append(res, all[i].ID)
+	}
+
+	return res, nil
+}
+
+// ParseCurves "X25519", "P-256", "secp384r1"
+func ParseCurves(values []string) ([]tls.CurveID, error) {
+
+	res := []tls.CurveID{}
+
+	for _, v := range values {
+		id, ok := curves[strings.ToLower(v)]
+		if !ok {
+			return nil, fmt.Errorf("unknown TLS curve %q", v)
+		}
+		res = append(res, id)
+	}
+
+	return res, nil
+}
+
+// Resolve settings with empty values from preset
+func (x Settings) Resolve() (Settings, error) {
+
+	if x.Preset == "" {
+		return x, nil
+	}
+
+	preset, ok := presets[x.Preset]
+	if !ok {
+		return x, fmt.Errorf("unknown TLS preset %q not one of %v", x.Preset, Presets)
+	}
+
+	if x.MinVersion == "" {
+		x.MinVersion = preset.MinVersion
+	}
+	if x.MaxVersion == "" {
+		x.MaxVersion = preset.MaxVersion
+	}
+	if len(x.CipherSuites) == 0 {
+		x.CipherSuites = preset.CipherSuites
+	}
+	if len(x.Curves) == 0 {
+		x.Curves = preset.Curves
+	}
+
+	return x, nil
+}
+
+// Apply versions, cipher suites and curves of settings to cfg
+func (x Settings) Apply(cfg *tls.Config) error {
+
+	x, err := x.Resolve()
+	if err != nil {
+		return err
+	}
+
+	if cfg.MinVersion, err = ParseVersion(x.MinVersion); err != nil {
+		return err
+	}
+	if cfg.MaxVersion, err = ParseVersion(x.MaxVersion); err != nil {
+		return err
+	}
+	if cfg.MinVersion != 0 && cfg.MaxVersion != 0 && cfg.MinVersion > cfg.MaxVersion {
+		return fmt.Errorf("TLS min version %v above max version %v", x.MinVersion, x.MaxVersion)
+	}
+
+	cfg.CipherSuites = nil
+	if len(x.CipherSuites) > 0 {
+		if cfg.CipherSuites, err = ParseCipherSuites(x.CipherSuites); err != nil {
+			return err
+		}
+	}
+
+	cfg.CurvePreferences = nil
+	if len(x.Curves) > 0 {
+		if cfg.CurvePreferences, err = ParseCurves(x.Curves); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Describe effective settings of cfg for logs, go defaults if not set
+func Describe(cfg *tls.Config) string {
+
+	version := func(v uint16, def string) string {
+		if v == 0 {
+			return def
+		}
+		return tls.VersionName(v)
+	}
+
+	ciphers := "default"
+	if len(cfg.CipherSuites) > 0 {
+		names := []string{}
+		for _, v := range cfg.CipherSuites {
+			names = append(names, tls.CipherSuiteName(v))
+		}
+		ciphers = strings.Join(names, ",")
+	}
+
+	curveNames := "default"
+	if len(cfg.CurvePreferences) > 0 {
+		names := []string{}
+		for _, v := range cfg.CurvePreferences {
+			names = append(names, v.String())
+		}
+		curveNames = strings.Join(names, ",")
+	}
+
+	return fmt.Sprintf("min: %v max: %v ciphers: %v curves: %v",
+		version(cfg.MinVersion, "default"), version(cfg.MaxVersion, "default"), ciphers, curveNames)
+}
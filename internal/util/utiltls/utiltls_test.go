@@ -0,0 +1,83 @@
+package utiltls
+
+import (
+	"crypto/tls"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestSettings_Apply(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		settings Settings
+		min      uint16
+		max      uint16
+		ciphers  int
+		curves   []tls.CurveID
+		wantErr  bool
+	}{
+		{name: "go defaults", settings: Settings{}},
+		{name: "modern", settings: Settings{Preset: PresetModern}, min: tls.VersionTLS13, curves: []tls.CurveID{tls.X25519MLKEM768, tls.X25519, tls.CurveP256, tls.CurveP384}},
+		{name: "intermediate", settings: Settings{Preset: PresetIntermediate}, min: tls.VersionTLS12, ciphers: 6, curves: []tls.CurveID{tls.X25519MLKEM768, tls.X25519, tls.CurveP256, tls.CurveP384}},
+		{name: "legacy", settings: Settings{Preset: PresetLegacy}, min: tls.VersionTLS10, ciphers: 18, curves: []tls.CurveID{tls.X25519, tls.CurveP256, tls.CurveP384, tls.CurveP521}},
+		{name: "preset override", settings: Settings{Preset: PresetIntermediate, MaxVersion: "1.2", Curves: []string{"secp384r1"}, CipherSuites: []string{"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384"}},
+			min: tls.VersionTLS12, max: tls.VersionTLS12, ciphers: 1, curves: []tls.CurveID{tls.CurveP384}},
+		{name: "unknown preset", settings: Settings{Preset: "strict"}, wantErr: true},
+		{name: "unknown version", settings: Settings{MinVersion: "1.4"}, wantErr: true},
+		{name: "min above max", settings: Settings{MinVersion: "1.3", MaxVersion: "1.2"}, wantErr: true},
+		{name: "unknown cipher", settings: Settings{CipherSuites: []string{"TLS_NULL"}}, wantErr: true},
+		{name: "unknown curve", settings: Settings{Curves: []string{"P-192"}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &tls.Config{}
+			err := tt.settings.Apply(cfg)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Apply() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if cfg.MinVersion != tt.min || cfg.MaxVersion != tt.max {
+				t.Errorf("versions = %x %x, want %x %x", cfg.MinVersion, cfg.MaxVersion, tt.min, tt.max)
+			}
+			if len(cfg.CipherSuites) != tt.ciphers {
+				t.Errorf("cipher suites = %v, want %v", len(cfg.CipherSuites), tt.ciphers)
+			}
+			if !slices.Equal(cfg.CurvePreferences, tt.curves) {
+				t.Errorf("curves = %v, want %v", cfg.CurvePreferences, tt.curves)
+			}
+		})
+	}
+}
+
+func TestDescribe(t *testing.T) {
+
+	cfg := &tls.Config{}
+	if got := Describe(cfg); got != "min: default max: default ciphers: default curves: default" {
+		t.Errorf("Describe() = %v", got)
+	}
+
+	if err := (Settings{Preset: PresetIntermediate}).Apply(cfg); err != nil {
+		t.Fatal(err)
+	}
+	got := Describe(cfg)
+	for _, want := range []string{"min: TLS 1.2", "TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256", "X25519"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("Describe() = %v, want contains %v", got, want)
+		}
+	}
+}
+
+func TestParseVersion(t *testing.T) {
+	for value, want := range map[string]uint16{"": 0, "1.2": tls.VersionTLS12, "TLS1.3": tls.VersionTLS13, "tls1.0": tls.VersionTLS10} {
+		if got, err := ParseVersion(value); err != nil || got != want {
+			t.Errorf("ParseVersion(%q) = %x, %v, want %x", value, got, err, want)
+		}
+	}
+	if _, err := ParseVersion("ssl3"); err == nil {
+		t.Errorf("expected error for ssl3")
+	}
+}